@@ -1,22 +1,160 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
 
+	"github.com/RGood/fs-xfer/pkg/auth"
+	"github.com/RGood/fs-xfer/pkg/backend"
+	"github.com/RGood/fs-xfer/pkg/certs"
+	"github.com/RGood/fs-xfer/pkg/codec"
 	filesystem "github.com/RGood/fs-xfer/pkg/generated/filesystem"
 	"github.com/RGood/fs-xfer/pkg/server"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 func main() {
+	dedup := flag.Bool("dedup", false, "store uploads in a content-addressed chunk store, so shared content is stored once")
+	bucket := flag.String("s3-bucket", "", "store files in this S3 bucket instead of ./data")
+	prefix := flag.String("s3-prefix", "", "key prefix to store files under in the S3 bucket")
+	endpoint := flag.String("s3-endpoint", "", "URL of an S3-compatible server to use instead of AWS")
+	region := flag.String("s3-region", "us-east-1", "region of the S3 bucket")
+	compressAtRest := flag.String("compress-at-rest", "none", "compress the chunks of the chunk store with zstd or gzip; requires -dedup")
+	compressLevel := flag.Int("compress-level", 0, "codec specific level for -compress-at-rest, or 0 for the codec's default")
+	defaultTTL := flag.Duration("default-ttl", 0, "delete uploads that don't ask for a time to live after this long, or 0 to keep them")
+	maxTTL := flag.Duration("max-ttl", 0, "cap the time to live of every upload at this, or 0 for no cap")
+	sessionTimeout := flag.Duration("session-timeout", 24*time.Hour, "discard upload sessions that receive nothing for this long, or 0 to keep them")
+	uploadQuota := flag.Int64("upload-quota", 0, "largest upload in bytes, or 0 for no limit")
+	principalQuota := flag.Int64("principal-quota", 0, "bytes each principal may store, or 0 for no limit")
+	totalQuota := flag.Int64("total-quota", 0, "bytes the server may store in total, or 0 for no limit")
+	tlsCert := flag.String("tls-cert", "", "serve TLS with this PEM certificate; reloaded when it changes")
+	tlsKey := flag.String("tls-key", "", "PEM private key of -tls-cert; reloaded when it changes")
+	clientCA := flag.String("tls-client-ca", "", "require client certificates signed by a CA in this PEM file; reloaded when it changes")
+	tokenFile := flag.String("auth-tokens", "", "accept the bearer tokens in this file, one principal and token per line")
+	keySet := flag.String("auth-jwks", "", "accept JWTs signed with a key from this JSON Web Key Set file")
+	issuer := flag.String("auth-jwt-issuer", "", "only accept JWTs with this issuer")
+	audience := flag.String("auth-jwt-audience", "", "only accept JWTs for this audience")
+	policyFile := flag.String("policy", "", "only allow what the rules in this JSON policy file allow; reloaded when it changes")
+	shareKeyFile := flag.String("share-key", "", "sign share links with the key in this file, of at least 32 bytes")
+	flag.Parse()
+
+	compression, err := codec.Parse(*compressAtRest)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if compression != filesystem.Compression_UNCOMPRESSED && !*dedup {
+		log.Fatal("-compress-at-rest requires -dedup")
+	}
+
+	root := "./data"
+	var storage, chunks backend.Backend = backend.NewLocal(root), backend.NewLocal(filepath.Join(root, ".chunks"))
+	if *bucket != "" {
+		client, err := newS3Client(*endpoint, *region)
+		if err != nil {
+			log.Fatalf("failed to create S3 client: %v", err)
+		}
+		storage = backend.NewS3(client, *bucket, *prefix)
+		chunks = backend.NewS3(client, *bucket, path.Join(*prefix, ".chunks"))
+	}
+
+	opts := []server.Option{
+		server.WithUploadTTL(*defaultTTL, *maxTTL),
+		server.WithSessionTimeout(*sessionTimeout),
+		server.WithQuotas(server.Quotas{Upload: *uploadQuota, Principal: *principalQuota, Total: *totalQuota}),
+	}
+	if *dedup {
+		store, err := server.NewChunkStore(chunks, server.WithChunkCompression(compression, *compressLevel))
+		if err != nil {
+			log.Fatalf("failed to open chunk store: %v", err)
+		}
+		opts = append(opts, server.WithChunkStore(store))
+	}
+	if *policyFile != "" {
+		policy, err := server.LoadPolicy(*policyFile)
+		if err != nil {
+			log.Fatalf("failed to load policy: %v", err)
+		}
+		opts = append(opts, server.WithPolicy(policy))
+	}
+	if *shareKeyFile != "" {
+		key, err := os.ReadFile(*shareKeyFile)
+		if err != nil {
+			log.Fatalf("failed to read share key: %v", err)
+		}
+		if len(key) < 32 {
+			log.Fatal("-share-key must hold at least 32 bytes")
+		}
+		opts = append(opts, server.WithShareKey(key))
+	}
+
 	lis, err := net.Listen("tcp", ":50051")
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
-	grpcServer := grpc.NewServer()
-	filesystem.RegisterStorageServiceServer(grpcServer, server.NewLocalStorageService("./data"))
+	var serverOpts []grpc.ServerOption
+	if *tlsCert != "" || *tlsKey != "" {
+		config, err := certs.ServerConfig(*tlsCert, *tlsKey, *clientCA)
+		if err != nil {
+			log.Fatalf("failed to configure TLS: %v", err)
+		}
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(config)))
+	} else if *clientCA != "" {
+		log.Fatal("-tls-client-ca requires -tls-cert and -tls-key")
+	}
+
+	var authenticators []auth.Authenticator
+	if *tokenFile != "" {
+		tokens, err := auth.LoadStaticTokens(*tokenFile)
+		if err != nil {
+			log.Fatalf("failed to load tokens: %v", err)
+		}
+		authenticators = append(authenticators, tokens)
+	}
+	if *keySet != "" {
+		jwts, err := auth.LoadJWTAuthenticator(*keySet, auth.JWTOptions{Issuer: *issuer, Audience: *audience})
+		if err != nil {
+			log.Fatalf("failed to load key set: %v", err)
+		}
+		authenticators = append(authenticators, jwts)
+	}
+	if len(authenticators) > 0 {
+		// Clients only send tokens over TLS
+		if *tlsCert == "" {
+			log.Fatal("-auth-tokens and -auth-jwks require -tls-cert and -tls-key")
+		}
+		a := auth.Any(authenticators...)
+		serverOpts = append(serverOpts, grpc.UnaryInterceptor(server.UnaryAuthInterceptor(a)), grpc.StreamInterceptor(server.StreamAuthInterceptor(a)))
+	}
+
+	grpcServer := grpc.NewServer(serverOpts...)
+	filesystem.RegisterStorageServiceServer(grpcServer, server.NewStorageService(storage, opts...))
 	if err := grpcServer.Serve(lis); err != nil {
 		log.Fatalf("failed to serve: %v", err)
 	}
 }
+
+// newS3Client creates an S3 client with the default AWS credential chain.
+// A custom endpoint, such as a local S3-compatible server, is addressed path-style.
+func newS3Client(endpoint string, region string) (*s3.Client, error) {
+	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(region))
+	if err != nil {
+		return nil, err
+	}
+
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	}), nil
+}
@@ -1,16 +1,28 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/RGood/fs-xfer/pkg/certs"
 	"github.com/RGood/fs-xfer/pkg/client"
+	"github.com/RGood/fs-xfer/pkg/codec"
+	"github.com/RGood/fs-xfer/pkg/generated/filesystem"
 	"github.com/RGood/fs-xfer/pkg/units"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
@@ -25,29 +37,300 @@ func resolveHomeDir(path string) string {
 	return path
 }
 
-func prettyPrintManifest(entries []client.FSEntry, depth int) {
-	if entries == nil {
-		return
+func prettyPrintEntry(entry client.FSEntry, depth int, long bool) {
+	name := strings.Repeat("  ", depth) + entry.GetName()
+	if !long {
+		fmt.Println(name)
+	} else {
+		// Folders are streamed before their contents, so their size isn't known yet
+		size := "-"
+		if !entry.GetMode().IsDir() {
+			size = units.FormatBytesIEC(entry.GetSize())
+		}
+		fmt.Printf("%s %10s %s %s%s\n", entry.GetMode(), size, entry.GetModTime().Format("2006-01-02 15:04"), name, details(entry))
+	}
+}
+
+// details describes the symlink target and digest of a file in the long listing.
+func details(entry client.FSEntry) string {
+	f, ok := entry.(*client.File)
+	if !ok {
+		return ""
+	}
+
+	var s string
+	if f.GetLinkTarget() != "" {
+		s += " -> " + f.GetLinkTarget()
+	}
+	if f.GetSha256() != nil {
+		s += fmt.Sprintf(" sha256:%x", f.GetSha256())
+	}
+	return s
+}
+
+// diskUsage totals the size of every folder in a streamed listing like du, printing each folder once everything under it was listed.
+type diskUsage struct {
+	root string
+	// open holds the folders being listed from the root down, with the size of what was listed under each so far.
+	open []folderUsage
+}
+
+type folderUsage struct {
+	path string
+	size int64
+}
+
+func newDiskUsage(root string) *diskUsage {
+	return &diskUsage{root: root, open: []folderUsage{{}}}
+}
+
+func (d *diskUsage) add(relPath string, entry client.FSEntry) {
+	for len(d.open) > 1 && !strings.HasPrefix(relPath, d.open[len(d.open)-1].path+"/") {
+		d.pop()
+	}
+
+	if _, ok := entry.(*client.Folder); ok {
+		d.open = append(d.open, folderUsage{path: relPath})
+	} else if entry.GetMode()&fs.ModeSymlink == 0 {
+		d.open[len(d.open)-1].size += entry.GetSize()
+	}
+}
+
+// pop prints the innermost open folder and adds its size to the folder holding it.
+func (d *diskUsage) pop() {
+	folder := d.open[len(d.open)-1]
+	d.open = d.open[:len(d.open)-1]
+	if len(d.open) > 0 {
+		d.open[len(d.open)-1].size += folder.size
+	}
+
+	fmt.Printf("%10s  %s/\n", units.FormatBytesIEC(folder.size), path.Join(d.root, folder.path))
+}
+
+func (d *diskUsage) flush() {
+	for len(d.open) > 0 {
+		d.pop()
+	}
+}
+
+// copyLines copies the first n lines of r to w.
+func copyLines(w io.Writer, r io.Reader, n int) error {
+	br := bufio.NewReader(r)
+	for n > 0 {
+		// Lines longer than the buffer are copied in pieces
+		line, err := br.ReadSlice('\n')
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+
+		switch {
+		case err == nil:
+			n--
+		case err == io.EOF:
+			return nil
+		case err != bufio.ErrBufferFull:
+			return err
+		}
+	}
+	return nil
+}
+
+// statOutput describes a remote path for the stat command.
+type statOutput struct {
+	Path   string    `json:"path"`
+	Type   string    `json:"type"`
+	Size   int64     `json:"size"`
+	Mode   string    `json:"mode"`
+	Mtime  time.Time `json:"mtime"`
+	Target string    `json:"target,omitempty"`
+	Sha256 string    `json:"sha256,omitempty"`
+}
+
+func newStatOutput(remotePath string, entry client.FSEntry) statOutput {
+	out := statOutput{
+		Path:  remotePath,
+		Type:  "file",
+		Size:  entry.GetSize(),
+		Mode:  fmt.Sprintf("%04o", entry.GetMode().Perm()),
+		Mtime: entry.GetModTime().UTC(),
+	}
+
+	switch {
+	case entry.GetMode().IsDir():
+		out.Type = "directory"
+	case entry.GetMode()&fs.ModeSymlink != 0:
+		out.Type = "symlink"
+	}
+	if f, ok := entry.(*client.File); ok {
+		out.Target = f.GetLinkTarget()
+		if f.GetSha256() != nil {
+			out.Sha256 = hex.EncodeToString(f.GetSha256())
+		}
+	}
+	return out
+}
+
+func (o statOutput) print() {
+	fmt.Printf("    Path: %s\n", o.Path)
+	fmt.Printf("    Type: %s\n", o.Type)
+	if o.Type != "directory" {
+		fmt.Printf("    Size: %s (%d bytes)\n", units.FormatBytesIEC(o.Size), o.Size)
+	}
+	fmt.Printf("    Mode: %s\n", o.Mode)
+	fmt.Printf("Modified: %s\n", o.Mtime.Local().Format(time.RFC3339))
+	if o.Target != "" {
+		fmt.Printf("  Target: %s\n", o.Target)
 	}
+	if o.Sha256 != "" {
+		fmt.Printf("  SHA256: %s\n", o.Sha256)
+	}
+}
+
+// formatQuota describes how much of a quota is used, or only what's used when the quota is unset.
+func formatQuota(used int64, quota int64) string {
+	if quota <= 0 {
+		return fmt.Sprintf("%s (no quota)", units.FormatBytesIEC(used))
+	}
+	return fmt.Sprintf("%s of %s (%.1f%%)", units.FormatBytesIEC(used), units.FormatBytesIEC(quota), float64(used)*100/float64(quota))
+}
+
+// overwritePolicies maps the values of --overwrite to what the server does with an existing destination.
+var overwritePolicies = map[string]filesystem.OverwritePolicy{
+	"fail":          filesystem.OverwritePolicy_FAIL,
+	"replace":       filesystem.OverwritePolicy_REPLACE,
+	"skip-existing": filesystem.OverwritePolicy_SKIP_EXISTING,
+	"merge":         filesystem.OverwritePolicy_MERGE,
+}
+
+// uploadFlags adds the --dest, --overwrite and --ttl flags to a command.
+// The returned function gives the upload options they select once the flags are parsed.
+func uploadFlags(flags *flag.FlagSet) func() client.UploadOptions {
+	dest := flags.String("dest", "", "Remote folder to upload into instead of a new one")
+	overwrite := flags.String("overwrite", "fail", "What to do when --dest exists: fail, replace, skip-existing or merge")
+	ttl := flags.Duration("ttl", 0, "How long the server keeps the upload before deleting it, such as 24h, or 0 for the server's default")
 
-	client.SortEntries(entries)
-	for _, entry := range entries {
-		fmt.Printf("%s%s\n", strings.Repeat("  ", depth), entry.GetName())
-		prettyPrintManifest(entry.GetChildren(), depth+1)
+	return func() client.UploadOptions {
+		policy, ok := overwritePolicies[*overwrite]
+		if !ok {
+			flagError("unknown overwrite policy: %s", *overwrite)
+		}
+		if *ttl < 0 {
+			flagError("negative --ttl: %s", *ttl)
+		}
+		return client.UploadOptions{Destination: *dest, Overwrite: policy, TTL: *ttl}
+	}
+}
+
+// flagError prints a problem with a flag's value and exits with the status the flag package uses for invalid flags.
+func flagError(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(2)
+}
+
+// transferFlags adds the --compress, --compress-level and --parallel flags to a command.
+// The returned function gives the client options they select once the flags are parsed.
+func transferFlags(flags *flag.FlagSet) func() []client.Option {
+	name := flags.String("compress", "none", "Compress transferred chunks with zstd or gzip")
+	level := flags.Int("compress-level", 0, "Codec specific compression level, or 0 for the codec's default")
+	streams := flags.Int("parallel", 1, "Number of concurrent streams to split the transfer across")
+
+	return func() []client.Option {
+		compression, err := codec.Parse(*name)
+		if err != nil {
+			flagError("%v", err)
+		}
+
+		opts := []client.Option{client.WithParallel(*streams)}
+		if compression != filesystem.Compression_UNCOMPRESSED {
+			opts = append(opts, client.WithCompression(compression, *level))
+		}
+		return opts
 	}
 }
 
 func printHelp() {
-	fmt.Println("Usage: fs <remote_host> <command> [flags] <args>")
+	fmt.Println("Usage: fs [--tls] [--ca <file>] [--cert <file> --key <file>] [--server-name <name>] <remote_host> <command> [flags] <args>")
 	fmt.Println("Commands:")
-	fmt.Println("  upload <local_folder>              Upload a folder to the target url")
-	fmt.Println("  cp <folder>:<local_folder>         Download a folder from the target url")
-	fmt.Println("  ls [-r] <folder>                   List the manifest of a remote folder")
+	fmt.Println("  upload [--dest <folder>] [--overwrite <policy>] [--ttl <duration>] [--no-owner] [--compress <codec>] [--compress-level <n>] [--parallel <n>] <local_folder>")
+	fmt.Println("                                     Upload a folder to the target url")
+	fmt.Println("  put [--dest <folder>] [--overwrite <policy>] [--ttl <duration>] [--compress <codec>] [--compress-level <n>] <local_file|-> <name>")
+	fmt.Println("                                     Upload a file, or stdin with -, as a file with the given name")
+	fmt.Println("  cp [--delta] [--no-owner] [--share <token>] [--compress <codec>] [--compress-level <n>] [--parallel <n>] <folder>:<local_folder>")
+	fmt.Println("                                     Download a folder from the target url")
+	fmt.Println("  ls [-r] [-l] [--du] [--checksum] <folder>")
+	fmt.Println("                                     List the manifest of a remote folder")
+	fmt.Println("  sync [--delete] [--checksum] [--delta] [--no-owner] [--compress <codec>] [--compress-level <n>] [--parallel <n>] <local_folder>:<folder>")
+	fmt.Println("                                     Upload new or changed files into an existing remote folder")
+	fmt.Println("  cat [--offset <n>] [--length <n>] [--share <token>] <file>")
+	fmt.Println("                                     Print a remote file, or part of it, to stdout")
+	fmt.Println("  head [-n <lines>] [-c <bytes>] [--share <token>] <file>")
+	fmt.Println("                                     Print the first lines or bytes of a remote file")
+	fmt.Println("  stat [--json] [--checksum] <folder>")
+	fmt.Println("                                     Show the type, size, mode and modification time of a remote path")
+	fmt.Println("  usage                              Show how much you and the server store, and the quotas that apply")
+	fmt.Println("  share [--ttl <duration>] [--max-downloads <n>] <folder>")
+	fmt.Println("                                     Create a link that downloads a remote path without credentials until it expires")
+	fmt.Println("  rm [-r] <folder>                   Delete a remote file, or a folder with -r")
+	fmt.Println("  mv <folder> <folder>               Move a remote file or folder")
+	fmt.Println("  remote-cp <folder> <folder>        Copy a remote file or folder on the server")
 	fmt.Println("  help                               Show this help message")
+	fmt.Println("Codecs: zstd, gzip, none")
+	fmt.Println("Overwrite policies: fail, replace, skip-existing, merge")
+	fmt.Println("Connections are plaintext unless a TLS flag is given before the remote host")
+	fmt.Println("Calls authenticate with the token in $FS_XFER_TOKEN, or else in fs-xfer/token in your config directory")
+}
+
+// connectionFlags adds the flags that secure the connection to the server, which come before the address.
+// The returned function gives the transport credentials they select once the flags are parsed.
+func connectionFlags(flags *flag.FlagSet) func() credentials.TransportCredentials {
+	useTLS := flags.Bool("tls", false, "Connect with TLS, verifying the server against the system's CAs unless --ca is given")
+	ca := flags.String("ca", "", "Verify the server against the CA certificates in this PEM file; implies --tls")
+	cert := flags.String("cert", "", "Present this PEM client certificate to servers that ask for one; implies --tls")
+	key := flags.String("key", "", "PEM private key of --cert")
+	serverName := flags.String("server-name", "", "Name the server's certificate must be valid for, instead of the host dialed; implies --tls")
+
+	return func() credentials.TransportCredentials {
+		if !*useTLS && *ca == "" && *cert == "" && *key == "" && *serverName == "" {
+			return insecure.NewCredentials()
+		}
+
+		config, err := certs.ClientConfig(*ca, *cert, *key, *serverName)
+		if err != nil {
+			panic(err)
+		}
+		return credentials.NewTLS(config)
+	}
+}
+
+// tokenEnv names the environment variable that holds the token to authenticate with.
+const tokenEnv = "FS_XFER_TOKEN"
+
+// loadToken returns the token to authenticate with from the environment, or else from the token file in the
+// user's config directory. It returns an empty string when there's neither.
+func loadToken() string {
+	if token := os.Getenv(tokenEnv); token != "" {
+		return token
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "fs-xfer", "token"))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			panic(err)
+		}
+		return ""
+	}
+	return strings.TrimSpace(string(data))
 }
 
 func main() {
-	args := os.Args
+	transportCredentials := connectionFlags(flag.CommandLine)
+	flag.Usage = printHelp
+	flag.Parse()
+	args := append([]string{os.Args[0]}, flag.Args()...)
 
 	if len(args) < 3 {
 		printHelp()
@@ -55,69 +338,348 @@ func main() {
 	}
 
 	url := args[1]
+	transport := transportCredentials()
+	token := loadToken()
+	// Tokens are never sent in plaintext, so every call would fail
+	if token != "" && transport.Info().SecurityProtocol == "insecure" {
+		fmt.Fprintf(os.Stderr, "A token is set in $%s or your token file, but tokens are only sent over TLS. Pass --tls or --ca before the address.\n", tokenEnv)
+		os.Exit(2)
+	}
+
 	conn, err := grpc.NewClient(
 		url,
 		grpc.WithTransportCredentials(
-			insecure.NewCredentials(),
+			transport,
 		),
 	)
 	if err != nil {
 		panic(err)
 	}
 
-	c := client.NewStorageClient(conn)
+	// Every client authenticates with the token, if there is one
+	var authOpts []client.Option
+	if token != "" {
+		authOpts = append(authOpts, client.WithCredentials(client.TokenCredentials(token)))
+	}
+	newClient := func(opts ...client.Option) *client.StorageClient {
+		return client.NewStorageClient(conn, append(opts, authOpts...)...)
+	}
+
+	c := newClient()
 
 	if strings.ToLower(args[2]) == "upload" {
-		if len(args) != 4 {
-			fmt.Println("Usage: fs <url> upload <folder>")
+		uploadArgs := flag.NewFlagSet("upload", flag.ExitOnError)
+		noOwner := uploadArgs.Bool("no-owner", false, "Don't send the owners of uploaded files")
+		uploadOpts := uploadFlags(uploadArgs)
+		transfer := transferFlags(uploadArgs)
+		uploadArgs.Parse(args[3:])
+
+		if uploadArgs.NArg() != 1 {
+			fmt.Println("Usage: fs <url> upload [--dest <folder>] [--overwrite <policy>] [--ttl <duration>] [--no-owner] [--compress <codec>] [--compress-level <n>] [--parallel <n>] <folder>")
 			return
 		}
-		remoteAddr, size, err := c.Upload(context.Background(), resolveHomeDir(args[3]))
+		opts := transfer()
+		if *noOwner {
+			opts = append(opts, client.WithoutOwnership())
+		}
+		c = newClient(opts...)
+
+		remoteAddr, size, err := c.UploadTo(context.Background(), resolveHomeDir(uploadArgs.Arg(0)), uploadOpts())
 		if err != nil {
 			panic(err)
 		}
 		fmt.Printf("Uploaded %s bytes to %s\n", units.FormatBytesIEC(size), remoteAddr)
+	} else if strings.ToLower(args[2]) == "put" {
+		putArgs := flag.NewFlagSet("put", flag.ExitOnError)
+		uploadOpts := uploadFlags(putArgs)
+		transfer := transferFlags(putArgs)
+		putArgs.Parse(args[3:])
+
+		if putArgs.NArg() != 2 {
+			fmt.Println("Usage: fs <url> put [--dest <folder>] [--overwrite <policy>] [--ttl <duration>] [--compress <codec>] [--compress-level <n>] <local_file|-> <remote_name>")
+			return
+		}
+		destination := uploadOpts()
+		c = newClient(transfer()...)
+
+		r := os.Stdin
+		if putArgs.Arg(0) != "-" {
+			f, err := os.Open(resolveHomeDir(putArgs.Arg(0)))
+			if err != nil {
+				panic(err)
+			}
+			defer f.Close()
+			r = f
+		}
+
+		remoteAddr, size, err := c.UploadReader(context.Background(), r, putArgs.Arg(1), destination)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Uploaded %s bytes to %s\n", units.FormatBytesIEC(size), path.Join(remoteAddr, putArgs.Arg(1)))
 	} else if strings.ToLower(args[2]) == "help" {
 		printHelp()
 	} else if strings.ToLower(args[2]) == "manifest" || strings.ToLower(args[2]) == "ls" {
 		manifestArgs := flag.NewFlagSet("manifest", flag.ExitOnError)
 		recursive := manifestArgs.Bool("r", false, "List files recursively")
+		long := manifestArgs.Bool("l", false, "Show the mode, size and modification time of each entry")
+		du := manifestArgs.Bool("du", false, "Show the total size of every folder instead of listing files")
+		checksum := manifestArgs.Bool("checksum", false, "Show the SHA-256 of each file in the long listing")
 		manifestArgs.Parse(args[3:])
 
-		if len(args) < 4 {
-			fmt.Println("Usage: fs <url> ls <folder>")
+		if manifestArgs.NArg() != 1 {
+			fmt.Println("Usage: fs <url> ls [-r] [-l] [--du] [--checksum] <folder>")
 			return
 		}
 
-		manifest, err := c.GetManifest(context.Background(), manifestArgs.Arg(0), *recursive)
+		if *du {
+			usage := newDiskUsage(path.Clean(manifestArgs.Arg(0)))
+			err = c.WalkManifest(context.Background(), manifestArgs.Arg(0), true, false, func(relPath string, entry client.FSEntry) error {
+				usage.add(relPath, entry)
+				return nil
+			})
+			if err != nil {
+				panic(err)
+			}
+			usage.flush()
+		} else {
+			err = c.WalkManifest(context.Background(), manifestArgs.Arg(0), *recursive, *checksum && *long, func(relPath string, entry client.FSEntry) error {
+				prettyPrintEntry(entry, strings.Count(relPath, "/"), *long)
+				return nil
+			})
+			if err != nil {
+				panic(err)
+			}
+		}
+	} else if strings.ToLower(args[2]) == "cp" || strings.ToLower(args[2]) == "download" {
+		cpArgs := flag.NewFlagSet("cp", flag.ExitOnError)
+		useDelta := cpArgs.Bool("delta", false, "Only transfer the blocks of existing local files that changed")
+		noOwner := cpArgs.Bool("no-owner", false, "Don't restore the owners of downloaded files")
+		share := cpArgs.String("share", "", "Download with a share link token instead of your credentials")
+		transfer := transferFlags(cpArgs)
+		cpArgs.Parse(args[3:])
+
+		parts := strings.SplitN(cpArgs.Arg(0), ":", 2)
+		if cpArgs.NArg() != 1 || len(parts) != 2 {
+			fmt.Println("Usage: fs <url> cp [--delta] [--no-owner] [--share <token>] [--compress <codec>] [--compress-level <n>] [--parallel <n>] <folder>:<local_folder>")
+			return
+		}
+		opts := transfer()
+		if *noOwner {
+			opts = append(opts, client.WithoutOwnership())
+		}
+		if *share != "" {
+			opts = append(opts, client.WithShareToken(*share))
+		}
+		c = newClient(opts...)
+
+		resolvedFolder, err := filepath.Abs(resolveHomeDir(parts[1]))
 		if err != nil {
 			panic(err)
 		}
 
-		prettyPrintManifest(manifest, 0)
-	} else if strings.ToLower(args[2]) == "cp" || strings.ToLower(args[2]) == "download" {
-		if len(args) != 4 {
-			fmt.Println("Usage: fs <url> cp <folder>:<local_folder>")
+		println("Downloading", parts[0], "to", resolvedFolder)
+		download := c.Download
+		if *useDelta {
+			download = c.DownloadDelta
+		}
+		size, err := download(context.Background(), parts[0], resolvedFolder)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Downloaded %s bytes to %s\n", units.FormatBytesIEC(size), resolvedFolder)
+	} else if strings.ToLower(args[2]) == "sync" {
+		syncArgs := flag.NewFlagSet("sync", flag.ExitOnError)
+		deleteExtra := syncArgs.Bool("delete", false, "Delete remote files that don't exist locally")
+		checksum := syncArgs.Bool("checksum", false, "Compare file contents instead of sizes and modification times")
+		useDelta := syncArgs.Bool("delta", false, "Only transfer the blocks of changed files that differ from the remote copy")
+		noOwner := syncArgs.Bool("no-owner", false, "Don't send the owners of uploaded files")
+		transfer := transferFlags(syncArgs)
+		syncArgs.Parse(args[3:])
+
+		parts := strings.SplitN(syncArgs.Arg(0), ":", 2)
+		if syncArgs.NArg() != 1 || len(parts) != 2 {
+			fmt.Println("Usage: fs <url> sync [--delete] [--checksum] [--delta] [--no-owner] [--compress <codec>] [--compress-level <n>] [--parallel <n>] <local_folder>:<folder>")
 			return
 		}
+		opts := transfer()
+		if *noOwner {
+			opts = append(opts, client.WithoutOwnership())
+		}
+		c = newClient(opts...)
 
-		parts := strings.SplitN(args[3], ":", 2)
-		if len(parts) != 2 {
-			fmt.Println("Usage: fs <url> cp <folder>:<local_folder>")
+		result, err := c.Sync(context.Background(), resolveHomeDir(parts[0]), parts[1], client.SyncOptions{
+			Delete:   *deleteExtra,
+			Checksum: *checksum,
+			Delta:    *useDelta,
+		})
+		if err != nil {
+			panic(err)
+		}
+
+		for _, p := range result.Uploaded {
+			fmt.Println("+", p)
+		}
+		for _, p := range result.Deleted {
+			fmt.Println("-", p)
+		}
+		fmt.Printf("Synced %d files (%s bytes) to %s, deleted %d\n", len(result.Uploaded), units.FormatBytesIEC(result.Size), parts[1], len(result.Deleted))
+	} else if strings.ToLower(args[2]) == "cat" {
+		catArgs := flag.NewFlagSet("cat", flag.ExitOnError)
+		offset := catArgs.Int64("offset", 0, "Byte to start printing from")
+		length := catArgs.Int64("length", 0, "Number of bytes to print, or 0 for the rest of the file")
+		share := catArgs.String("share", "", "Read with a share link token instead of your credentials")
+		transfer := transferFlags(catArgs)
+		catArgs.Parse(args[3:])
+
+		if catArgs.NArg() != 1 {
+			fmt.Println("Usage: fs <url> cat [--offset <n>] [--length <n>] [--share <token>] [--compress <codec>] [--compress-level <n>] <file>")
 			return
 		}
+		opts := transfer()
+		if *share != "" {
+			opts = append(opts, client.WithShareToken(*share))
+		}
+		c = newClient(opts...)
 
-		resolvedFolder, err := filepath.Abs(resolveHomeDir(parts[1]))
+		r, err := c.OpenFile(context.Background(), catArgs.Arg(0), *offset, *length)
 		if err != nil {
 			panic(err)
 		}
+		defer r.Close()
 
-		println("Downloading", parts[0], "to", resolvedFolder)
-		size, err := c.Download(context.Background(), parts[0], resolvedFolder)
+		if _, err := io.Copy(os.Stdout, r); err != nil {
+			panic(err)
+		}
+	} else if strings.ToLower(args[2]) == "head" {
+		headArgs := flag.NewFlagSet("head", flag.ExitOnError)
+		lines := headArgs.Int("n", 10, "Number of lines to print")
+		bytes := headArgs.Int64("c", 0, "Number of bytes to print instead of lines")
+		share := headArgs.String("share", "", "Read with a share link token instead of your credentials")
+		headArgs.Parse(args[3:])
+
+		if headArgs.NArg() != 1 {
+			fmt.Println("Usage: fs <url> head [-n <lines>] [-c <bytes>] [--share <token>] <file>")
+			return
+		}
+		if *share != "" {
+			c = newClient(client.WithShareToken(*share))
+		}
+
+		// Only the requested bytes are downloaded, and a line count stops the download once enough lines were read
+		r, err := c.OpenFile(context.Background(), headArgs.Arg(0), 0, *bytes)
 		if err != nil {
 			panic(err)
 		}
-		fmt.Printf("Downloaded %s bytes to %s\n", units.FormatBytesIEC(size), resolvedFolder)
+		defer r.Close()
+
+		if *bytes > 0 {
+			_, err = io.Copy(os.Stdout, r)
+		} else {
+			err = copyLines(os.Stdout, r, *lines)
+		}
+		if err != nil {
+			panic(err)
+		}
+	} else if strings.ToLower(args[2]) == "stat" {
+		statArgs := flag.NewFlagSet("stat", flag.ExitOnError)
+		asJSON := statArgs.Bool("json", false, "Print the result as JSON")
+		checksum := statArgs.Bool("checksum", false, "Show the SHA-256 of a file")
+		statArgs.Parse(args[3:])
+
+		if statArgs.NArg() != 1 {
+			fmt.Println("Usage: fs <url> stat [--json] [--checksum] <folder>")
+			return
+		}
+
+		entry, err := c.Stat(context.Background(), statArgs.Arg(0), *checksum)
+		if err != nil {
+			panic(err)
+		}
+
+		out := newStatOutput(statArgs.Arg(0), entry)
+		if *asJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(out); err != nil {
+				panic(err)
+			}
+		} else {
+			out.print()
+		}
+	} else if strings.ToLower(args[2]) == "usage" {
+		usage, err := c.GetUsage(context.Background())
+		if err != nil {
+			panic(err)
+		}
+
+		principal := usage.Principal
+		if principal == "" {
+			principal = "anonymous"
+		}
+		fmt.Printf("Principal: %s\n", principal)
+		fmt.Printf("     Used: %s\n", formatQuota(usage.Used, usage.Quota))
+		fmt.Printf("   Server: %s\n", formatQuota(usage.TotalUsed, usage.TotalQuota))
+		if usage.UploadQuota > 0 {
+			fmt.Printf("   Upload: up to %s each\n", units.FormatBytesIEC(usage.UploadQuota))
+		}
+	} else if strings.ToLower(args[2]) == "share" {
+		shareArgs := flag.NewFlagSet("share", flag.ExitOnError)
+		ttl := shareArgs.Duration("ttl", 24*time.Hour, "How long the link works for")
+		maxDownloads := shareArgs.Int64("max-downloads", 0, "How many times the link can be downloaded, or 0 for any number")
+		shareArgs.Parse(args[3:])
+
+		if shareArgs.NArg() != 1 {
+			fmt.Println("Usage: fs <url> share [--ttl <duration>] [--max-downloads <n>] <folder>")
+			return
+		}
+		if *ttl <= 0 {
+			flagError("--ttl must be positive: %s", *ttl)
+		}
+
+		link, err := c.CreateShareLink(context.Background(), shareArgs.Arg(0), client.ShareOptions{TTL: *ttl, MaxDownloads: *maxDownloads})
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Shared %s until %s. Download it with:\n", shareArgs.Arg(0), link.Expires.Format("2006-01-02 15:04"))
+		// The connection flags given before the address are needed to reach the server the same way
+		command := append(append([]string{"fs"}, os.Args[1:len(os.Args)-flag.NArg()]...), args[1], "cp", "--share", link.Token, ":<local_folder>")
+		fmt.Println(strings.Join(command, " "))
+	} else if strings.ToLower(args[2]) == "rm" {
+		rmArgs := flag.NewFlagSet("rm", flag.ExitOnError)
+		recursive := rmArgs.Bool("r", false, "Delete folders and everything in them")
+		rmArgs.Parse(args[3:])
+
+		if rmArgs.NArg() != 1 {
+			fmt.Println("Usage: fs <url> rm [-r] <folder>")
+			return
+		}
+
+		if err := c.Delete(context.Background(), rmArgs.Arg(0), *recursive); err != nil {
+			panic(err)
+		}
+		fmt.Printf("Deleted %s\n", rmArgs.Arg(0))
+	} else if strings.ToLower(args[2]) == "mv" {
+		if len(args) != 5 {
+			fmt.Println("Usage: fs <url> mv <source> <destination>")
+			return
+		}
+
+		if err := c.Move(context.Background(), args[3], args[4]); err != nil {
+			panic(err)
+		}
+		fmt.Printf("Moved %s to %s\n", args[3], args[4])
+	} else if strings.ToLower(args[2]) == "remote-cp" {
+		if len(args) != 5 {
+			fmt.Println("Usage: fs <url> remote-cp <source> <destination>")
+			return
+		}
+
+		size, err := c.Copy(context.Background(), args[3], args[4])
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Copied %s bytes from %s to %s\n", units.FormatBytesIEC(size), args[3], args[4])
 	} else {
 		println("Unknown command:", args[2])
 		printHelp()
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrInvalidToken is returned for tokens that no authenticator accepts.
+var ErrInvalidToken = errors.New("invalid token")
+
+// Authenticator checks bearer tokens and returns the principal each one authenticates.
+type Authenticator interface {
+	Authenticate(token string) (string, error)
+}
+
+// Any accepts tokens that any of the authenticators accepts, trying them in order.
+func Any(authenticators ...Authenticator) Authenticator {
+	return anyOf(authenticators)
+}
+
+type anyOf []Authenticator
+
+func (a anyOf) Authenticate(token string) (string, error) {
+	err := ErrInvalidToken
+	for _, authenticator := range a {
+		principal, authErr := authenticator.Authenticate(token)
+		if authErr == nil {
+			return principal, nil
+		}
+		err = authErr
+	}
+	return "", err
+}
+
+// StaticTokens accepts a fixed set of tokens, each of which authenticates a principal.
+type StaticTokens struct {
+	// principals is keyed by the SHA-256 of each token, so looking one up takes the same time however much of it matches.
+	principals map[[sha256.Size]byte]string
+}
+
+// LoadStaticTokens reads a token file. Each line holds a principal and its token separated by whitespace.
+// Blank lines and lines starting with # are ignored.
+func LoadStaticTokens(file string) (*StaticTokens, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t := &StaticTokens{principals: map[[sha256.Size]byte]string{}}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a principal and a token", file, line)
+		}
+		t.principals[sha256.Sum256([]byte(fields[1]))] = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *StaticTokens) Authenticate(token string) (string, error) {
+	principal, ok := t.principals[sha256.Sum256([]byte(token))]
+	if !ok {
+		return "", ErrInvalidToken
+	}
+	return principal, nil
+}
@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// jwtLeeway is how far the clocks of the token issuer and the server may disagree.
+const jwtLeeway = time.Minute
+
+// JWTOptions restricts which signed tokens a JWTAuthenticator accepts.
+type JWTOptions struct {
+	// Issuer, if set, must match the token's iss claim.
+	Issuer string
+	// Audience, if set, must be one of the token's aud claim.
+	Audience string
+}
+
+// JWTAuthenticator accepts JSON Web Tokens signed with a key from a local key set. The token's sub claim is the principal.
+// Tokens must expire, and are signed with RS256, ES256, EdDSA or HS256.
+type JWTAuthenticator struct {
+	// keys holds the keys of the set by key id. Each is an *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey or []byte.
+	keys map[string]any
+	opts JWTOptions
+}
+
+// jwk is a single key of a JSON Web Key Set, as described in RFC 7517.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// LoadJWTAuthenticator reads the JSON Web Key Set in file, whose RSA, P-256, Ed25519 and symmetric keys verify tokens.
+func LoadJWTAuthenticator(file string, opts JWTOptions) (*JWTAuthenticator, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("could not read key set %s: %v", file, err)
+	}
+
+	j := &JWTAuthenticator{keys: map[string]any{}, opts: opts}
+	for _, k := range set.Keys {
+		key, err := k.parse()
+		if err != nil {
+			return nil, fmt.Errorf("could not read key %q of %s: %v", k.Kid, file, err)
+		}
+		j.keys[k.Kid] = key
+	}
+	if len(j.keys) == 0 {
+		return nil, fmt.Errorf("no keys in key set %s", file)
+	}
+
+	return j, nil
+}
+
+// parse returns the key as the type the signature algorithms use it as.
+func (k jwk) parse() (any, error) {
+	switch {
+	case k.Kty == "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("invalid P-256 point")
+		}
+		return ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	case k.Kty == "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil {
+			return nil, err
+		}
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("symmetric keys must be at least 32 bytes")
+		}
+		return secret, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s %s", k.Kty, k.Crv)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// claims are the registered claims of a token that are checked. aud may be a string or a list of them.
+type claims struct {
+	Sub string          `json:"sub"`
+	Iss string          `json:"iss"`
+	Aud json.RawMessage `json:"aud"`
+	Exp *float64        `json:"exp"`
+	Nbf *float64        `json:"nbf"`
+}
+
+func (j *JWTAuthenticator) Authenticate(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	key, ok := j.keys[header.Kid]
+	if !ok {
+		return "", fmt.Errorf("%w: unknown key %q", ErrInvalidToken, header.Kid)
+	}
+	if err := verify(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return "", err
+	}
+
+	var c claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return "", err
+	}
+	if err := j.check(&c, time.Now()); err != nil {
+		return "", err
+	}
+	return c.Sub, nil
+}
+
+// check validates the claims of a token with a valid signature at now.
+func (j *JWTAuthenticator) check(c *claims, now time.Time) error {
+	switch {
+	case c.Sub == "":
+		return fmt.Errorf("%w: no subject", ErrInvalidToken)
+	case c.Exp == nil:
+		return fmt.Errorf("%w: no expiry", ErrInvalidToken)
+	case now.After(unixTime(*c.Exp).Add(jwtLeeway)):
+		return fmt.Errorf("%w: expired", ErrInvalidToken)
+	case c.Nbf != nil && now.Before(unixTime(*c.Nbf).Add(-jwtLeeway)):
+		return fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	case j.opts.Issuer != "" && c.Iss != j.opts.Issuer:
+		return fmt.Errorf("%w: wrong issuer", ErrInvalidToken)
+	}
+
+	if j.opts.Audience == "" {
+		return nil
+	}
+	var audiences []string
+	if err := json.Unmarshal(c.Aud, &audiences); err != nil {
+		var audience string
+		if json.Unmarshal(c.Aud, &audience) == nil {
+			audiences = []string{audience}
+		}
+	}
+	for _, audience := range audiences {
+		if audience == j.opts.Audience {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: wrong audience", ErrInvalidToken)
+}
+
+// unixTime converts a NumericDate, seconds since the Unix epoch that may have a fraction, to a time.
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// verify checks the signature over signed with alg, which must be meant for the type of key, so a token can't pick
+// an algorithm that uses a public key as an HMAC secret.
+func verify(alg string, key any, signed []byte, signature []byte) error {
+	digest := sha256.Sum256(signed)
+
+	var ok bool
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		ok = alg == "RS256" && rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		ok = alg == "ES256" && len(signature) == 64 &&
+			ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:]))
+	case ed25519.PublicKey:
+		ok = alg == "EdDSA" && ed25519.Verify(k, signed, signature)
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write(signed)
+		ok = alg == "HS256" && hmac.Equal(mac.Sum(nil), signature)
+	}
+
+	if !ok {
+		return fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+	return nil
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token into v.
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKeys are the private halves of the keys in the key set written by writeKeySet.
+type testKeys struct {
+	rsa     *rsa.PrivateKey
+	ec      *ecdsa.PrivateKey
+	ed      ed25519.PrivateKey
+	hmacKey []byte
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmacKey := make([]byte, 32)
+	rand.Read(hmacKey)
+
+	return &testKeys{rsa: rsaKey, ec: ecKey, ed: edKey, hmacKey: hmacKey}
+}
+
+// writeKeySet writes the public halves of keys as a JSON Web Key Set and returns its file name.
+func writeKeySet(t *testing.T, keys *testKeys) string {
+	t.Helper()
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	point, err := keys.ec.PublicKey.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := map[string][]jwk{"keys": {
+		{Kty: "RSA", Kid: "rsa", N: b64(keys.rsa.N.Bytes()), E: b64([]byte{1, 0, 1})},
+		{Kty: "EC", Kid: "ec", Crv: "P-256", X: b64(point[1:33]), Y: b64(point[33:])},
+		{Kty: "OKP", Kid: "ed", Crv: "Ed25519", X: b64(keys.ed.Public().(ed25519.PublicKey))},
+		{Kty: "oct", Kid: "hmac", K: b64(keys.hmacKey)},
+	}}
+
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// sign returns a token with the given header and claims, signed with alg using the matching key of keys.
+func (keys *testKeys) sign(t *testing.T, alg string, kid string, claims map[string]any) string {
+	t.Helper()
+
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(map[string]string{"alg": alg, "kid": kid}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch alg {
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, keys.rsa, crypto.SHA256, digest[:])
+	case "ES256":
+		r, s, signErr := ecdsa.Sign(rand.Reader, keys.ec, digest[:])
+		signature, err = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...), signErr
+	case "EdDSA":
+		signature = ed25519.Sign(keys.ed, []byte(signed))
+	case "HS256":
+		// Signed with the HMAC secret, or with the RSA public key as the secret when kid names it
+		secret := keys.hmacKey
+		if kid == "rsa" {
+			secret = keys.rsa.N.Bytes()
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	keys := newTestKeys(t)
+	j, err := LoadJWTAuthenticator(writeKeySet(t, keys), JWTOptions{Issuer: "issuer", Audience: "fs-xfer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	valid := func(changes map[string]any) map[string]any {
+		c := map[string]any{"sub": "alice", "iss": "issuer", "aud": "fs-xfer", "exp": now + 3600}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name   string
+		alg    string
+		kid    string
+		claims map[string]any
+		ok     bool
+	}{
+		{"RS256", "RS256", "rsa", valid(nil), true},
+		{"ES256", "ES256", "ec", valid(nil), true},
+		{"EdDSA", "EdDSA", "ed", valid(nil), true},
+		{"HS256", "HS256", "hmac", valid(nil), true},
+		{"audience in a list", "HS256", "hmac", valid(map[string]any{"aud": []string{"other", "fs-xfer"}}), true},
+		{"expired within leeway", "HS256", "hmac", valid(map[string]any{"exp": now - 30}), true},
+
+		{"RSA key as HMAC secret", "HS256", "rsa", valid(nil), false},
+		{"algorithm of another key type", "RS256", "hmac", valid(nil), false},
+		{"no algorithm", "none", "hmac", valid(nil), false},
+		{"unknown key", "HS256", "missing", valid(nil), false},
+		{"expired", "HS256", "hmac", valid(map[string]any{"exp": now - 3600}), false},
+		{"no expiry", "HS256", "hmac", valid(map[string]any{"exp": nil}), false},
+		{"not valid yet", "HS256", "hmac", valid(map[string]any{"nbf": now + 3600}), false},
+		{"wrong audience", "HS256", "hmac", valid(map[string]any{"aud": "other"}), false},
+		{"wrong audience in a list", "HS256", "hmac", valid(map[string]any{"aud": []string{"a", "b"}}), false},
+		{"no audience", "HS256", "hmac", valid(map[string]any{"aud": nil}), false},
+		{"wrong issuer", "HS256", "hmac", valid(map[string]any{"iss": "other"}), false},
+		{"no subject", "HS256", "hmac", valid(map[string]any{"sub": nil}), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			principal, err := j.Authenticate(keys.sign(t, test.alg, test.kid, test.claims))
+			switch {
+			case test.ok && err != nil:
+				t.Fatalf("rejected valid token: %v", err)
+			case test.ok && principal != "alice":
+				t.Fatalf("principal is %q, want alice", principal)
+			case !test.ok && !errors.Is(err, ErrInvalidToken):
+				t.Fatalf("got principal %q and error %v, want ErrInvalidToken", principal, err)
+			}
+		})
+	}
+}
+
+func TestJWTAuthenticatorTampered(t *testing.T) {
+	keys := newTestKeys(t)
+	j, err := LoadJWTAuthenticator(writeKeySet(t, keys), JWTOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := keys.sign(t, "HS256", "hmac", map[string]any{"sub": "alice", "exp": time.Now().Unix() + 3600})
+	forged := keys.sign(t, "HS256", "hmac", map[string]any{"sub": "mallory", "exp": time.Now().Unix() + 3600})
+	parts, forgedParts := strings.Split(token, "."), strings.Split(forged, ".")
+	header, payload, signature := parts[0], parts[1], parts[2]
+
+	tests := map[string]string{
+		"swapped payload":  header + "." + forgedParts[1] + "." + signature,
+		"no signature":     header + "." + payload + ".",
+		"missing segment":  header + "." + payload,
+		"invalid encoding": header + "." + payload + ".!!",
+	}
+	for name, token := range tests {
+		t.Run(name, func(t *testing.T) {
+			if principal, err := j.Authenticate(token); !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("got principal %q and error %v, want ErrInvalidToken", principal, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package backend
+
+import (
+	"io"
+	"io/fs"
+	"time"
+)
+
+// Backend stores the files of a StorageService. Names are slash separated and relative to the backend's root, as in io/fs.
+// Regular files returned by Open must implement io.ReaderAt. Open, Stat and ReadDir follow symlinks.
+type Backend interface {
+	fs.StatFS
+	fs.ReadDirFS
+	fs.ReadLinkFS
+
+	// Create opens name for writing, creating it and its parent directories if needed.
+	// If truncate is set any existing content is discarded.
+	Create(name string, truncate bool) (Writer, error)
+	// MkdirAll creates the directory name along with any missing parents.
+	MkdirAll(name string) error
+	// Symlink creates name as a symlink to target, which is relative to name's directory.
+	Symlink(target string, name string) error
+	// Link creates newName as a hardlink to the file oldName.
+	Link(oldName string, newName string) error
+	// Remove removes a file or an empty directory.
+	Remove(name string) error
+	// RemoveAll removes name and everything under it. It returns nil if name doesn't exist.
+	RemoveAll(name string) error
+	// Rename moves a file or directory, creating the parent directories of newName if needed and replacing an existing file.
+	Rename(oldName string, newName string) error
+	// Chtimes sets the modification time of name.
+	Chtimes(name string, mtime time.Time) error
+	// Chmod sets the permission bits of name.
+	Chmod(name string, mode fs.FileMode) error
+	// Chown sets the owner of name. Backends that don't keep files on the local disk report the owner
+	// in a *files.Sys from the Sys method of the file's info.
+	Chown(name string, uid int, gid int) error
+}
+
+// Writer is a file opened for writing by a Backend.
+type Writer interface {
+	io.WriterAt
+	// Sync makes the data written so far durable.
+	Sync() error
+	Close() error
+}
@@ -0,0 +1,132 @@
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// writeFile writes data at off to name through a writer from b.Create, closing it.
+func writeFile(t *testing.T, b Backend, name string, truncate bool, off int64, data []byte) {
+	t.Helper()
+
+	w, err := b.Create(name, truncate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteAt(data, off); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkFile fails unless name reads as want.
+func checkFile(t *testing.T, b Backend, name string, want []byte) {
+	t.Helper()
+
+	got, err := fs.ReadFile(b, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s holds %d bytes that differ from the %d written", name, len(got), len(want))
+	}
+}
+
+func TestBackends(t *testing.T) {
+	backends := map[string]func(t *testing.T) Backend{
+		"local":  func(t *testing.T) Backend { return NewLocal(t.TempDir()) },
+		"memory": func(t *testing.T) Backend { return NewMemory() },
+		"s3": func(t *testing.T) Backend {
+			b, _ := newTestS3(t, "prefix")
+			return b
+		},
+	}
+	for name, newBackend := range backends {
+		t.Run(name, func(t *testing.T) {
+			testBackend(t, newBackend(t))
+		})
+	}
+}
+
+func testBackend(t *testing.T, b Backend) {
+	writeFile(t, b, "a/b/file", true, 0, []byte("hello"))
+	writeFile(t, b, "a/b/file", false, 5, []byte(" world"))
+	checkFile(t, b, "a/b/file", []byte("hello world"))
+	writeFile(t, b, "a/b/file", false, 0, []byte("J"))
+	checkFile(t, b, "a/b/file", []byte("Jello world"))
+
+	// Files opened for reading support random access
+	f, err := b.Open("a/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 5)
+	if n, err := f.(io.ReaderAt).ReadAt(p, 6); n != 5 || (err != nil && err != io.EOF) || string(p) != "world" {
+		t.Fatalf("read %q and error %v at 6, want %q", p[:n], err, "world")
+	}
+	f.Close()
+
+	writeFile(t, b, "a/other", true, 0, []byte("other"))
+	writeFile(t, b, "a/other", true, 0, []byte("x"))
+	checkFile(t, b, "a/other", []byte("x"))
+
+	if err := b.MkdirAll("a/empty/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(b, "a/b/file", "a/other", "a/empty/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Unix(1700000000, 0)
+	if err := b.Chtimes("a/other", mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Chmod("a/other", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := b.Stat("a/other"); err != nil || !info.ModTime().Equal(mtime) || info.Mode() != 0600 || info.Size() != 1 {
+		t.Fatalf("a/other has info %v and error %v, want 1 byte with mode 0600 modified at %s", info, err, mtime)
+	}
+
+	if err := b.Remove("a/b"); err == nil {
+		t.Fatal("removed a directory that isn't empty")
+	}
+	if err := b.Rename("a/other", "a/b"); err == nil {
+		t.Fatal("renamed a file over a directory")
+	}
+
+	if err := b.Rename("a", "c/d"); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, b, "c/d/b/file", []byte("Jello world"))
+	if _, err := b.Stat("a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("renamed directory still has info and error %v", err)
+	}
+	if err := b.Rename("c/d/other", "c/d/b/file"); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, b, "c/d/b/file", []byte("x"))
+
+	if err := b.Remove("c/d/b/file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Remove("c/d/empty/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.RemoveAll("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.RemoveAll("c"); err != nil {
+		t.Fatalf("removing a missing directory returned %v", err)
+	}
+	if entries, err := b.ReadDir("."); err != nil || len(entries) != 0 {
+		t.Fatalf("root holds %v and error %v, want nothing", entries, err)
+	}
+}
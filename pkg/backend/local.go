@@ -0,0 +1,192 @@
+package backend
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Local stores files in a directory on the local disk. Every operation goes through an os.Root,
+// so symlinks stored in the directory are never followed out of it.
+type Local struct {
+	root string
+
+	once sync.Once
+	r    *os.Root
+	err  error
+}
+
+// NewLocal creates a backend storing its files under the root directory, which is created when it's first used.
+func NewLocal(root string) *Local {
+	return &Local{root: filepath.Clean(root)}
+}
+
+// Root returns the directory the backend stores its files in.
+func (l *Local) Root() string {
+	return l.root
+}
+
+func (l *Local) Open(name string) (fs.File, error) {
+	r, err := l.open("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return r.Open(name)
+}
+
+func (l *Local) Stat(name string) (fs.FileInfo, error) {
+	r, err := l.open("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return r.Stat(name)
+}
+
+func (l *Local) ReadDir(name string) ([]fs.DirEntry, error) {
+	r, err := l.open("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.ReadDir(r.FS(), name)
+}
+
+func (l *Local) Lstat(name string) (fs.FileInfo, error) {
+	r, err := l.open("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return r.Lstat(name)
+}
+
+func (l *Local) ReadLink(name string) (string, error) {
+	r, err := l.open("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	target, err := r.Readlink(name)
+	return filepath.ToSlash(target), err
+}
+
+func (l *Local) Create(name string, truncate bool) (Writer, error) {
+	r, err := l.open("create", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.MkdirAll(path.Dir(name), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY
+	if truncate {
+		flags |= os.O_TRUNC
+	}
+	return r.OpenFile(name, flags, 0644)
+}
+
+func (l *Local) MkdirAll(name string) error {
+	r, err := l.open("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return r.MkdirAll(name, os.ModePerm)
+}
+
+func (l *Local) Symlink(target string, name string) error {
+	r, err := l.open("symlink", name)
+	if err != nil {
+		return err
+	}
+
+	if err := r.MkdirAll(path.Dir(name), os.ModePerm); err != nil {
+		return err
+	}
+	return r.Symlink(filepath.FromSlash(target), name)
+}
+
+func (l *Local) Link(oldName string, newName string) error {
+	r, err := l.open("link", oldName)
+	if err != nil {
+		return err
+	}
+	if _, err := l.open("link", newName); err != nil {
+		return err
+	}
+
+	if err := r.MkdirAll(path.Dir(newName), os.ModePerm); err != nil {
+		return err
+	}
+	return r.Link(oldName, newName)
+}
+
+func (l *Local) Remove(name string) error {
+	r, err := l.open("remove", name)
+	if err != nil {
+		return err
+	}
+	return r.Remove(name)
+}
+
+func (l *Local) RemoveAll(name string) error {
+	r, err := l.open("remove", name)
+	if err != nil {
+		return err
+	}
+	return r.RemoveAll(name)
+}
+
+func (l *Local) Rename(oldName string, newName string) error {
+	r, err := l.open("rename", oldName)
+	if err != nil {
+		return err
+	}
+	if _, err := l.open("rename", newName); err != nil {
+		return err
+	}
+
+	if err := r.MkdirAll(path.Dir(newName), os.ModePerm); err != nil {
+		return err
+	}
+	return r.Rename(oldName, newName)
+}
+
+func (l *Local) Chtimes(name string, mtime time.Time) error {
+	r, err := l.open("chtimes", name)
+	if err != nil {
+		return err
+	}
+	return r.Chtimes(name, time.Time{}, mtime)
+}
+
+func (l *Local) Chmod(name string, mode fs.FileMode) error {
+	r, err := l.open("chmod", name)
+	if err != nil {
+		return err
+	}
+	return r.Chmod(name, mode)
+}
+
+func (l *Local) Chown(name string, uid int, gid int) error {
+	r, err := l.open("chown", name)
+	if err != nil {
+		return err
+	}
+	return r.Lchown(name, uid, gid)
+}
+
+// open returns the root directory, opening it first if needed, after checking that name is a valid io/fs path.
+func (l *Local) open(op string, name string) (*os.Root, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	l.once.Do(func() {
+		if l.err = os.MkdirAll(l.root, os.ModePerm); l.err == nil {
+			l.r, l.err = os.OpenRoot(l.root)
+		}
+	})
+	return l.r, l.err
+}
@@ -0,0 +1,577 @@
+package backend
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RGood/fs-xfer/pkg/files"
+	"github.com/RGood/fs-xfer/pkg/generated/filesystem"
+)
+
+var (
+	errIsDir    = errors.New("is a directory")
+	errNotDir   = errors.New("not a directory")
+	errNotEmpty = errors.New("directory not empty")
+	errLoop     = errors.New("too many levels of symbolic links")
+)
+
+// maxHops bounds the number of symlinks followed while resolving a name.
+const maxHops = 40
+
+// Memory keeps files in memory. It is meant for tests and for embedding the service without touching the disk.
+type Memory struct {
+	mu    sync.RWMutex
+	nodes map[string]*memNode
+}
+
+// memNode is a file, directory or symlink held by Memory. Its fields are guarded by Memory.mu.
+type memNode struct {
+	dir   bool
+	data  []byte
+	mode  fs.FileMode
+	mtime time.Time
+	owner *filesystem.Ownership
+	// target is set for symlinks.
+	target string
+	// hardlinks counts the names that refer to the node besides the first.
+	hardlinks int
+}
+
+// NewMemory creates an empty in-memory backend.
+func NewMemory() *Memory {
+	return &Memory{nodes: map[string]*memNode{".": {dir: true, mode: 0755, mtime: time.Now()}}}
+}
+
+func (m *Memory) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	resolved, node, err := m.resolve(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	if node.dir {
+		return &memDir{info: m.info(name, node), entries: m.children(resolved)}, nil
+	}
+	return &memFile{m: m, name: name, node: node}, nil
+}
+
+func (m *Memory) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, node, err := m.resolve(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return m.info(name, node), nil
+}
+
+func (m *Memory) Lstat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	node, ok := m.nodes[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrNotExist}
+	}
+	return m.info(name, node), nil
+}
+
+func (m *Memory) ReadLink(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	node, ok := m.nodes[name]
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrNotExist}
+	} else if node.target == "" {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return node.target, nil
+}
+
+func (m *Memory) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	resolved, node, err := m.resolve(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	} else if !node.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+	return m.children(resolved), nil
+}
+
+func (m *Memory) Create(name string, truncate bool) (Writer, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, ok := m.nodes[name]
+	if ok && node.dir {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: errIsDir}
+	}
+	if ok && node.target != "" {
+		m.drop(name)
+		ok = false
+	}
+
+	if !ok {
+		if err := m.mkdirAll(path.Dir(name)); err != nil {
+			return nil, err
+		}
+		node = &memNode{mode: 0644}
+		m.nodes[name] = node
+	}
+
+	if truncate {
+		node.data = nil
+	}
+	node.mtime = time.Now()
+
+	return &memWriter{m: m, node: node}, nil
+}
+
+func (m *Memory) MkdirAll(name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.mkdirAll(name)
+}
+
+// mkdirAll creates the directory name and its missing parents. m.mu must be held.
+func (m *Memory) mkdirAll(name string) error {
+	if node, ok := m.nodes[name]; ok {
+		if !node.dir {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: errNotDir}
+		}
+		return nil
+	}
+
+	if err := m.mkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+
+	m.nodes[name] = &memNode{dir: true, mode: 0755, mtime: time.Now()}
+	return nil
+}
+
+func (m *Memory) Symlink(target string, name string) error {
+	if !fs.ValidPath(name) || name == "." || target == "" {
+		return &fs.PathError{Op: "symlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.nodes[name]; ok {
+		return &fs.PathError{Op: "symlink", Path: name, Err: fs.ErrExist}
+	}
+	if err := m.mkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+
+	m.nodes[name] = &memNode{mode: 0777, mtime: time.Now(), target: target}
+	return nil
+}
+
+func (m *Memory) Link(oldName string, newName string) error {
+	if !fs.ValidPath(oldName) || !fs.ValidPath(newName) || newName == "." {
+		return &fs.PathError{Op: "link", Path: oldName, Err: fs.ErrInvalid}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, ok := m.nodes[oldName]
+	if !ok {
+		return &fs.PathError{Op: "link", Path: oldName, Err: fs.ErrNotExist}
+	} else if node.dir {
+		return &fs.PathError{Op: "link", Path: oldName, Err: errIsDir}
+	}
+	if _, ok := m.nodes[newName]; ok {
+		return &fs.PathError{Op: "link", Path: newName, Err: fs.ErrExist}
+	}
+	if err := m.mkdirAll(path.Dir(newName)); err != nil {
+		return err
+	}
+
+	node.hardlinks++
+	m.nodes[newName] = node
+	return nil
+}
+
+func (m *Memory) Remove(name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, ok := m.nodes[name]
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if node.dir && len(m.children(name)) > 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+	}
+
+	m.drop(name)
+	return nil
+}
+
+func (m *Memory) RemoveAll(name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key := range m.nodes {
+		if key != "." && within(key, name) {
+			m.drop(key)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Rename(oldName string, newName string) error {
+	if !fs.ValidPath(oldName) || !fs.ValidPath(newName) || oldName == "." || newName == "." || within(newName, oldName) && newName != oldName {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrInvalid}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, ok := m.nodes[oldName]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrNotExist}
+	}
+	if oldName == newName {
+		return nil
+	}
+
+	if existing, ok := m.nodes[newName]; ok {
+		if existing.dir != node.dir {
+			err := errIsDir
+			if !existing.dir {
+				err = errNotDir
+			}
+			return &fs.PathError{Op: "rename", Path: oldName, Err: err}
+		}
+		if existing.dir && len(m.children(newName)) > 0 {
+			return &fs.PathError{Op: "rename", Path: oldName, Err: errNotEmpty}
+		}
+		if existing != node {
+			m.drop(newName)
+		}
+	}
+
+	if err := m.mkdirAll(path.Dir(newName)); err != nil {
+		return err
+	}
+
+	moved := map[string]*memNode{}
+	for key, n := range m.nodes {
+		if within(key, oldName) {
+			moved[newName+strings.TrimPrefix(key, oldName)] = n
+			delete(m.nodes, key)
+		}
+	}
+	for key, n := range moved {
+		m.nodes[key] = n
+	}
+
+	return nil
+}
+
+func (m *Memory) Chtimes(name string, mtime time.Time) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrInvalid}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, ok := m.nodes[name]
+	if !ok {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrNotExist}
+	}
+
+	node.mtime = mtime
+	return nil
+}
+
+func (m *Memory) Chmod(name string, mode fs.FileMode) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "chmod", Path: name, Err: fs.ErrInvalid}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, ok := m.nodes[name]
+	if !ok {
+		return &fs.PathError{Op: "chmod", Path: name, Err: fs.ErrNotExist}
+	}
+
+	node.mode = mode.Perm()
+	return nil
+}
+
+func (m *Memory) Chown(name string, uid int, gid int) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "chown", Path: name, Err: fs.ErrInvalid}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, ok := m.nodes[name]
+	if !ok {
+		return &fs.PathError{Op: "chown", Path: name, Err: fs.ErrNotExist}
+	}
+
+	node.owner = &filesystem.Ownership{Uid: uint32(uid), Gid: uint32(gid)}
+	return nil
+}
+
+// resolve follows the symlinks in name, returning the name and node it refers to. m.mu must be held.
+func (m *Memory) resolve(name string) (string, *memNode, error) {
+	cur, node := ".", m.nodes["."]
+	rest := strings.Split(name, "/")
+	for hops := 0; len(rest) > 0; {
+		next := path.Join(cur, rest[0])
+		rest = rest[1:]
+
+		n, ok := m.nodes[next]
+		if !ok {
+			return "", nil, fs.ErrNotExist
+		}
+		if n.target == "" {
+			cur, node = next, n
+			continue
+		}
+
+		if hops++; hops > maxHops {
+			return "", nil, errLoop
+		}
+
+		// Targets are relative to the link's directory and can't leave the backend
+		target := path.Join(path.Dir(next), n.target)
+		if path.IsAbs(n.target) || !fs.ValidPath(target) {
+			return "", nil, fs.ErrNotExist
+		}
+		cur, node = ".", m.nodes["."]
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return cur, node, nil
+}
+
+// drop deletes the name of a node. m.mu must be held.
+func (m *Memory) drop(name string) {
+	if node := m.nodes[name]; node.hardlinks > 0 {
+		node.hardlinks--
+	}
+	delete(m.nodes, name)
+}
+
+// children returns the sorted entries of the directory name. m.mu must be held.
+func (m *Memory) children(name string) []fs.DirEntry {
+	entries := []fs.DirEntry{}
+	for key, node := range m.nodes {
+		if key != "." && path.Dir(key) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(m.info(key, node)))
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries
+}
+
+// info describes a node. m.mu must be held.
+func (m *Memory) info(name string, node *memNode) *memInfo {
+	info := &memInfo{name: path.Base(name), size: int64(len(node.data)), mode: node.mode, mtime: node.mtime, sys: &files.Sys{Owner: node.owner}}
+	switch {
+	case node.dir:
+		info.mode |= fs.ModeDir
+	case node.target != "":
+		info.mode |= fs.ModeSymlink
+		info.size = int64(len(node.target))
+	case node.hardlinks > 0:
+		info.sys.LinkID = node
+	}
+	return info
+}
+
+// within reports whether name is dir or inside it.
+func within(name string, dir string) bool {
+	return dir == "." || name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+// memFile reads a file held by Memory. Writes made while it is open are visible to it.
+type memFile struct {
+	m    *Memory
+	name string
+	node *memNode
+	pos  int64
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.m.mu.RLock()
+	defer f.m.mu.RUnlock()
+
+	return f.m.info(f.name, f.node), nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.m.mu.RLock()
+	defer f.m.mu.RUnlock()
+
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+// memWriter writes a file held by Memory.
+type memWriter struct {
+	m      *Memory
+	node   *memNode
+	closed bool
+}
+
+func (w *memWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.m.mu.Lock()
+	defer w.m.mu.Unlock()
+
+	if w.closed {
+		return 0, fs.ErrClosed
+	}
+
+	if end := off + int64(len(p)); end > int64(len(w.node.data)) {
+		if end > int64(cap(w.node.data)) {
+			grown := make([]byte, len(w.node.data), max(end, 2*int64(cap(w.node.data))))
+			copy(grown, w.node.data)
+			w.node.data = grown
+		}
+		w.node.data = w.node.data[:end]
+	}
+
+	copy(w.node.data[off:], p)
+	w.node.mtime = time.Now()
+	return len(p), nil
+}
+
+func (w *memWriter) Sync() error {
+	return nil
+}
+
+func (w *memWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+type memDir struct {
+	info    *memInfo
+	entries []fs.DirEntry
+	read    int
+}
+
+func (d *memDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *memDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errIsDir}
+}
+
+func (d *memDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.read:]
+	if n > 0 {
+		if len(remaining) == 0 {
+			return nil, io.EOF
+		}
+		remaining = remaining[:min(n, len(remaining))]
+	}
+
+	d.read += len(remaining)
+	return remaining, nil
+}
+
+func (d *memDir) Close() error {
+	return nil
+}
+
+type memInfo struct {
+	name  string
+	size  int64
+	mode  fs.FileMode
+	mtime time.Time
+	sys   *files.Sys
+}
+
+func (i *memInfo) Name() string       { return i.name }
+func (i *memInfo) Size() int64        { return i.size }
+func (i *memInfo) Mode() fs.FileMode  { return i.mode }
+func (i *memInfo) ModTime() time.Time { return i.mtime }
+func (i *memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memInfo) Sys() any           { return i.sys }
@@ -0,0 +1,919 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RGood/fs-xfer/pkg/files"
+	"github.com/RGood/fs-xfer/pkg/generated/filesystem"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	// partSize is the size of the parts large files are uploaded in. S3 requires at least 5 MiB.
+	partSize = 16 * 1024 * 1024 // 16 MiB
+	// maxCopySize is the largest object a single CopyObject request can copy.
+	maxCopySize = 5 * 1024 * 1024 * 1024 // 5 GiB
+	// copyPartSize is the size of the parts larger objects are copied in.
+	copyPartSize = 512 * 1024 * 1024 // 512 MiB
+	// readAhead is the least a ranged GET fetches, since files are mostly read a chunk at a time.
+	readAhead = 4 * 1024 * 1024 // 4 MiB
+	// Object metadata holding the file's modification time in Unix nanoseconds, its octal permissions, its owner
+	// and, for symlinks, their target
+	mtimeKey   = "mtime"
+	modeKey    = "mode"
+	uidKey     = "uid"
+	gidKey     = "gid"
+	symlinkKey = "symlink"
+)
+
+// S3 stores files as objects in an S3 compatible bucket, under an optional key prefix.
+// Directories are implied by the keys under them. Empty directories are kept as zero byte objects whose key ends in a slash.
+// Symlinks are zero byte objects with their target in the metadata, and are only followed as the last element of a name.
+// S3 has no hardlinks, so they are stored as copies.
+type S3 struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+// NewS3 creates a backend storing its files in bucket under prefix.
+func NewS3(client *s3.Client, bucket string, prefix string) *S3 {
+	return &S3{client: client, bucket: bucket, prefix: strings.Trim(prefix, "/")}
+}
+
+func (b *S3) Open(name string) (fs.File, error) {
+	resolved, info, err := b.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		entries, err := b.ReadDir(resolved)
+		if err != nil {
+			return nil, err
+		}
+		return &s3Dir{info: info, entries: entries}, nil
+	}
+	return &s3File{b: b, key: b.key(resolved), info: info}, nil
+}
+
+func (b *S3) Stat(name string) (fs.FileInfo, error) {
+	_, info, err := b.resolve("stat", name)
+	return info, err
+}
+
+func (b *S3) Lstat(name string) (fs.FileInfo, error) {
+	return b.stat("lstat", name)
+}
+
+func (b *S3) ReadLink(name string) (string, error) {
+	info, err := b.stat("readlink", name)
+	if err != nil {
+		return "", err
+	} else if info.target == "" {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return info.target, nil
+}
+
+// resolve follows name if it is a symlink, returning the name it refers to and its info.
+func (b *S3) resolve(op string, name string) (string, *s3Info, error) {
+	info, err := b.stat(op, name)
+	for hops := 0; err == nil && info.target != ""; hops++ {
+		target := path.Join(path.Dir(name), info.target)
+		if hops == maxHops {
+			return "", nil, &fs.PathError{Op: op, Path: name, Err: errLoop}
+		} else if path.IsAbs(info.target) || !fs.ValidPath(target) {
+			return "", nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+
+		base := info.name
+		name = target
+		if info, err = b.stat(op, name); err == nil {
+			info.name = base
+		}
+	}
+	return name, info, err
+}
+
+// stat looks name up as an object, and failing that as a directory.
+func (b *S3) stat(op string, name string) (*s3Info, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return &s3Info{name: ".", mode: fs.ModeDir | 0755}, nil
+	}
+
+	ctx := context.Background()
+
+	head, err := b.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &b.bucket, Key: aws.String(b.key(name))})
+	if err == nil {
+		return objectInfo(path.Base(name), aws.ToInt64(head.ContentLength), head.Metadata, head.LastModified), nil
+	} else if !isNotFound(err) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	list, err := b.client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: &b.bucket, Prefix: aws.String(b.dirKey(name)), MaxKeys: aws.Int32(1)})
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if len(list.Contents) == 0 {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+
+	return &s3Info{name: path.Base(name), mode: fs.ModeDir | 0755, mtime: aws.ToTime(list.Contents[0].LastModified)}, nil
+}
+
+func (b *S3) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	dirKey := b.dirKey(name)
+	entries := []fs.DirEntry{}
+	found := false
+
+	// Some S3-compatible servers list the markers of subdirectories as objects as well as common prefixes
+	dirs := map[string]bool{}
+	addDir := func(child string) {
+		if !dirs[child] {
+			dirs[child] = true
+			entries = append(entries, &s3Entry{b: b, name: path.Join(name, child), info: &s3Info{name: child, mode: fs.ModeDir | 0755}})
+		}
+	}
+
+	pages := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{Bucket: &b.bucket, Prefix: aws.String(dirKey), Delimiter: aws.String("/")})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(context.Background())
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+		}
+
+		for _, prefix := range page.CommonPrefixes {
+			found = true
+			addDir(strings.TrimSuffix(strings.TrimPrefix(aws.ToString(prefix.Prefix), dirKey), "/"))
+		}
+		for _, object := range page.Contents {
+			found = true
+			child := strings.TrimPrefix(aws.ToString(object.Key), dirKey)
+			if child == "" {
+				// The directory's own marker
+				continue
+			}
+			if dir, ok := strings.CutSuffix(child, "/"); ok {
+				addDir(dir)
+				continue
+			}
+			entries = append(entries, &s3Entry{b: b, name: path.Join(name, child), info: &s3Info{name: child, size: aws.ToInt64(object.Size), mode: 0644, mtime: aws.ToTime(object.LastModified)}})
+		}
+	}
+
+	if !found && name != "." {
+		if _, err := b.stat("readdir", name); err != nil {
+			return nil, err
+		}
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+// Create stages the writes to the file in a local temporary file. Syncing or closing the writer uploads the parts
+// of the file that changed since it was last uploaded, and copies the others within the bucket.
+func (b *S3) Create(name string, truncate bool) (Writer, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+
+	tmp, err := os.CreateTemp("", "fs-xfer-s3-*")
+	if err != nil {
+		return nil, err
+	}
+	w := &s3Writer{b: b, key: b.key(name), tmp: tmp, loaded: map[int64]bool{}, changed: map[int64]bool{}, dirty: true}
+
+	if !truncate {
+		head, err := b.client.HeadObject(context.Background(), &s3.HeadObjectInput{Bucket: &b.bucket, Key: aws.String(w.key)})
+		if err == nil {
+			w.base = aws.ToInt64(head.ContentLength)
+			w.size, w.dirty = w.base, false
+		} else if !isNotFound(err) {
+			w.discard()
+			return nil, &fs.PathError{Op: "create", Path: name, Err: err}
+		}
+	}
+
+	return w, nil
+}
+
+func (b *S3) MkdirAll(name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return nil
+	}
+
+	_, err := b.client.PutObject(context.Background(), &s3.PutObjectInput{Bucket: &b.bucket, Key: aws.String(b.dirKey(name)), Body: strings.NewReader("")})
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return nil
+}
+
+// Symlink stores the link as a zero byte object with the target in its metadata.
+func (b *S3) Symlink(target string, name string) error {
+	if !fs.ValidPath(name) || name == "." || target == "" {
+		return &fs.PathError{Op: "symlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if _, err := b.stat("symlink", name); err == nil {
+		return &fs.PathError{Op: "symlink", Path: name, Err: fs.ErrExist}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	info := &s3Info{mode: fs.ModeSymlink | 0777, mtime: time.Now(), target: target}
+	_, err := b.client.PutObject(context.Background(), &s3.PutObjectInput{Bucket: &b.bucket, Key: aws.String(b.key(name)), Body: strings.NewReader(""), Metadata: info.metadata()})
+	if err != nil {
+		return &fs.PathError{Op: "symlink", Path: name, Err: err}
+	}
+	return nil
+}
+
+// Link copies the object, since S3 has no hardlinks.
+func (b *S3) Link(oldName string, newName string) error {
+	if !fs.ValidPath(newName) || newName == "." {
+		return &fs.PathError{Op: "link", Path: newName, Err: fs.ErrInvalid}
+	}
+
+	info, err := b.stat("link", oldName)
+	if err != nil {
+		return err
+	} else if info.IsDir() {
+		return &fs.PathError{Op: "link", Path: oldName, Err: errIsDir}
+	}
+
+	if _, err := b.stat("link", newName); err == nil {
+		return &fs.PathError{Op: "link", Path: newName, Err: fs.ErrExist}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if err := b.copyObject(b.key(oldName), b.key(newName), info.size, info.metadata()); err != nil {
+		return &fs.PathError{Op: "link", Path: oldName, Err: err}
+	}
+	return nil
+}
+
+func (b *S3) Remove(name string) error {
+	info, err := b.stat("remove", name)
+	if err != nil {
+		return err
+	}
+	if name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+
+	ctx := context.Background()
+	key := b.key(name)
+
+	if info.IsDir() {
+		list, err := b.client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: &b.bucket, Prefix: aws.String(b.dirKey(name)), MaxKeys: aws.Int32(2)})
+		if err != nil {
+			return &fs.PathError{Op: "remove", Path: name, Err: err}
+		}
+		for _, object := range list.Contents {
+			if aws.ToString(object.Key) != b.dirKey(name) {
+				return &fs.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+			}
+		}
+		key = b.dirKey(name)
+	}
+
+	if _, err := b.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: &b.bucket, Key: &key}); err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (b *S3) RemoveAll(name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+
+	ctx := context.Background()
+
+	if name != "." {
+		if _, err := b.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: &b.bucket, Key: aws.String(b.key(name))}); err != nil && !isNotFound(err) {
+			return &fs.PathError{Op: "remove", Path: name, Err: err}
+		}
+	}
+
+	pages := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{Bucket: &b.bucket, Prefix: aws.String(b.dirKey(name))})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return &fs.PathError{Op: "remove", Path: name, Err: err}
+		}
+		if len(page.Contents) == 0 {
+			continue
+		}
+
+		objects := make([]types.ObjectIdentifier, len(page.Contents))
+		for i, object := range page.Contents {
+			objects[i] = types.ObjectIdentifier{Key: object.Key}
+		}
+
+		res, err := b.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{Bucket: &b.bucket, Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)}})
+		if err != nil {
+			return &fs.PathError{Op: "remove", Path: name, Err: err}
+		}
+		if len(res.Errors) > 0 {
+			return &fs.PathError{Op: "remove", Path: name, Err: fmt.Errorf("could not delete %s: %s", aws.ToString(res.Errors[0].Key), aws.ToString(res.Errors[0].Message))}
+		}
+	}
+
+	return nil
+}
+
+// Rename copies the objects to their new keys and then deletes the originals, so it isn't atomic.
+func (b *S3) Rename(oldName string, newName string) error {
+	if !fs.ValidPath(newName) || newName == "." {
+		return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrInvalid}
+	}
+
+	info, err := b.stat("rename", oldName)
+	if err != nil {
+		return err
+	}
+	if oldName == "." || within(newName, oldName) && newName != oldName {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrInvalid}
+	}
+	if oldName == newName {
+		return nil
+	}
+
+	// Like a local rename, only a file may replace a file and only an empty directory a directory
+	if existing, err := b.stat("rename", newName); err == nil {
+		if existing.IsDir() != info.IsDir() {
+			err := errIsDir
+			if !existing.IsDir() {
+				err = errNotDir
+			}
+			return &fs.PathError{Op: "rename", Path: oldName, Err: err}
+		}
+		if existing.IsDir() {
+			if entries, err := b.ReadDir(newName); err != nil {
+				return err
+			} else if len(entries) > 0 {
+				return &fs.PathError{Op: "rename", Path: oldName, Err: errNotEmpty}
+			}
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	ctx := context.Background()
+
+	if !info.IsDir() {
+		if err := b.copyObject(b.key(oldName), b.key(newName), info.size, info.metadata()); err != nil {
+			return &fs.PathError{Op: "rename", Path: oldName, Err: err}
+		}
+		return b.RemoveAll(oldName)
+	}
+
+	oldKey, newKey := b.dirKey(oldName), b.dirKey(newName)
+	pages := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{Bucket: &b.bucket, Prefix: &oldKey})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return &fs.PathError{Op: "rename", Path: oldName, Err: err}
+		}
+
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			var metadata map[string]string
+			if !strings.HasSuffix(key, "/") {
+				head, err := b.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &b.bucket, Key: &key})
+				if err != nil {
+					return &fs.PathError{Op: "rename", Path: oldName, Err: err}
+				}
+				metadata = objectInfo(key, aws.ToInt64(object.Size), head.Metadata, head.LastModified).metadata()
+			}
+
+			if err := b.copyObject(key, newKey+strings.TrimPrefix(key, oldKey), aws.ToInt64(object.Size), metadata); err != nil {
+				return &fs.PathError{Op: "rename", Path: oldName, Err: err}
+			}
+		}
+	}
+
+	return b.RemoveAll(oldName)
+}
+
+// Chtimes stores the modification time in the object's metadata. Directories have no metadata of their own.
+func (b *S3) Chtimes(name string, mtime time.Time) error {
+	return b.update("chtimes", name, func(info *s3Info) {
+		info.mtime = mtime
+	})
+}
+
+// Chmod stores the permissions in the object's metadata.
+func (b *S3) Chmod(name string, mode fs.FileMode) error {
+	return b.update("chmod", name, func(info *s3Info) {
+		info.mode = mode.Perm()
+	})
+}
+
+// Chown stores the owner in the object's metadata.
+func (b *S3) Chown(name string, uid int, gid int) error {
+	return b.update("chown", name, func(info *s3Info) {
+		info.owner = &filesystem.Ownership{Uid: uint32(uid), Gid: uint32(gid)}
+	})
+}
+
+// update rewrites the metadata of the object called name by copying it onto itself.
+func (b *S3) update(op string, name string, change func(*s3Info)) error {
+	info, err := b.stat(op, name)
+	if err != nil || info.IsDir() {
+		return err
+	}
+
+	change(info)
+	if err := b.copyObject(b.key(name), b.key(name), info.size, info.metadata()); err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+// copyObject copies the object at src to dst, replacing its metadata.
+func (b *S3) copyObject(src string, dst string, size int64, metadata map[string]string) error {
+	ctx := context.Background()
+	source := url.PathEscape(b.bucket + "/" + src)
+
+	if size <= maxCopySize {
+		_, err := b.client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:            &b.bucket,
+			Key:               &dst,
+			CopySource:        &source,
+			Metadata:          metadata,
+			MetadataDirective: types.MetadataDirectiveReplace,
+		})
+		return err
+	}
+
+	upload, err := b.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: &b.bucket, Key: &dst, Metadata: metadata})
+	if err != nil {
+		return err
+	}
+
+	var parts []types.CompletedPart
+	for number, offset := int32(1), int64(0); offset < size; number, offset = number+1, offset+copyPartSize {
+		res, err := b.client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:          &b.bucket,
+			Key:             &dst,
+			UploadId:        upload.UploadId,
+			PartNumber:      aws.Int32(number),
+			CopySource:      &source,
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, min(offset+copyPartSize, size)-1)),
+		})
+		if err != nil {
+			b.abort(dst, upload.UploadId)
+			return err
+		}
+		parts = append(parts, types.CompletedPart{ETag: res.CopyPartResult.ETag, PartNumber: aws.Int32(number)})
+	}
+
+	return b.complete(dst, upload.UploadId, parts)
+}
+
+func (b *S3) complete(key string, uploadID *string, parts []types.CompletedPart) error {
+	_, err := b.client.CompleteMultipartUpload(context.Background(), &s3.CompleteMultipartUploadInput{
+		Bucket:          &b.bucket,
+		Key:             &key,
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		b.abort(key, uploadID)
+	}
+	return err
+}
+
+// abort cleans up a failed multipart upload so its parts aren't kept around.
+func (b *S3) abort(key string, uploadID *string) {
+	b.client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{Bucket: &b.bucket, Key: &key, UploadId: uploadID})
+}
+
+func (b *S3) key(name string) string {
+	if name == "." {
+		return b.prefix
+	} else if b.prefix == "" {
+		return name
+	}
+	return b.prefix + "/" + name
+}
+
+// dirKey returns the prefix shared by every key inside the directory name.
+func (b *S3) dirKey(name string) string {
+	if key := b.key(name); key != "" {
+		return key + "/"
+	}
+	return ""
+}
+
+// objectInfo describes an object from its metadata, falling back to defaults for objects written by other tools.
+func objectInfo(name string, size int64, metadata map[string]string, lastModified *time.Time) *s3Info {
+	info := &s3Info{name: name, size: size, mode: 0644, mtime: aws.ToTime(lastModified)}
+
+	if ns, err := strconv.ParseInt(metadata[mtimeKey], 10, 64); err == nil {
+		info.mtime = time.Unix(0, ns)
+	}
+	if mode, err := strconv.ParseUint(metadata[modeKey], 8, 32); err == nil {
+		info.mode = fs.FileMode(mode).Perm()
+	}
+	if target := metadata[symlinkKey]; target != "" {
+		info.mode |= fs.ModeSymlink
+		info.target = target
+	}
+
+	uid, uidErr := strconv.ParseUint(metadata[uidKey], 10, 32)
+	gid, gidErr := strconv.ParseUint(metadata[gidKey], 10, 32)
+	if uidErr == nil && gidErr == nil {
+		info.owner = &filesystem.Ownership{Uid: uint32(uid), Gid: uint32(gid)}
+	}
+
+	return info
+}
+
+func isNotFound(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NotFound", "NoSuchKey":
+			return true
+		}
+	}
+
+	var respErr interface{ HTTPStatusCode() int }
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotFound
+}
+
+// s3File reads an object with ranged GETs, buffering ahead of the requested bytes.
+type s3File struct {
+	b    *S3
+	key  string
+	info *s3Info
+	pos  int64
+
+	buf    []byte
+	bufOff int64
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *s3File) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	for n < len(p) && off+int64(n) < f.info.size {
+		pos := off + int64(n)
+		if pos < f.bufOff || pos >= f.bufOff+int64(len(f.buf)) {
+			if err := f.fetch(pos, max(int64(len(p)-n), readAhead)); err != nil {
+				return n, err
+			}
+		}
+		n += copy(p[n:], f.buf[pos-f.bufOff:])
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fetch buffers up to length bytes of the object starting at off.
+func (f *s3File) fetch(off int64, length int64) error {
+	end := min(off+length, f.info.size)
+	obj, err := f.b.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: &f.b.bucket,
+		Key:    &f.key,
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", off, end-1)),
+	})
+	if err != nil {
+		return err
+	}
+	defer obj.Body.Close()
+
+	buf := make([]byte, end-off)
+	if _, err := io.ReadFull(obj.Body, buf); err != nil {
+		return err
+	}
+
+	f.buf, f.bufOff = buf, off
+	return nil
+}
+
+func (f *s3File) Close() error {
+	f.buf = nil
+	return nil
+}
+
+// s3Writer stages the parts of a file that are written in a local temporary file, at their offsets in the file.
+// The other parts stay in the object the file had when it was last uploaded.
+type s3Writer struct {
+	b   *S3
+	key string
+	tmp *os.File
+	// base is the size of the object the parts that aren't in tmp are copied from, and size the size of the file.
+	base int64
+	size int64
+	// loaded holds the indexes of the parts whose content is in tmp, and changed those written since the last upload.
+	loaded  map[int64]bool
+	changed map[int64]bool
+	// dirty is set when the file has changes that haven't been uploaded.
+	dirty  bool
+	closed bool
+}
+
+func (w *s3Writer) WriteAt(p []byte, off int64) (int, error) {
+	if w.closed {
+		return 0, fs.ErrClosed
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	// Parts written in part keep the rest of their content
+	end := off + int64(len(p))
+	for part := off / partSize; part*partSize < end; part++ {
+		if off > part*partSize || end < min((part+1)*partSize, w.base) {
+			if err := w.load(part); err != nil {
+				return 0, err
+			}
+		}
+		w.loaded[part], w.changed[part] = true, true
+	}
+
+	w.dirty = true
+	n, err := w.tmp.WriteAt(p, off)
+	w.size = max(w.size, off+int64(n))
+	return n, err
+}
+
+// load copies the content the part has in the uploaded object into tmp, unless it's there already.
+func (w *s3Writer) load(part int64) error {
+	start, end := part*partSize, min((part+1)*partSize, w.base)
+	if w.loaded[part] || start >= end {
+		return nil
+	}
+
+	obj, err := w.b.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: &w.b.bucket,
+		Key:    &w.key,
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, end-1)),
+	})
+	if err != nil {
+		return err
+	}
+	defer obj.Body.Close()
+
+	if _, err := io.Copy(io.NewOffsetWriter(w.tmp, start), io.LimitReader(obj.Body, end-start)); err != nil {
+		return err
+	}
+	w.loaded[part] = true
+	return nil
+}
+
+// Sync uploads the file if it changed since it was last uploaded.
+// Only the parts written since then are sent, the others are copied from the uploaded object within the bucket.
+func (w *s3Writer) Sync() error {
+	if w.closed {
+		return fs.ErrClosed
+	}
+	if !w.dirty {
+		return nil
+	}
+
+	var err error
+	if w.size <= partSize {
+		err = w.put()
+	} else {
+		err = w.uploadParts()
+	}
+	if err != nil {
+		return err
+	}
+
+	w.base, w.dirty = w.size, false
+	clear(w.changed)
+	return nil
+}
+
+// put uploads the file in a single request.
+func (w *s3Writer) put() error {
+	if err := w.load(0); err != nil {
+		return err
+	}
+
+	_, err := w.b.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:        &w.b.bucket,
+		Key:           &w.key,
+		Body:          io.NewSectionReader(w.tmp, 0, w.size),
+		ContentLength: aws.Int64(w.size),
+	})
+	return err
+}
+
+// uploadParts uploads the file as a multipart upload, copying the parts that haven't changed from the uploaded object.
+func (w *s3Writer) uploadParts() error {
+	ctx := context.Background()
+	b := w.b
+
+	upload, err := b.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: &b.bucket, Key: &w.key})
+	if err != nil {
+		return err
+	}
+
+	source := url.PathEscape(b.bucket + "/" + w.key)
+	var parts []types.CompletedPart
+	for part := int64(0); part*partSize < w.size; part++ {
+		number := aws.Int32(int32(part + 1))
+		start, end := part*partSize, min((part+1)*partSize, w.size)
+
+		var etag *string
+		if !w.changed[part] && end <= w.base {
+			var res *s3.UploadPartCopyOutput
+			res, err = b.client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+				Bucket:          &b.bucket,
+				Key:             &w.key,
+				UploadId:        upload.UploadId,
+				PartNumber:      number,
+				CopySource:      &source,
+				CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end-1)),
+			})
+			if err == nil {
+				etag = res.CopyPartResult.ETag
+			}
+		} else if err = w.load(part); err == nil {
+			var res *s3.UploadPartOutput
+			res, err = b.client.UploadPart(ctx, &s3.UploadPartInput{
+				Bucket:        &b.bucket,
+				Key:           &w.key,
+				UploadId:      upload.UploadId,
+				PartNumber:    number,
+				Body:          io.NewSectionReader(w.tmp, start, end-start),
+				ContentLength: aws.Int64(end - start),
+			})
+			if err == nil {
+				etag = res.ETag
+			}
+		}
+		if err != nil {
+			b.abort(w.key, upload.UploadId)
+			return err
+		}
+		parts = append(parts, types.CompletedPart{ETag: etag, PartNumber: number})
+	}
+
+	return b.complete(w.key, upload.UploadId, parts)
+}
+
+func (w *s3Writer) Close() error {
+	if w.closed {
+		return fs.ErrClosed
+	}
+
+	err := w.Sync()
+	w.discard()
+	return err
+}
+
+func (w *s3Writer) discard() {
+	w.closed = true
+	w.tmp.Close()
+	os.Remove(w.tmp.Name())
+}
+
+// s3Entry is a directory entry whose full info, including the modification time kept in metadata, is fetched on demand.
+type s3Entry struct {
+	b    *S3
+	name string
+	info *s3Info
+	full *s3Info
+}
+
+func (e *s3Entry) Name() string { return e.info.name }
+func (e *s3Entry) IsDir() bool  { return e.info.IsDir() }
+
+// Type tells symlinks apart from empty files, which the listing alone can't.
+func (e *s3Entry) Type() fs.FileMode {
+	if e.info.size == 0 && !e.info.IsDir() {
+		if info, err := e.Info(); err == nil {
+			return info.Mode().Type()
+		}
+	}
+	return e.info.mode.Type()
+}
+
+func (e *s3Entry) Info() (fs.FileInfo, error) {
+	if e.full == nil {
+		info, err := e.b.stat("stat", e.name)
+		if err != nil {
+			return nil, err
+		}
+		e.full = info
+	}
+	return e.full, nil
+}
+
+type s3Dir struct {
+	info    *s3Info
+	entries []fs.DirEntry
+	read    int
+}
+
+func (d *s3Dir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *s3Dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errIsDir}
+}
+
+func (d *s3Dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.read:]
+	if n > 0 {
+		if len(remaining) == 0 {
+			return nil, io.EOF
+		}
+		remaining = remaining[:min(n, len(remaining))]
+	}
+
+	d.read += len(remaining)
+	return remaining, nil
+}
+
+func (d *s3Dir) Close() error {
+	return nil
+}
+
+type s3Info struct {
+	name  string
+	size  int64
+	mode  fs.FileMode
+	mtime time.Time
+	owner *filesystem.Ownership
+	// target is set for symlinks.
+	target string
+}
+
+// metadata returns the object metadata that records the info.
+func (i *s3Info) metadata() map[string]string {
+	metadata := map[string]string{
+		mtimeKey: strconv.FormatInt(i.mtime.UnixNano(), 10),
+		modeKey:  strconv.FormatUint(uint64(i.mode.Perm()), 8),
+	}
+	if i.owner != nil {
+		metadata[uidKey] = strconv.FormatUint(uint64(i.owner.GetUid()), 10)
+		metadata[gidKey] = strconv.FormatUint(uint64(i.owner.GetGid()), 10)
+	}
+	if i.target != "" {
+		metadata[symlinkKey] = i.target
+	}
+	return metadata
+}
+
+func (i *s3Info) Name() string       { return i.name }
+func (i *s3Info) Size() int64        { return i.size }
+func (i *s3Info) Mode() fs.FileMode  { return i.mode }
+func (i *s3Info) ModTime() time.Time { return i.mtime }
+func (i *s3Info) IsDir() bool        { return i.mode.IsDir() }
+func (i *s3Info) Sys() any           { return &files.Sys{Owner: i.owner} }
@@ -0,0 +1,444 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+const testBucket = "bucket"
+
+// s3Requests counts the requests a fake S3 server received that move file content.
+type s3Requests struct {
+	mu sync.Mutex
+	// puts counts PutObject requests and parts UploadPart requests, partBytes the bytes they uploaded,
+	// copies UploadPartCopy requests and gets ranged GetObject requests.
+	puts, parts, copies, gets int
+	partBytes                 int64
+}
+
+func (r *s3Requests) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.puts, r.parts, r.copies, r.gets, r.partBytes = 0, 0, 0, 0, 0
+}
+
+// newTestS3 returns a backend storing its files under prefix in a bucket of an in-memory S3 server, and the requests that server receives.
+func newTestS3(t *testing.T, prefix string) (*S3, *s3Requests) {
+	t.Helper()
+
+	storage := s3mem.New()
+	if err := storage.CreateBucket(testBucket); err != nil {
+		t.Fatal(err)
+	}
+	faker := gofakes3.New(storage)
+
+	requests := &s3Requests{}
+	srv := httptest.NewServer(requests.handler(faker.Server()))
+	t.Cleanup(srv.Close)
+
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "id", SecretAccessKey: "secret"}, nil
+		}),
+		RequestChecksumCalculation: aws.RequestChecksumCalculationWhenRequired,
+		ResponseChecksumValidation: aws.ResponseChecksumValidationWhenRequired,
+	})
+	return NewS3(client, testBucket, prefix), requests
+}
+
+// handler counts the requests passed to next, and serves UploadPartCopy requests, which gofakes3 lacks,
+// as a ranged GET of the source followed by an UploadPart.
+func (r *s3Requests) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		r.mu.Lock()
+		switch {
+		case req.Method == http.MethodPut && query.Has("uploadId") && req.Header.Get("X-Amz-Copy-Source") != "":
+			r.copies++
+		case req.Method == http.MethodPut && query.Has("uploadId"):
+			r.parts++
+			r.partBytes += req.ContentLength
+		case req.Method == http.MethodPut && req.Header.Get("X-Amz-Copy-Source") == "":
+			r.puts++
+		case req.Method == http.MethodGet && req.Header.Get("Range") != "":
+			r.gets++
+		}
+		r.mu.Unlock()
+
+		source := req.Header.Get("X-Amz-Copy-Source")
+		if req.Method != http.MethodPut || !query.Has("uploadId") || source == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		sourcePath, err := url.PathUnescape(source)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		get := httptest.NewRequestWithContext(req.Context(), http.MethodGet, "/"+strings.TrimPrefix(sourcePath, "/"), nil)
+		get.Header.Set("Range", req.Header.Get("X-Amz-Copy-Source-Range"))
+		got := httptest.NewRecorder()
+		next.ServeHTTP(got, get)
+		if got.Code != http.StatusOK && got.Code != http.StatusPartialContent {
+			http.Error(w, got.Body.String(), got.Code)
+			return
+		}
+
+		part := req.Clone(req.Context())
+		part.Header.Del("X-Amz-Copy-Source")
+		part.Header.Del("X-Amz-Copy-Source-Range")
+		part.Header.Set("Content-Length", strconv.Itoa(got.Body.Len()))
+		part.ContentLength = int64(got.Body.Len())
+		part.Body = io.NopCloser(bytes.NewReader(got.Body.Bytes()))
+		put := httptest.NewRecorder()
+		next.ServeHTTP(put, part)
+		if put.Code != http.StatusOK {
+			http.Error(w, put.Body.String(), put.Code)
+			return
+		}
+
+		fmt.Fprintf(w, `<CopyPartResult><ETag>%s</ETag><LastModified>%s</LastModified></CopyPartResult>`, put.Header().Get("ETag"), time.Now().UTC().Format(time.RFC3339))
+	})
+}
+
+// randomData returns n pseudo-random bytes, the same for the same seed.
+func randomData(seed byte, n int) []byte {
+	data := make([]byte, n)
+	rand.NewChaCha8([32]byte{seed}).Read(data)
+	return data
+}
+
+func TestS3Writer(t *testing.T) {
+	b, requests := newTestS3(t, "prefix")
+
+	w, err := b.Create("dir/file", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, b, "dir/file", []byte("hello"))
+
+	// Syncing again without writes uploads nothing
+	requests.reset()
+	if err := w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteAt([]byte(" world"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if requests.puts != 1 {
+		t.Fatalf("made %d uploads, want 1", requests.puts)
+	}
+	checkFile(t, b, "dir/file", []byte("hello world"))
+	if _, err := w.WriteAt([]byte("x"), 0); err == nil {
+		t.Fatal("wrote to a closed writer")
+	}
+
+	writeFile(t, b, "dir/file", false, 6, []byte("there"))
+	checkFile(t, b, "dir/file", []byte("hello there"))
+	writeFile(t, b, "dir/file", false, 13, []byte("!"))
+	checkFile(t, b, "dir/file", []byte("hello there\x00\x00!"))
+	writeFile(t, b, "dir/file", true, 0, []byte("new"))
+	checkFile(t, b, "dir/file", []byte("new"))
+
+	// Opening an existing file without writing to it leaves it be
+	requests.reset()
+	w, err = b.Create("dir/file", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if requests.puts != 0 || requests.gets != 0 {
+		t.Fatalf("made %d uploads and %d downloads, want none", requests.puts, requests.gets)
+	}
+	checkFile(t, b, "dir/file", []byte("new"))
+}
+
+func TestS3WriterParts(t *testing.T) {
+	b, requests := newTestS3(t, "")
+	data := randomData(1, 2*partSize+partSize/2)
+
+	// Written in chunks smaller than a part, as uploads are
+	w, err := b.Create("big", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for off := 0; off < len(data); off += 1 << 20 {
+		if _, err := w.WriteAt(data[off:min(off+1<<20, len(data))], int64(off)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if requests.parts != 3 || requests.partBytes != int64(len(data)) {
+		t.Fatalf("uploaded %d parts of %d bytes, want 3 of %d", requests.parts, requests.partBytes, len(data))
+	}
+	checkFile(t, b, "big", data)
+
+	tests := []struct {
+		name string
+		off  int64
+		data []byte
+		// parts and copies are the parts uploaded and copied, and gets the parts downloaded to complete the ones written.
+		parts, copies, gets int
+	}{
+		{"within a part", partSize + 10, []byte("changed"), 1, 2, 1},
+		{"whole part", 0, randomData(2, partSize), 1, 2, 0},
+		{"across parts", 2*partSize - 3, []byte("across"), 2, 1, 2},
+		{"last part", int64(len(data)) - 1, []byte("!"), 1, 2, 1},
+		{"appended", int64(len(data)), randomData(3, partSize), 2, 2, 1},
+		{"after a gap", 4*partSize + 100, []byte("gap"), 2, 3, 1},
+	}
+	for _, test := range tests {
+		if end := test.off + int64(len(test.data)); end > int64(len(data)) {
+			data = append(data, make([]byte, end-int64(len(data)))...)
+		}
+		copy(data[test.off:], test.data)
+
+		requests.reset()
+		writeFile(t, b, "big", false, test.off, test.data)
+		if requests.parts != test.parts || requests.copies != test.copies || requests.gets != test.gets {
+			t.Fatalf("%s: uploaded %d parts, copied %d and downloaded %d, want %d, %d and %d",
+				test.name, requests.parts, requests.copies, requests.gets, test.parts, test.copies, test.gets)
+		}
+		checkFile(t, b, "big", data)
+	}
+}
+
+func TestS3ReadAt(t *testing.T) {
+	b, requests := newTestS3(t, "")
+	data := randomData(4, 3*readAhead+5)
+	writeFile(t, b, "file", true, 0, data)
+
+	f, err := b.Open("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := f.(io.ReaderAt)
+
+	tests := []struct {
+		name      string
+		off, n    int64
+		wantN     int64
+		fetches   int
+		wantError bool
+	}{
+		{"start", 0, 10, 10, 1, false},
+		{"buffered", 100, 1000, 1000, 0, false},
+		{"next window", readAhead + 1, 10, 10, 1, false},
+		{"larger than the window", 0, 2*readAhead + 1, 2*readAhead + 1, 1, false},
+		{"past the end", int64(len(data)) - 3, 10, 3, 1, true},
+		{"at the end", int64(len(data)), 1, 0, 0, true},
+	}
+	for _, test := range tests {
+		requests.reset()
+		p := make([]byte, test.n)
+		n, err := r.ReadAt(p, test.off)
+		if int64(n) != test.wantN || (err != nil) != test.wantError {
+			t.Fatalf("%s: read %d bytes and error %v, want %d bytes and error %v", test.name, n, err, test.wantN, test.wantError)
+		}
+		if !bytes.Equal(p[:n], data[test.off:test.off+int64(n)]) {
+			t.Fatalf("%s: read the wrong bytes", test.name)
+		}
+		if requests.gets != test.fetches {
+			t.Fatalf("%s: made %d ranged requests, want %d", test.name, requests.gets, test.fetches)
+		}
+	}
+}
+
+func TestS3ReadDir(t *testing.T) {
+	b, _ := newTestS3(t, "prefix")
+	writeFile(t, b, "dir/file", true, 0, []byte("data"))
+	writeFile(t, b, "dir/sub/file", true, 0, []byte("data"))
+	if err := b.MkdirAll("dir/empty"); err != nil {
+		t.Fatal(err)
+	}
+	// Markers of directories that also hold files, as other tools leave them
+	for _, key := range []string{"prefix/dir/", "prefix/dir/sub/"} {
+		if _, err := b.client.PutObject(context.Background(), &s3.PutObjectInput{Bucket: aws.String(testBucket), Key: aws.String(key), Body: strings.NewReader("")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := b.ReadDir("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range entries {
+		got = append(got, fmt.Sprintf("%s %v", entry.Name(), entry.IsDir()))
+	}
+	if want := "[empty true file false sub true]"; fmt.Sprint(got) != want {
+		t.Fatalf("got entries %v, want %s", got, want)
+	}
+
+	if entries, err := b.ReadDir("dir/empty"); err != nil || len(entries) != 0 {
+		t.Fatalf("empty directory has entries %v and error %v", entries, err)
+	}
+	if info, err := b.Stat("dir/empty"); err != nil || !info.IsDir() {
+		t.Fatalf("empty directory has info %v and error %v", info, err)
+	}
+	if _, err := b.ReadDir("dir/file"); err == nil {
+		t.Fatal("read a file as a directory")
+	}
+	if _, err := b.ReadDir("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("reading a missing directory returned %v", err)
+	}
+
+	if err := b.Remove("dir/sub"); err == nil {
+		t.Fatal("removed a directory that isn't empty")
+	}
+	if err := b.Remove("dir/empty"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Stat("dir/empty"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("removed directory has error %v", err)
+	}
+}
+
+func TestS3Rename(t *testing.T) {
+	b, _ := newTestS3(t, "")
+	mtime := time.Unix(1700000000, 123)
+	writeFile(t, b, "a/file", true, 0, []byte("file"))
+	writeFile(t, b, "a/sub/nested", true, 0, []byte("nested"))
+	if err := b.MkdirAll("a/empty"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Chtimes("a/file", mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Chmod("a/file", 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Rename("a", "b/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Stat("a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("renamed directory has error %v", err)
+	}
+	checkFile(t, b, "b/a/file", []byte("file"))
+	checkFile(t, b, "b/a/sub/nested", []byte("nested"))
+	if info, err := b.Stat("b/a/empty"); err != nil || !info.IsDir() {
+		t.Fatalf("empty directory has info %v and error %v", info, err)
+	}
+	info, err := b.Stat("b/a/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(mtime) || info.Mode() != 0600 {
+		t.Fatalf("renamed file has mode %v and mtime %v, want %v and %v", info.Mode(), info.ModTime(), fs.FileMode(0600), mtime)
+	}
+
+	// Renaming a file replaces the one in its place
+	writeFile(t, b, "other", true, 0, []byte("other"))
+	if err := b.Rename("other", "b/a/file"); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, b, "b/a/file", []byte("other"))
+
+	if err := b.Rename("b", "b/inside"); err == nil {
+		t.Fatal("renamed a directory into itself")
+	}
+	if err := b.Rename("missing", "x"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("renaming a missing file returned %v", err)
+	}
+}
+
+func TestS3Symlink(t *testing.T) {
+	b, _ := newTestS3(t, "prefix")
+	writeFile(t, b, "dir/file", true, 0, []byte("data"))
+	if err := b.Symlink("file", "dir/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Symlink("link", "dir/chain"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Symlink("../../escapes", "dir/escape"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Symlink("file", "dir/link"); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("creating an existing symlink returned %v", err)
+	}
+
+	info, err := b.Lstat("dir/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&fs.ModeSymlink == 0 {
+		t.Fatalf("symlink has mode %v", info.Mode())
+	}
+	if target, err := b.ReadLink("dir/link"); err != nil || target != "file" {
+		t.Fatalf("symlink points at %q with error %v", target, err)
+	}
+	if _, err := b.ReadLink("dir/file"); err == nil {
+		t.Fatal("read a file as a symlink")
+	}
+
+	for _, name := range []string{"dir/link", "dir/chain"} {
+		info, err := b.Stat(name)
+		if err != nil || info.Size() != 4 || !info.Mode().IsRegular() {
+			t.Fatalf("%s follows to info %v and error %v", name, info, err)
+		}
+		checkFile(t, b, name, []byte("data"))
+	}
+	if _, err := b.Stat("dir/escape"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("symlink leading outside the backend has error %v", err)
+	}
+
+	entries, err := b.ReadDir("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if isLink := entry.Type()&fs.ModeSymlink != 0; isLink != (entry.Name() != "file") {
+			t.Fatalf("%s has type %v", entry.Name(), entry.Type())
+		}
+	}
+
+	// Renaming keeps the link, and removing it keeps what it points at
+	if err := b.Rename("dir/link", "dir/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := b.ReadLink("dir/moved"); err != nil || target != "file" {
+		t.Fatalf("renamed symlink points at %q with error %v", target, err)
+	}
+	if err := b.Remove("dir/moved"); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, b, "dir/file", []byte("data"))
+}
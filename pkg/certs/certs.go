@@ -0,0 +1,178 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ServerConfig returns a TLS configuration that serves the certificate in certFile with the key in keyFile.
+// With clientCAFile set, clients must present a certificate signed by one of the CAs in it.
+// The files are read again whenever they change on disk, so certificates can be rotated without a restart.
+func ServerConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	pair := &keyPair{certFile: certFile, keyFile: keyFile}
+	if _, err := pair.get(); err != nil {
+		return nil, err
+	}
+	getCertificate := func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return pair.get()
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: getCertificate}
+	if clientCAFile == "" {
+		return config, nil
+	}
+
+	cas := &certPool{file: clientCAFile}
+	if _, err := cas.get(); err != nil {
+		return nil, err
+	}
+	// Every handshake gets a configuration with the current client CAs
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		pool, err := cas.get()
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: getCertificate,
+			ClientAuth:     tls.RequireAndVerifyClientCert,
+			ClientCAs:      pool,
+		}, nil
+	}
+	return config, nil
+}
+
+// ClientConfig returns a TLS configuration that verifies the server against the CAs in caFile, or the system's roots if it's empty.
+// serverName overrides the name the server's certificate must be valid for, which is otherwise taken from the address dialed.
+// With certFile and keyFile set, the client presents that certificate to servers that ask for one.
+func ClientConfig(caFile string, certFile string, keyFile string, serverName string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: serverName}
+
+	if caFile != "" {
+		pool, err := loadPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("a client certificate needs both a certificate and a key file")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// keyPair holds a certificate and key read from files, reading them again once either file's modification time changes.
+type keyPair struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	modTimes [2]time.Time
+	cert     *tls.Certificate
+}
+
+// get returns the current certificate. If the files changed but can't be loaded, for example because
+// they're halfway through being replaced, the previous certificate is kept until they can.
+func (k *keyPair) get() (*tls.Certificate, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	modTimes, err := modTimes(k.certFile, k.keyFile)
+	if err == nil && k.cert != nil && modTimes == k.modTimes {
+		return k.cert, nil
+	}
+
+	if err == nil {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(k.certFile, k.keyFile); err == nil {
+			if k.cert != nil {
+				fmt.Printf("Reloaded certificate from %s\n", k.certFile)
+			}
+			k.cert, k.modTimes = &cert, modTimes
+			return k.cert, nil
+		}
+	}
+
+	if k.cert == nil {
+		return nil, fmt.Errorf("could not load certificate: %v", err)
+	}
+	fmt.Printf("Could not reload certificate from %s, keeping the previous one: %v\n", k.certFile, err)
+	return k.cert, nil
+}
+
+// certPool holds the CA certificates read from a file, reading it again once its modification time changes.
+type certPool struct {
+	file string
+
+	mu      sync.Mutex
+	modTime time.Time
+	pool    *x509.CertPool
+}
+
+// get returns the current pool. Like keyPair.get, it keeps the previous pool while the file can't be loaded.
+func (c *certPool) get() (*x509.CertPool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info, err := os.Stat(c.file)
+	if err == nil && c.pool != nil && info.ModTime().Equal(c.modTime) {
+		return c.pool, nil
+	}
+
+	if err == nil {
+		var pool *x509.CertPool
+		if pool, err = loadPool(c.file); err == nil {
+			if c.pool != nil {
+				fmt.Printf("Reloaded CA certificates from %s\n", c.file)
+			}
+			c.pool, c.modTime = pool, info.ModTime()
+			return c.pool, nil
+		}
+	}
+
+	if c.pool == nil {
+		return nil, err
+	}
+	fmt.Printf("Could not reload CA certificates from %s, keeping the previous ones: %v\n", c.file, err)
+	return c.pool, nil
+}
+
+// loadPool reads the PEM encoded CA certificates in file.
+func loadPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA certificates: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no CA certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// modTimes returns the modification times of both files.
+func modTimes(first string, second string) ([2]time.Time, error) {
+	var times [2]time.Time
+	for i, name := range []string{first, second} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return times, err
+		}
+		times[i] = info.ModTime()
+	}
+	return times, nil
+}
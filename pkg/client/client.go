@@ -2,111 +2,786 @@ package client
 
 import (
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"math"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
 	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/RGood/fs-xfer/pkg/codec"
+	"github.com/RGood/fs-xfer/pkg/delta"
 	"github.com/RGood/fs-xfer/pkg/files"
 	"github.com/RGood/fs-xfer/pkg/generated/filesystem"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
+// maxUploadAttempts bounds how many times Upload streams before giving up on a session.
+const maxUploadAttempts = 5
+
+// maxListAttempts bounds how many times WalkManifest resumes a listing before giving up.
+const maxListAttempts = 5
+
 type StorageClient struct {
 	c filesystem.StorageServiceClient
+	// noOwner stops file owners from being sent on upload and restored on download.
+	noOwner bool
+	// compression is the codec transfers are compressed with where the server supports it.
+	compression      filesystem.Compression
+	compressionLevel int
+	// parallel is the number of concurrent streams transfers are split across.
+	parallel int
+	// creds authenticate every call, if set.
+	creds credentials.PerRPCCredentials
+	// shareToken authorizes downloads with a share link, if set.
+	shareToken string
+}
+
+// Option configures optional StorageClient behavior.
+type Option func(*StorageClient)
+
+// WithoutOwnership neither sends the owners of uploaded files nor restores the owners of downloaded ones.
+// Permissions and modification times are still preserved.
+func WithoutOwnership() Option {
+	return func(s *StorageClient) {
+		s.noOwner = true
+	}
 }
 
-func NewStorageClient(conn *grpc.ClientConn) *StorageClient {
-	return &StorageClient{
-		c: filesystem.NewStorageServiceClient(conn),
+// WithCompression compresses the chunks of uploads and downloads with the codec at level, where zero picks the codec's default.
+// Transfers fall back to uncompressed chunks if the server doesn't support the codec.
+func WithCompression(c filesystem.Compression, level int) Option {
+	return func(s *StorageClient) {
+		s.compression, s.compressionLevel = c, level
 	}
 }
 
+// WithParallel splits uploads and downloads across n concurrent streams. Each file is sent whole on one stream,
+// except large files, which are split into ranges sent on different streams.
+func WithParallel(n int) Option {
+	return func(s *StorageClient) {
+		s.parallel = n
+	}
+}
+
+// WithShareToken downloads with a share link token from CreateShareLink, which needs no other credentials.
+// An empty remote path downloads what was shared. Downloads with a share link use a single stream.
+func WithShareToken(token string) Option {
+	return func(s *StorageClient) {
+		s.shareToken = token
+	}
+}
+
+func NewStorageClient(conn *grpc.ClientConn, opts ...Option) *StorageClient {
+	s := &StorageClient{}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	var cc grpc.ClientConnInterface = conn
+	if s.creds != nil {
+		cc = &credentialsConn{ClientConnInterface: conn, creds: grpc.PerRPCCredentials(s.creds)}
+	}
+	s.c = filesystem.NewStorageServiceClient(cc)
+
+	return s
+}
+
 // Download downloads the remote path to the local path and returns the total size of the downloaded data.
+// Each chunk and file is checked against the digests sent by the server, and files get the permissions,
+// modification time and owner they have on the server.
 func (s *StorageClient) Download(ctx context.Context, remotePath string, localPath string) (int64, error) {
-	downloadClient, err := s.c.Download(ctx, &filesystem.DownloadRequest{Path: remotePath})
+	return s.download(ctx, remotePath, localPath, nil)
+}
+
+// DownloadDelta is like Download, but files that already exist under the local path are updated by
+// transferring only the blocks that differ from the local copy.
+func (s *StorageClient) DownloadDelta(ctx context.Context, remotePath string, localPath string) (int64, error) {
+	signatures, err := localSignatures(localPath)
 	if err != nil {
 		return 0, err
 	}
+	return s.download(ctx, remotePath, localPath, signatures)
+}
 
-	var totalSize int64
+// maxSignatureBytes keeps a DownloadRequest under gRPC's default 4 MiB message limit.
+const maxSignatureBytes = 3 * 1024 * 1024
 
-	downloadClient.CloseSend()
+// localSignatures signs the files under localPath, stopping once the signatures would no longer fit in one request.
+func localSignatures(localPath string) ([]*filesystem.FileSignature, error) {
+	if info, err := os.Stat(localPath); errors.Is(err, fs.ErrNotExist) || (err == nil && !info.IsDir()) {
+		return nil, nil
+	}
+
+	entries, err := files.Tree(localPath, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var signatures []*filesystem.FileSignature
+	var total int
+	for _, entry := range entries {
+		if entry.GetType() != filesystem.EntryType_REGULAR || entry.GetSize() == 0 {
+			continue
+		}
+
+		f, err := os.Open(path.Join(localPath, entry.GetPath()))
+		if err != nil {
+			return nil, err
+		}
+		sig, err := delta.Sign(f, entry.GetSize())
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		sig.Path = entry.GetPath()
+
+		if total += proto.Size(sig); total > maxSignatureBytes || len(signatures) == delta.MaxSignatures {
+			break
+		}
+		signatures = append(signatures, sig)
+	}
+
+	return signatures, nil
+}
+
+func (s *StorageClient) download(ctx context.Context, remotePath string, localPath string, signatures []*filesystem.FileSignature) (int64, error) {
+	d := &downloader{s: s, localPath: localPath, hasBase: map[string]bool{}, files: map[string]*localFile{}}
+	defer d.close()
+	for _, sig := range signatures {
+		d.hasBase[sig.GetPath()] = true
+	}
 
-	curFilename := ""
-	var curFile *os.File
+	streams := s.streams()
+	if s.shareToken != "" {
+		// Share links count every download call, so they can't be split across streams
+		streams = 1
+	}
+	err := parallel(ctx, streams, func(ctx context.Context, shard int) error {
+		req := &filesystem.DownloadRequest{
+			Path:             remotePath,
+			Signatures:       signatures,
+			CompressionLevel: int32(s.compressionLevel),
+			Shard:            int32(shard),
+			Shards:           int32(streams),
+			ShareToken:       s.shareToken,
+		}
+		if s.compression != filesystem.Compression_UNCOMPRESSED {
+			req.Compressions = []filesystem.Compression{s.compression}
+		}
+		return d.receive(ctx, req)
+	})
+	if err == nil {
+		err = d.finish()
+	}
+	if err != nil {
+		d.discard()
+	}
+
+	return d.size, err
+}
+
+// downloader writes the chunks of a download under localPath as they arrive on any of its streams.
+// Everything is written through an os.Root, so symlinks under localPath are never followed out of it.
+type downloader struct {
+	s         *StorageClient
+	localPath string
+	hasBase   map[string]bool
+
+	rootOnce sync.Once
+	root     *os.Root
+	rootErr  error
+
+	mu    sync.Mutex
+	files map[string]*localFile
+	// links holds the hardlinks received, which are created once every file they could link to is complete.
+	links []*filesystem.File
+	size  int64
+}
+
+// receive writes the chunks of one Download stream.
+func (d *downloader) receive(ctx context.Context, req *filesystem.DownloadRequest) error {
+	downloadClient, err := d.s.c.Download(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	downloadClient.CloseSend()
 
 	for {
 		file, err := downloadClient.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := files.Decompress(file); err != nil {
+			return err
+		}
+		if err := files.VerifyChunk(file); err != nil {
+			return err
+		}
+
+		switch file.GetType() {
+		case filesystem.EntryType_REGULAR:
+			err = d.write(file)
+		case filesystem.EntryType_HARDLINK:
+			d.mu.Lock()
+			d.links = append(d.links, file)
+			d.mu.Unlock()
+		default:
+			err = d.createEntry(file)
+		}
 		if err != nil {
-			break
+			return err
 		}
+	}
+}
 
-		fullFileName := path.Join(localPath, file.GetPath(), file.GetName())
+// openRoot returns the root that the download is written through, creating localPath first if needed.
+func (d *downloader) openRoot() (*os.Root, error) {
+	d.rootOnce.Do(func() {
+		if d.rootErr = os.MkdirAll(d.localPath, os.ModePerm); d.rootErr == nil {
+			d.root, d.rootErr = os.OpenRoot(d.localPath)
+		}
+	})
+	return d.root, d.rootErr
+}
 
-		if fullFileName != curFilename {
-			curFile.Close()
+// close closes the root once the download is over.
+func (d *downloader) close() {
+	if d.root != nil {
+		d.root.Close()
+	}
+}
 
-			dir := path.Dir(fullFileName)
-			if err := os.MkdirAll(dir, os.ModePerm); err != nil {
-				return 0, err
+// write writes a chunk to its file, which is checked against its digest and given its metadata once every byte of it has arrived.
+func (d *downloader) write(file *filesystem.File) error {
+	root, err := d.openRoot()
+	if err != nil {
+		return err
+	}
+	name := localName(file)
+
+	d.mu.Lock()
+	l, ok := d.files[name]
+	if !ok {
+		if err := files.CheckParents(root.FS(), ".", name); err != nil {
+			d.mu.Unlock()
+			return err
+		}
+		if l, err = createLocalFile(root, name, d.hasBase[name]); err != nil {
+			d.mu.Unlock()
+			return err
+		}
+		d.files[name] = l
+	}
+	d.size += int64(len(file.GetData()))
+	d.mu.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	complete, err := l.write(file)
+	if err != nil || !complete {
+		return err
+	}
+	if err := l.finish(); err != nil {
+		return err
+	}
+	return files.ApplyMetadata(root, name, l.final.GetMetadata(), !d.s.noOwner)
+}
+
+// finish creates the hardlinks of the download once every stream has ended, and checks that no file is missing data.
+func (d *downloader) finish() error {
+	for _, l := range d.files {
+		if !l.done {
+			return fmt.Errorf("download of %s is incomplete", l.name)
+		}
+	}
+
+	for _, file := range d.links {
+		if err := d.createEntry(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discard throws away the partially rebuilt deltas of a failed download.
+func (d *downloader) discard() {
+	for _, l := range d.files {
+		l.discard()
+	}
+}
+
+// createEntry creates the empty directory, symlink or hardlink described by file, replacing whatever file or empty directory is in its place.
+// Nothing is created inside a symlink, symlinks that would lead out of the download are rejected and hardlinks only point at regular files.
+func (d *downloader) createEntry(file *filesystem.File) error {
+	root, err := d.openRoot()
+	if err != nil {
+		return err
+	}
+	name := localName(file)
+	if err := files.CheckParents(root.FS(), ".", name); err != nil {
+		return err
+	}
+
+	switch file.GetType() {
+	case filesystem.EntryType_DIRECTORY:
+		if info, err := root.Lstat(name); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			if err := root.Remove(name); err != nil {
+				return err
 			}
+		}
+		if err := root.MkdirAll(name, os.ModePerm); err != nil {
+			return err
+		}
+		return files.ApplyMetadata(root, name, file.GetMetadata(), !d.s.noOwner)
+	case filesystem.EntryType_SYMLINK, filesystem.EntryType_HARDLINK:
+	default:
+		return fmt.Errorf("%s has unknown type %v", name, file.GetType())
+	}
+
+	target, err := files.LinkTarget(file)
+	if err != nil {
+		return err
+	}
+	if file.GetType() == filesystem.EntryType_SYMLINK {
+		err = files.CheckSymlink(root.FS(), ".", file)
+	} else if err = files.CheckParents(root.FS(), ".", target); err == nil {
+		var info fs.FileInfo
+		if info, err = root.Lstat(target); err == nil && !info.Mode().IsRegular() {
+			err = fmt.Errorf("hardlink %s -> %s doesn't point at a regular file", name, target)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := root.MkdirAll(path.Dir(name), os.ModePerm); err != nil {
+		return err
+	}
+	if err := root.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if file.GetType() == filesystem.EntryType_SYMLINK {
+		return root.Symlink(filepath.FromSlash(files.SymlinkTarget(file)), name)
+	}
+	return root.Link(target, name)
+}
+
+// localName maps a chunk's path and name to a name under the root of a download, ignoring attempts to climb out of it.
+func localName(file *filesystem.File) string {
+	name := strings.TrimPrefix(path.Clean("/"+files.Key(file)), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// localFile is a file being written by Download, possibly from several streams at once. Files rebuilt from a delta
+// against an existing copy are written next to it and replace it once complete.
+type localFile struct {
+	// root is what name and writePath are relative to.
+	root      *os.Root
+	name      string
+	writePath string
+	f         *os.File
+	base      *os.File
+	baseSize  int64
+
+	// mu is held while writing to the file.
+	mu       sync.Mutex
+	received files.Ranges
+	// digest covers the bytes received so far while they arrive in order, or is nil once they don't.
+	digest hash.Hash
+	// final is the chunk that ends the file at end, once it has arrived.
+	final *filesystem.File
+	end   int64
+	done  bool
+}
+
+func createLocalFile(root *os.Root, name string, hasBase bool) (*localFile, error) {
+	if err := root.MkdirAll(path.Dir(name), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	l := &localFile{root: root, name: name, writePath: name, digest: sha256.New()}
 
-			f, err := os.OpenFile(fullFileName, os.O_CREATE|os.O_WRONLY, 0644)
+	if hasBase {
+		base, err := root.Open(name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if base != nil {
+			info, err := base.Stat()
 			if err != nil {
-				return 0, err
+				base.Close()
+				return nil, err
 			}
+			l.base, l.baseSize = base, info.Size()
+			l.writePath = path.Join(path.Dir(name), "."+path.Base(name)+".partial")
+		}
+	}
 
-			curFile = f
-			curFilename = fullFileName
+	// A symlink in the file's place is replaced rather than written through
+	if info, err := root.Lstat(l.writePath); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		if err := root.Remove(l.writePath); err != nil {
+			l.base.Close()
+			return nil, err
 		}
+	}
 
-		b, err := curFile.Write(file.GetData())
-		if err != nil {
-			panic(err)
+	f, err := root.OpenFile(l.writePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		l.base.Close()
+		return nil, err
+	}
+	l.f = f
+
+	return l, nil
+}
+
+// write writes the chunk at its offset and reports whether every byte of the file has now arrived. l.mu must be held.
+func (l *localFile) write(file *filesystem.File) (bool, error) {
+	if l.done {
+		return false, nil
+	}
+
+	data := file.GetData()
+	if c := file.GetCopy(); c != nil {
+		if l.base == nil {
+			return false, fmt.Errorf("server sent a copy for %s, which has no local copy", files.Key(file))
+		}
+
+		if err := files.CheckCopy(c, l.baseSize); err != nil {
+			return false, fmt.Errorf("server sent an invalid copy for %s: %v", files.Key(file), err)
+		}
+
+		data = make([]byte, c.GetLength())
+		if n, err := l.base.ReadAt(data, c.GetOffset()); n < len(data) {
+			return false, fmt.Errorf("copy of %d bytes at %d is outside the local copy of %s: %v", c.GetLength(), c.GetOffset(), files.Key(file), err)
 		}
-		totalSize += int64(b)
 	}
 
-	return totalSize, nil
+	if _, err := l.f.WriteAt(data, file.GetOffset()); err != nil {
+		return false, err
+	}
+
+	if l.digest != nil && l.received.Continues(file.GetOffset()) {
+		l.digest.Write(data)
+	} else {
+		l.digest = nil
+	}
+	l.received.Add(file.GetOffset(), int64(len(data)))
+
+	if file.GetFileSha256() != nil && l.final == nil {
+		l.final, l.end = file, file.GetOffset()+int64(len(data))
+	}
+	return l.final != nil && l.received.Contiguous() >= l.end, nil
+}
+
+// finish closes the complete file, checks it against the digest of its final chunk and moves it into place. l.mu must be held.
+func (l *localFile) finish() error {
+	l.base.Close()
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+
+	var sum []byte
+	if l.digest != nil {
+		sum = l.digest.Sum(nil)
+	} else {
+		var err error
+		if sum, err = files.HashFS(l.root.FS(), l.writePath); err != nil {
+			return err
+		}
+	}
+	if err := files.VerifyFile(l.final, sum); err != nil {
+		return err
+	}
+
+	l.done = true
+	if l.writePath != l.name {
+		return l.root.Rename(l.writePath, l.name)
+	}
+	return nil
+}
+
+// discard closes the file if it isn't complete, throwing away a partially rebuilt delta.
+func (l *localFile) discard() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.done {
+		return
+	}
+
+	l.base.Close()
+	l.f.Close()
+	if l.writePath != l.name {
+		l.root.Remove(l.writePath)
+	}
 }
 
 // Upload uploads the file or folder at the given path and returns the remote address of the folder and its size.
+// If the connection drops, the upload is resumed from the last offsets the server acknowledged.
 func (s *StorageClient) Upload(ctx context.Context, localPath string) (string, int64, error) {
-	cancelCtx, cancel := context.WithCancel(ctx)
-	defer cancel()
+	return s.UploadTo(ctx, localPath, UploadOptions{})
+}
 
-	uploadClient, err := s.c.Upload(cancelCtx)
+// UploadOptions places an upload at a path chosen by the caller.
+type UploadOptions struct {
+	// Destination is the remote folder that receives the contents of an uploaded folder, or an uploaded file.
+	// Empty uploads into a new folder named by the server, where files keep their full local path.
+	Destination string
+	// Overwrite decides what happens when Destination already exists.
+	Overwrite filesystem.OverwritePolicy
+	// TTL is how long the server keeps the upload before deleting it, rounded up to whole seconds.
+	// Zero leaves it to the server's default. The server may cap it.
+	TTL time.Duration
+}
+
+// request returns the BeginUpload request that opens a session with the options.
+func (o UploadOptions) request() *filesystem.BeginUploadRequest {
+	return &filesystem.BeginUploadRequest{
+		Destination: o.Destination,
+		Overwrite:   o.Overwrite,
+		TtlSeconds:  int64((o.TTL + time.Second - 1) / time.Second),
+	}
+}
+
+// UploadTo is like Upload but writes into the destination given by opts.
+func (s *StorageClient) UploadTo(ctx context.Context, localPath string, opts UploadOptions) (string, int64, error) {
+	session, err := s.c.BeginUpload(ctx, opts.request())
+	if err != nil {
+		return "", 0, err
+	}
+
+	stream := files.StreamFrom
+	if opts.Destination != "" {
+		stream = files.StreamContents
+	}
+	res, err := s.runSession(ctx, session, func(ctx context.Context, opts files.Options, fileChan chan<- *files.FileProgress) error {
+		return stream(ctx, localPath, opts, fileChan)
+	})
+	if err != nil {
+		return "", 0, err
+	}
+
+	return res.GetId(), res.GetSize(), nil
+}
+
+// streamFunc sends the chunks of an upload with opts, which skip the bytes already received and pick the compression the server accepts.
+type streamFunc func(ctx context.Context, opts files.Options, fileChan chan<- *files.FileProgress) error
+
+// runSession streams into an upload session, resuming it after retryable failures, and commits it.
+func (s *StorageClient) runSession(ctx context.Context, session *filesystem.UploadSession, stream streamFunc) (*filesystem.UploadFilesystemResponse, error) {
+	for attempt := 1; ; attempt++ {
+		err := s.uploadToSession(ctx, session, stream)
+		if err == nil {
+			break
+		}
+		if attempt >= maxUploadAttempts || !isRetryable(ctx, err) {
+			return nil, err
+		}
+
+		select {
+		case <-time.After(time.Duration(attempt) * time.Second):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		resumed, resumeErr := s.c.ResumeUpload(ctx, &filesystem.ResumeUploadRequest{Id: session.GetId()})
+		if resumeErr == nil {
+			session = resumed
+		} else if !isRetryable(ctx, resumeErr) {
+			return nil, fmt.Errorf("could not resume upload %s: %v", session.GetId(), resumeErr)
+		}
+	}
+
+	res, err := s.c.CommitUpload(ctx, &filesystem.CommitUploadRequest{Id: session.GetId()})
+	if err != nil {
+		return nil, fmt.Errorf("could not commit upload %s: %v", session.GetId(), err)
+	}
+
+	return res, nil
+}
+
+// UploadReader uploads everything read from r as a single file called name, a slash separated path inside the new upload
+// or the destination given by opts. It returns the remote address of the upload and the file's size.
+// A reader can't be read again, so failed uploads aren't resumed.
+func (s *StorageClient) UploadReader(ctx context.Context, r io.Reader, name string, opts UploadOptions) (string, int64, error) {
+	if clean := path.Clean(name); !fs.ValidPath(clean) || clean == "." {
+		return "", 0, fmt.Errorf("invalid remote name: %s", name)
+	}
+
+	session, err := s.c.BeginUpload(ctx, opts.request())
+	if err != nil {
+		return "", 0, err
+	}
+
+	err = s.uploadShard(ctx, session, s.sessionOptions(session), func(ctx context.Context, opts files.Options, fileChan chan<- *files.FileProgress) error {
+		return files.StreamReader(ctx, r, name, opts, fileChan)
+	})
 	if err != nil {
 		return "", 0, err
 	}
 
+	res, err := s.c.CommitUpload(ctx, &filesystem.CommitUploadRequest{Id: session.GetId()})
+	if err != nil {
+		return "", 0, fmt.Errorf("could not commit upload %s: %v", session.GetId(), err)
+	}
+
+	return res.GetId(), res.GetSize(), nil
+}
+
+// sessionOptions returns the options that skip what the session already received and compress with a codec it accepts.
+func (s *StorageClient) sessionOptions(session *filesystem.UploadSession) files.Options {
+	opts := files.Options{Offsets: map[string]int64{}, NoOwner: s.noOwner, CompressionLevel: s.compressionLevel}
+	for _, f := range session.GetFiles() {
+		if f.GetKept() {
+			// Offsets past the end of a file leave it out entirely
+			opts.Offsets[path.Join(f.GetPath(), f.GetName())] = math.MaxInt64
+		} else {
+			opts.Offsets[path.Join(f.GetPath(), f.GetName())] = f.GetOffset()
+		}
+	}
+	if slices.Contains(session.GetCompressions(), s.compression) && codec.IsSupported(s.compression) {
+		opts.Compression = s.compression
+	}
+	return opts
+}
+
+// uploadToSession streams everything the session hasn't received yet, split across the client's streams.
+func (s *StorageClient) uploadToSession(ctx context.Context, session *filesystem.UploadSession, stream streamFunc) error {
+	opts := s.sessionOptions(session)
+
+	streams := s.streams()
+	return parallel(ctx, streams, func(ctx context.Context, shard int) error {
+		opts := opts
+		opts.Shard, opts.Shards = shard, streams
+		return s.uploadShard(ctx, session, opts, stream)
+	})
+}
+
+// uploadShard streams the part of an upload selected by opts over one Upload stream.
+func (s *StorageClient) uploadShard(ctx context.Context, session *filesystem.UploadSession, opts files.Options, stream streamFunc) error {
+	cancelCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Reading stops separately from the stream so a failed Send doesn't hide the stream's status.
+	readCtx, stopReading := context.WithCancel(cancelCtx)
+	defer stopReading()
+
 	fileChan := make(chan *files.FileProgress)
 	var streamErr error
 
 	go func() {
-		streamErr = files.Stream(localPath, fileChan)
+		streamErr = stream(readCtx, opts, fileChan)
 		close(fileChan)
 	}()
 
+	// The stream is only opened once there is something to send, as an empty stream would start a one-shot upload.
+	var uploadClient filesystem.StorageService_UploadClient
+	var sendErr error
 	for p := range fileChan {
-		uploadClient.Send(p.File)
+		if sendErr != nil {
+			continue
+		}
+		if uploadClient == nil {
+			if uploadClient, sendErr = s.c.Upload(cancelCtx); sendErr != nil {
+				stopReading()
+				continue
+			}
+		}
+		p.File.SessionId = session.GetId()
+		if sendErr = uploadClient.Send(p.File); sendErr != nil {
+			stopReading()
+		}
 	}
 
-	if streamErr != nil {
-		return "", 0, streamErr
+	if streamErr != nil && sendErr == nil {
+		return streamErr
+	}
+	if uploadClient == nil {
+		return sendErr
 	}
 
-	res, err := uploadClient.CloseAndRecv()
-	if err != nil {
-		return "", 0, fmt.Errorf("could not receive upload response: %v", err)
+	// A failed Send only reports io.EOF; the stream's status comes from CloseAndRecv.
+	if _, err := uploadClient.CloseAndRecv(); err != nil {
+		return fmt.Errorf("could not receive upload response: %w", err)
 	}
 
-	return res.GetId(), res.GetSize(), nil
+	return sendErr
+}
+
+// streams returns the number of concurrent streams a transfer is split across.
+func (s *StorageClient) streams() int {
+	return max(s.parallel, 1)
+}
+
+// parallel runs fn for each of n shards at once and returns the first error, which cancels the others.
+func parallel(ctx context.Context, n int, fn func(ctx context.Context, shard int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+
+	for shard := range n {
+		wg.Go(func() {
+			if err := fn(ctx, shard); err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		})
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// isRetryable reports whether a failed transfer is worth resuming.
+func isRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Aborted, codes.DeadlineExceeded:
+		return true
+	default:
+		return false
+	}
 }
 
 type File struct {
-	name string
+	name   string
+	size   int64
+	mtime  time.Time
+	mode   fs.FileMode
+	target string
+	sha256 []byte
 }
 
 func (f *File) GetName() string {
@@ -117,6 +792,29 @@ func (f *File) GetChildren() []FSEntry {
 	return nil
 }
 
+func (f *File) GetSize() int64 {
+	return f.size
+}
+
+func (f *File) GetModTime() time.Time {
+	return f.mtime
+}
+
+// GetMode returns the permissions of the file, with fs.ModeSymlink set for symlinks.
+func (f *File) GetMode() fs.FileMode {
+	return f.mode
+}
+
+// GetLinkTarget returns what a symlink points at, or an empty string for regular files.
+func (f *File) GetLinkTarget() string {
+	return f.target
+}
+
+// GetSha256 returns the digest of the file's content, if checksums were requested.
+func (f *File) GetSha256() []byte {
+	return f.sha256
+}
+
 func (f *File) cmp(e FSEntry) bool {
 	if _, ok := e.(*Folder); ok {
 		return false
@@ -127,6 +825,8 @@ func (f *File) cmp(e FSEntry) bool {
 type Folder struct {
 	name     string
 	children []FSEntry
+	mtime    time.Time
+	mode     fs.FileMode
 }
 
 func (f *Folder) GetName() string {
@@ -137,6 +837,21 @@ func (f *Folder) GetChildren() []FSEntry {
 	return f.children
 }
 
+// GetSize returns the total size of the files listed under the folder, which only covers
+// its whole content in a recursive listing.
+func (f *Folder) GetSize() int64 {
+	return DiskUsage(f.children)
+}
+
+func (f *Folder) GetModTime() time.Time {
+	return f.mtime
+}
+
+// GetMode returns the permissions of the folder, with fs.ModeDir set.
+func (f *Folder) GetMode() fs.FileMode {
+	return f.mode
+}
+
 func (f *Folder) cmp(e FSEntry) bool {
 	if _, ok := e.(*File); ok {
 		return true
@@ -147,6 +862,9 @@ func (f *Folder) cmp(e FSEntry) bool {
 type FSEntry interface {
 	GetName() string
 	GetChildren() []FSEntry
+	GetSize() int64
+	GetModTime() time.Time
+	GetMode() fs.FileMode
 	cmp(FSEntry) bool
 }
 
@@ -159,24 +877,232 @@ func SortEntries(entries []FSEntry) {
 	})
 }
 
+// DiskUsage returns the total size of the regular files among the entries and under the folders among them.
+func DiskUsage(entries []FSEntry) int64 {
+	var size int64
+	for _, entry := range entries {
+		if entry.GetMode()&fs.ModeSymlink == 0 {
+			size += entry.GetSize()
+		}
+	}
+	return size
+}
+
 func mapEntries(manifestEntries []*filesystem.FSEntry) []FSEntry {
 	var entries []FSEntry
 	for _, entry := range manifestEntries {
-		switch e := entry.Value.(type) {
-		case *filesystem.FSEntry_File:
-			entries = append(entries, &File{name: e.File.GetName()})
-		case *filesystem.FSEntry_Directory:
-			entries = append(entries, &Folder{name: e.Directory.GetName(), children: mapEntries(e.Directory.GetEntries())})
+		if e := mapEntry(entry); e != nil {
+			entries = append(entries, e)
 		}
 	}
 	return entries
 }
 
-func (s *StorageClient) GetManifest(ctx context.Context, remotePath string, recursive bool) ([]FSEntry, error) {
-	// Implementation for retrieving the manifest
-	manifest, err := s.c.GetManifest(ctx, &filesystem.ManifestRequest{Path: remotePath, Recursive: recursive})
+func mapEntry(entry *filesystem.FSEntry) FSEntry {
+	switch e := entry.GetValue().(type) {
+	case *filesystem.FSEntry_File:
+		f := e.File
+		mode := fs.FileMode(f.GetMode()).Perm()
+		if f.GetType() == filesystem.EntryType_SYMLINK {
+			mode |= fs.ModeSymlink
+		}
+		return &File{
+			name:   f.GetName(),
+			size:   f.GetSize(),
+			mtime:  time.Unix(0, f.GetMtime()),
+			mode:   mode,
+			target: f.GetLinkTarget(),
+			sha256: f.GetSha256(),
+		}
+	case *filesystem.FSEntry_Directory:
+		d := e.Directory
+		return &Folder{
+			name:     d.GetName(),
+			children: mapEntries(d.GetEntries()),
+			mtime:    time.Unix(0, d.GetMtime()),
+			mode:     fs.ModeDir | fs.FileMode(d.GetMode()).Perm(),
+		}
+	}
+	return nil
+}
+
+// GetManifest lists the remote folder, and with recursive set everything under it.
+// With checksums set, files also carry the SHA-256 of their content.
+func (s *StorageClient) GetManifest(ctx context.Context, remotePath string, recursive bool, checksums bool) ([]FSEntry, error) {
+	root := &Folder{}
+	folders := map[string]*Folder{".": root}
+
+	err := s.WalkManifest(ctx, remotePath, recursive, checksums, func(relPath string, entry FSEntry) error {
+		parent, ok := folders[path.Dir(relPath)]
+		if !ok {
+			return fmt.Errorf("%s was listed before its folder", relPath)
+		}
+		parent.children = append(parent.children, entry)
+
+		if folder, ok := entry.(*Folder); ok {
+			folders[relPath] = folder
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("could not retrieve manifest: %v", err)
 	}
-	return mapEntries(manifest.GetEntries()), nil
+	return root.children, nil
+}
+
+// WalkManifest streams the entries of the remote folder, and with recursive set everything under it, to fn along with their slash separated path relative to the folder.
+// Entries arrive depth-first in name order with each folder, passed without children, before its contents.
+// A listing that breaks off is resumed after the last entry received.
+func (s *StorageClient) WalkManifest(ctx context.Context, remotePath string, recursive bool, checksums bool, fn func(relPath string, entry FSEntry) error) error {
+	req := &filesystem.ListEntriesRequest{Path: remotePath, Recursive: recursive, Checksums: checksums}
+
+	for attempt := 1; ; attempt++ {
+		err := s.listEntries(ctx, req, fn)
+		if err == nil {
+			return nil
+		}
+		if attempt >= maxListAttempts || !isRetryable(ctx, err) {
+			return err
+		}
+
+		select {
+		case <-time.After(time.Duration(attempt) * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// listEntries streams one ListEntries call to fn, moving the request's StartAfter past every entry handled.
+func (s *StorageClient) listEntries(ctx context.Context, req *filesystem.ListEntriesRequest, fn func(relPath string, entry FSEntry) error) error {
+	stream, err := s.c.ListEntries(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		for _, entry := range res.GetEntries() {
+			if e := mapEntry(entry.GetEntry()); e != nil {
+				if err := fn(entry.GetPath(), e); err != nil {
+					return err
+				}
+			}
+			req.StartAfter = entry.GetPath()
+		}
+	}
+}
+
+// Stat describes a remote path as a File, or as a Folder without children.
+// With checksum set, a regular file also carries the SHA-256 of its content.
+func (s *StorageClient) Stat(ctx context.Context, remotePath string, checksum bool) (FSEntry, error) {
+	res, err := s.c.Stat(ctx, &filesystem.StatRequest{Path: remotePath, Checksum: checksum})
+	if err != nil {
+		return nil, err
+	}
+
+	name := path.Base(remotePath)
+	mtime := time.Unix(0, res.GetMtime())
+	mode := fs.FileMode(res.GetMode()).Perm()
+	switch res.GetType() {
+	case filesystem.EntryType_DIRECTORY:
+		return &Folder{name: name, mtime: mtime, mode: fs.ModeDir | mode}, nil
+	case filesystem.EntryType_SYMLINK:
+		mode |= fs.ModeSymlink
+	}
+
+	return &File{
+		name:   name,
+		size:   res.GetSize(),
+		mtime:  mtime,
+		mode:   mode,
+		target: res.GetLinkTarget(),
+		sha256: res.GetSha256(),
+	}, nil
+}
+
+// Delete removes a remote file, symlink or empty directory, or with recursive set a directory and everything under it.
+func (s *StorageClient) Delete(ctx context.Context, remotePath string, recursive bool) error {
+	_, err := s.c.Delete(ctx, &filesystem.DeleteRequest{Path: remotePath, Recursive: recursive})
+	return err
+}
+
+// Move renames a remote path to one that doesn't exist yet.
+func (s *StorageClient) Move(ctx context.Context, source string, destination string) error {
+	_, err := s.c.Move(ctx, &filesystem.MoveRequest{Source: source, Destination: destination})
+	return err
+}
+
+// Copy copies a remote path to one that doesn't exist yet without transferring it, and returns the size of the files copied.
+func (s *StorageClient) Copy(ctx context.Context, source string, destination string) (int64, error) {
+	res, err := s.c.Copy(ctx, &filesystem.CopyRequest{Source: source, Destination: destination})
+	if err != nil {
+		return 0, err
+	}
+	return res.GetSize(), nil
+}
+
+// Usage is how many bytes a principal and the whole server store, and the quotas that limit them. Quotas are zero when unset.
+type Usage struct {
+	// Principal is who the server took the caller for. It's empty for anonymous clients.
+	Principal string
+	// Used counts the uploads the principal owns, along with what it's still uploading.
+	Used  int64
+	Quota int64
+	// TotalUsed counts everything on the server, along with everything still being uploaded.
+	TotalUsed  int64
+	TotalQuota int64
+	// UploadQuota is the largest single upload the server accepts.
+	UploadQuota int64
+}
+
+// ShareOptions configures a share link.
+type ShareOptions struct {
+	// TTL is how long the link works for. It's rounded up to whole seconds.
+	TTL time.Duration
+	// MaxDownloads limits how often the link can be downloaded. Zero allows any number of downloads.
+	MaxDownloads int64
+}
+
+// ShareLink lets anyone holding its token download a remote path without credentials of their own, until it expires.
+type ShareLink struct {
+	Token   string
+	Expires time.Time
+}
+
+// CreateShareLink creates a share link for the remote path, which recipients download with WithShareToken.
+func (s *StorageClient) CreateShareLink(ctx context.Context, remotePath string, opts ShareOptions) (*ShareLink, error) {
+	res, err := s.c.CreateShareLink(ctx, &filesystem.ShareLinkRequest{
+		Path:         remotePath,
+		TtlSeconds:   int64((opts.TTL + time.Second - 1) / time.Second),
+		MaxDownloads: opts.MaxDownloads,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ShareLink{Token: res.GetToken(), Expires: time.Unix(res.GetExpires(), 0)}, nil
+}
+
+// GetUsage reports how much the caller and the whole server store, and the quotas that apply.
+func (s *StorageClient) GetUsage(ctx context.Context) (Usage, error) {
+	res, err := s.c.GetUsage(ctx, &filesystem.UsageRequest{})
+	if err != nil {
+		return Usage{}, err
+	}
+
+	return Usage{
+		Principal:   res.GetPrincipal(),
+		Used:        res.GetUsed(),
+		Quota:       res.GetQuota(),
+		TotalUsed:   res.GetTotalUsed(),
+		TotalQuota:  res.GetTotalQuota(),
+		UploadQuota: res.GetUploadQuota(),
+	}, nil
 }
@@ -0,0 +1,498 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RGood/fs-xfer/pkg/backend"
+	filesystem "github.com/RGood/fs-xfer/pkg/generated/filesystem"
+	"github.com/RGood/fs-xfer/pkg/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// newTestClient serves s on a loopback port until the test ends and returns a client connected to it.
+func newTestClient(t *testing.T, s filesystem.StorageServiceServer, opts ...Option) *StorageClient {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := grpc.NewServer()
+	filesystem.RegisterStorageServiceServer(g, s)
+	go g.Serve(lis)
+	t.Cleanup(g.Stop)
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return NewStorageClient(conn, opts...)
+}
+
+// writeLocalFile writes data to the file called name under dir, creating its parent directories.
+func writeLocalFile(t *testing.T, dir string, name string, data []byte) string {
+	t.Helper()
+
+	target := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(target, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+// testServices returns a new service for each backend a test should pass on.
+func testServices() map[string]func(t *testing.T) *server.StorageService {
+	return map[string]func(t *testing.T) *server.StorageService{
+		"local":  func(t *testing.T) *server.StorageService { return server.NewLocalStorageService(t.TempDir()) },
+		"memory": func(t *testing.T) *server.StorageService { return server.NewStorageService(backend.NewMemory()) },
+		"dedup": func(t *testing.T) *server.StorageService {
+			store, err := server.NewChunkStore(backend.NewMemory())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return server.NewStorageService(backend.NewMemory(), server.WithChunkStore(store))
+		},
+	}
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	files := map[string]struct {
+		size int
+		mode os.FileMode
+	}{
+		"run.sh":      {10, 0755},
+		"secret":      {600 << 10, 0600},
+		"dir/empty":   {0, 0640},
+		"dir/sub/doc": {1, 0444},
+	}
+
+	for name, newService := range testServices() {
+		t.Run(name, func(t *testing.T) {
+			s := newService(t)
+			t.Cleanup(s.Close)
+			c := newTestClient(t, s)
+
+			src := t.TempDir()
+			for name, f := range files {
+				target := writeLocalFile(t, src, name, make([]byte, f.size))
+				if err := os.Chmod(target, f.mode); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(target, mtime, mtime); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			id, _, err := c.Upload(context.Background(), src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := t.TempDir()
+			if _, err := c.Download(context.Background(), filepath.Join(id, src), out); err != nil {
+				t.Fatal(err)
+			}
+
+			for name, f := range files {
+				info, err := os.Stat(filepath.Join(out, filepath.FromSlash(name)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Mode().Perm() != f.mode || !info.ModTime().Equal(mtime) {
+					t.Fatalf("%s came back with mode %v and mtime %v, want %v and %v", name, info.Mode().Perm(), info.ModTime(), f.mode, mtime)
+				}
+			}
+		})
+	}
+}
+
+func TestLinkRoundTrip(t *testing.T) {
+	for name, newService := range testServices() {
+		t.Run(name, func(t *testing.T) {
+			s := newService(t)
+			t.Cleanup(s.Close)
+			c := newTestClient(t, s)
+
+			src := t.TempDir()
+			writeLocalFile(t, src, "data", []byte("data"))
+			if err := os.MkdirAll(filepath.Join(src, "dir", "empty"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Link(filepath.Join(src, "data"), filepath.Join(src, "dir", "hard")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink("../data", filepath.Join(src, "dir", "link")); err != nil {
+				t.Fatal(err)
+			}
+
+			id, _, err := c.Upload(context.Background(), src)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Nothing is written through a symlink already in the destination
+			out, outside := t.TempDir(), t.TempDir()
+			if err := os.Symlink(outside, filepath.Join(out, "dir")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.Download(context.Background(), filepath.Join(id, src), out); err == nil {
+				t.Fatal("downloaded through a symlink")
+			}
+			if entries, err := os.ReadDir(outside); err != nil || len(entries) != 0 {
+				t.Fatalf("download wrote %v through a symlink, with error %v", entries, err)
+			}
+
+			out = t.TempDir()
+			if _, err := c.Download(context.Background(), filepath.Join(id, src), out); err != nil {
+				t.Fatal(err)
+			}
+			if target, err := os.Readlink(filepath.Join(out, "dir", "link")); err != nil || target != "../data" {
+				t.Fatalf("symlink points at %q with error %v", target, err)
+			}
+			data, err := os.Stat(filepath.Join(out, "data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hard, err := os.Stat(filepath.Join(out, "dir", "hard")); err != nil || !os.SameFile(data, hard) {
+				t.Fatalf("hardlink has info %v and error %v, want the same file as data", hard, err)
+			}
+			if info, err := os.Stat(filepath.Join(out, "dir", "empty")); err != nil || !info.IsDir() {
+				t.Fatalf("empty directory has info %v and error %v", info, err)
+			}
+		})
+	}
+}
+
+func TestUploadEscapingSymlink(t *testing.T) {
+	for name, newService := range testServices() {
+		t.Run(name, func(t *testing.T) {
+			s := newService(t)
+			t.Cleanup(s.Close)
+			c := newTestClient(t, s)
+
+			src := t.TempDir()
+			writeLocalFile(t, src, "data", []byte("data"))
+			if err := os.Symlink(strings.Repeat("../", 64)+"outside", filepath.Join(src, "escape")); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, _, err := c.Upload(context.Background(), src); err == nil {
+				t.Fatal("uploaded a symlink leading out of the upload")
+			}
+		})
+	}
+}
+
+func TestCompressedRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("compressible "), 100000)
+	for _, compression := range []filesystem.Compression{filesystem.Compression_ZSTD, filesystem.Compression_GZIP} {
+		for name, newService := range testServices() {
+			t.Run(compression.String()+"/"+name, func(t *testing.T) {
+				s := newService(t)
+				t.Cleanup(s.Close)
+				c := newTestClient(t, s, WithCompression(compression, 0))
+
+				src := t.TempDir()
+				writeLocalFile(t, src, "dir/file", data)
+
+				id, _, err := c.Upload(context.Background(), src)
+				if err != nil {
+					t.Fatal(err)
+				}
+				out := t.TempDir()
+				if _, err := c.Download(context.Background(), filepath.Join(id, src), out); err != nil {
+					t.Fatal(err)
+				}
+				if got, err := os.ReadFile(filepath.Join(out, "dir", "file")); err != nil || !bytes.Equal(got, data) {
+					t.Fatalf("downloaded %d bytes and error %v, want %d bytes", len(got), err, len(data))
+				}
+			})
+		}
+	}
+}
+
+func TestParallelRoundTrip(t *testing.T) {
+	// big is large enough to be split into ranges sent on different streams
+	contents := map[string][]byte{"big": make([]byte, 33<<20)}
+	rand.NewChaCha8([32]byte{1}).Read(contents["big"])
+	for i := range 20 {
+		contents[fmt.Sprintf("dir%d/file", i%3)+strconv.Itoa(i)] = []byte(strconv.Itoa(i))
+	}
+
+	for name, newService := range testServices() {
+		t.Run(name, func(t *testing.T) {
+			s := newService(t)
+			t.Cleanup(s.Close)
+			c := newTestClient(t, s, WithParallel(4))
+
+			src := t.TempDir()
+			for name, data := range contents {
+				writeLocalFile(t, src, name, data)
+			}
+
+			id, _, err := c.Upload(context.Background(), src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := t.TempDir()
+			if _, err := c.Download(context.Background(), filepath.Join(id, src), out); err != nil {
+				t.Fatal(err)
+			}
+			for name, data := range contents {
+				if got, err := os.ReadFile(filepath.Join(out, filepath.FromSlash(name))); err != nil || !bytes.Equal(got, data) {
+					t.Fatalf("%s downloaded as %d bytes and error %v, want %d bytes", name, len(got), err, len(data))
+				}
+			}
+		})
+	}
+}
+
+func TestManifestEntries(t *testing.T) {
+	mtime := time.Date(2021, 5, 6, 7, 8, 9, 0, time.UTC)
+	for name, newService := range testServices() {
+		t.Run(name, func(t *testing.T) {
+			s := newService(t)
+			t.Cleanup(s.Close)
+			c := newTestClient(t, s)
+
+			src := t.TempDir()
+			for name, data := range map[string]string{"a": "hello", "dir/b": "hello world"} {
+				target := writeLocalFile(t, src, name, []byte(data))
+				if err := os.Chmod(target, 0640); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(target, mtime, mtime); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.Symlink("dir/b", filepath.Join(src, "link")); err != nil {
+				t.Fatal(err)
+			}
+
+			id, _, err := c.Upload(context.Background(), src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := c.GetManifest(context.Background(), filepath.Join(id, src), true, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			SortEntries(entries)
+			if len(entries) != 3 {
+				t.Fatalf("listed %d entries, want 3", len(entries))
+			}
+
+			dir, ok := entries[0].(*Folder)
+			if !ok || dir.GetName() != "dir/" || dir.GetMode()&fs.ModeDir == 0 || dir.GetSize() != 11 {
+				t.Fatalf("first entry is %#v holding %d bytes, want dir/ holding 11", entries[0], entries[0].GetSize())
+			}
+			for _, entry := range []FSEntry{entries[1], dir.GetChildren()[0]} {
+				f := entry.(*File)
+				want := map[string]string{"a": "hello", "b": "hello world"}[f.GetName()]
+				sum := sha256.Sum256([]byte(want))
+				if f.GetSize() != int64(len(want)) || f.GetMode() != 0640 || !f.GetModTime().Equal(mtime) || !bytes.Equal(f.GetSha256(), sum[:]) {
+					t.Fatalf("%s has size %d, mode %v, mtime %v and digest %x", f.GetName(), f.GetSize(), f.GetMode(), f.GetModTime(), f.GetSha256())
+				}
+			}
+			link := entries[2].(*File)
+			if link.GetName() != "link" || link.GetMode()&fs.ModeSymlink == 0 || link.GetLinkTarget() != "dir/b" || link.GetSha256() != nil {
+				t.Fatalf("link has mode %v, target %q and digest %x", link.GetMode(), link.GetLinkTarget(), link.GetSha256())
+			}
+			if usage := DiskUsage(entries); usage != 16 {
+				t.Fatalf("entries use %d bytes, want 16", usage)
+			}
+		})
+	}
+}
+
+func TestStat(t *testing.T) {
+	for name, newService := range testServices() {
+		t.Run(name, func(t *testing.T) {
+			s := newService(t)
+			t.Cleanup(s.Close)
+			c := newTestClient(t, s)
+			ctx := context.Background()
+
+			src := t.TempDir()
+			if err := os.Chmod(writeLocalFile(t, src, "dir/file", []byte("hello")), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink("dir/file", filepath.Join(src, "link")); err != nil {
+				t.Fatal(err)
+			}
+			id, _, err := c.Upload(ctx, src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			remote := path.Join(id, filepath.ToSlash(src))
+
+			sum := sha256.Sum256([]byte("hello"))
+			file, err := c.Stat(ctx, remote+"/dir/file", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f := file.(*File); f.GetName() != "file" || f.GetSize() != 5 || f.GetMode() != 0600 || !bytes.Equal(f.GetSha256(), sum[:]) {
+				t.Fatalf("file has name %q, size %d, mode %v and digest %x", f.GetName(), f.GetSize(), f.GetMode(), f.GetSha256())
+			}
+			if file, err := c.Stat(ctx, remote+"/dir/file", false); err != nil || file.(*File).GetSha256() != nil {
+				t.Fatalf("stat without checksum returned %v and error %v", file, err)
+			}
+
+			if dir, err := c.Stat(ctx, remote+"/dir", false); err != nil || !dir.GetMode().IsDir() {
+				t.Fatalf("directory has info %v and error %v", dir, err)
+			}
+			link, err := c.Stat(ctx, remote+"/link", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if l := link.(*File); l.GetMode()&fs.ModeSymlink == 0 || l.GetLinkTarget() != "dir/file" || l.GetSha256() != nil {
+				t.Fatalf("symlink has mode %v, target %q and digest %x", l.GetMode(), l.GetLinkTarget(), l.GetSha256())
+			}
+
+			if _, err := c.Stat(ctx, remote+"/missing", false); status.Code(err) != codes.NotFound {
+				t.Fatalf("stat of a missing path returned %v, want NOT_FOUND", err)
+			}
+		})
+	}
+}
+
+func TestUploadReader(t *testing.T) {
+	large := make([]byte, 600<<10)
+	rand.NewChaCha8([32]byte{3}).Read(large)
+	contents := map[string][]byte{
+		"empty":         {},
+		"one":           []byte("x"),
+		"chunk":         large[:256<<10],
+		"dir/sub/large": large,
+	}
+
+	for name, newService := range testServices() {
+		t.Run(name, func(t *testing.T) {
+			s := newService(t)
+			t.Cleanup(s.Close)
+			c := newTestClient(t, s)
+			ctx := context.Background()
+
+			for remoteName, data := range contents {
+				id, size, err := c.UploadReader(ctx, bytes.NewReader(data), remoteName, UploadOptions{})
+				if err != nil {
+					t.Fatalf("%s: %v", remoteName, err)
+				}
+				if size != int64(len(data)) {
+					t.Fatalf("%s: uploaded %d bytes, want %d", remoteName, size, len(data))
+				}
+
+				f, err := c.OpenFile(ctx, path.Join(id, remoteName), 0, 0)
+				if err != nil {
+					t.Fatalf("%s: %v", remoteName, err)
+				}
+				got, err := io.ReadAll(f)
+				f.Close()
+				if err != nil || !bytes.Equal(got, data) {
+					t.Fatalf("%s: read back %d bytes and error %v, want %d bytes", remoteName, len(got), err, len(data))
+				}
+				if info, err := c.Stat(ctx, path.Join(id, remoteName), false); err != nil || info.GetMode() != 0644 {
+					t.Fatalf("%s: has info %v and error %v, want mode 0644", remoteName, info, err)
+				}
+			}
+
+			for _, remoteName := range []string{"", ".", "../escape", "/abs"} {
+				if _, _, err := c.UploadReader(ctx, bytes.NewReader(nil), remoteName, UploadOptions{}); err == nil {
+					t.Fatalf("uploaded a reader as %q", remoteName)
+				}
+			}
+		})
+	}
+}
+
+// readRemote returns the content of the remote file, or nil if it can't be read.
+func readRemote(t *testing.T, c *StorageClient, remotePath string) []byte {
+	t.Helper()
+
+	f, err := c.OpenFile(context.Background(), remotePath, 0, 0)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestOverwritePolicies(t *testing.T) {
+	tests := []struct {
+		policy filesystem.OverwritePolicy
+		code   codes.Code
+		// want maps the files in the destination to their content afterwards, or nil where they must be gone
+		want map[string]string
+	}{
+		{filesystem.OverwritePolicy_FAIL, codes.AlreadyExists, map[string]string{"keep": "old", "shared": "old", "new": ""}},
+		{filesystem.OverwritePolicy_REPLACE, codes.OK, map[string]string{"keep": "", "shared": "new", "new": "new"}},
+		{filesystem.OverwritePolicy_SKIP_EXISTING, codes.OK, map[string]string{"keep": "old", "shared": "old", "new": "new"}},
+		{filesystem.OverwritePolicy_MERGE, codes.OK, map[string]string{"keep": "old", "shared": "new", "new": "new"}},
+	}
+
+	for name, newService := range testServices() {
+		for _, test := range tests {
+			t.Run(name+"/"+test.policy.String(), func(t *testing.T) {
+				s := newService(t)
+				t.Cleanup(s.Close)
+				c := newTestClient(t, s)
+				ctx := context.Background()
+
+				old, src := t.TempDir(), t.TempDir()
+				writeLocalFile(t, old, "keep", []byte("old"))
+				writeLocalFile(t, old, "dir/shared", []byte("old"))
+				writeLocalFile(t, src, "dir/shared", []byte("new"))
+				writeLocalFile(t, src, "dir/new", []byte("new"))
+
+				// A destination that doesn't exist yet is created whatever the policy
+				if _, _, err := c.UploadTo(ctx, old, UploadOptions{Destination: "dest", Overwrite: filesystem.OverwritePolicy_FAIL}); err != nil {
+					t.Fatal(err)
+				}
+
+				_, _, err := c.UploadTo(ctx, src, UploadOptions{Destination: "dest", Overwrite: test.policy})
+				if status.Code(err) != test.code {
+					t.Fatalf("got error %v, want %s", err, test.code)
+				}
+				for file, want := range test.want {
+					remote := "dest/dir/" + file
+					if file == "keep" {
+						remote = "dest/keep"
+					}
+					if got := readRemote(t, c, remote); string(got) != want {
+						t.Fatalf("%s holds %q, want %q", remote, got, want)
+					}
+				}
+
+				if _, _, err := c.UploadReader(ctx, bytes.NewReader([]byte("x")), "file", UploadOptions{Destination: "dest/keep", Overwrite: test.policy}); err == nil && test.policy != filesystem.OverwritePolicy_REPLACE {
+					t.Fatal("uploaded into a destination that is a file")
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package client
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// WithCredentials attaches creds, such as a bearer token from TokenCredentials, to every call the client makes.
+func WithCredentials(creds credentials.PerRPCCredentials) Option {
+	return func(s *StorageClient) {
+		s.creds = creds
+	}
+}
+
+// TokenCredentials sends token as a bearer token in the authorization metadata of each call.
+// Like other credentials that grant access, it's only sent over connections secured with TLS.
+func TokenCredentials(token string) credentials.PerRPCCredentials {
+	return bearerToken(token)
+}
+
+type bearerToken string
+
+func (t bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (t bearerToken) RequireTransportSecurity() bool {
+	return true
+}
+
+// credentialsConn adds per-RPC credentials to every call made through a connection.
+type credentialsConn struct {
+	grpc.ClientConnInterface
+	creds grpc.CallOption
+}
+
+func (c *credentialsConn) Invoke(ctx context.Context, method string, args any, reply any, opts ...grpc.CallOption) error {
+	return c.ClientConnInterface.Invoke(ctx, method, args, reply, append(opts, c.creds)...)
+}
+
+func (c *credentialsConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return c.ClientConnInterface.NewStream(ctx, desc, method, append(opts, c.creds)...)
+}
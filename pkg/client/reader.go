@@ -0,0 +1,109 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/RGood/fs-xfer/pkg/files"
+	"github.com/RGood/fs-xfer/pkg/generated/filesystem"
+)
+
+// OpenFile streams length bytes of the remote regular file at remotePath starting at offset, or everything after offset with a length of zero.
+// Chunks are checked against their digests as they're read, and a whole file against its digest once it's read to the end.
+// Closing the reader stops the download.
+func (s *StorageClient) OpenFile(ctx context.Context, remotePath string, offset int64, length int64) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	req := &filesystem.DownloadRequest{
+		Path:             remotePath,
+		CompressionLevel: int32(s.compressionLevel),
+		Range:            &filesystem.ByteRange{Offset: offset, Length: length},
+		ShareToken:       s.shareToken,
+	}
+	if s.compression != filesystem.Compression_UNCOMPRESSED {
+		req.Compressions = []filesystem.Compression{s.compression}
+	}
+
+	stream, err := s.c.Download(ctx, req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	r := &fileReader{stream: stream, cancel: cancel, offset: offset}
+	if offset == 0 {
+		r.digest = sha256.New()
+	}
+
+	// The first chunk is read right away so errors such as a missing file surface here rather than on the first Read
+	if r.err = r.next(); r.err != nil && r.err != io.EOF {
+		cancel()
+		return nil, r.err
+	}
+	return r, nil
+}
+
+// fileReader reads the chunks of a ranged download in order.
+type fileReader struct {
+	stream filesystem.StorageService_DownloadClient
+	cancel context.CancelFunc
+	// offset is where in the file the next chunk should start.
+	offset int64
+	// digest hashes everything read so far when reading from the start of the file.
+	digest hash.Hash
+	// data is what's left of the current chunk.
+	data []byte
+	err  error
+}
+
+func (r *fileReader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// next receives the following chunk into data, or returns io.EOF once the stream ended.
+func (r *fileReader) next() error {
+	file, err := r.stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	if err := files.Decompress(file); err != nil {
+		return err
+	}
+	if err := files.VerifyChunk(file); err != nil {
+		return err
+	}
+	if file.GetType() != filesystem.EntryType_REGULAR || file.GetOffset() != r.offset {
+		return fmt.Errorf("unexpected chunk at offset %d of %s", file.GetOffset(), files.Key(file))
+	}
+
+	if r.digest != nil {
+		r.digest.Write(file.GetData())
+		if file.GetFileSha256() != nil {
+			if err := files.VerifyFile(file, r.digest.Sum(nil)); err != nil {
+				return err
+			}
+		}
+	}
+
+	r.offset += int64(len(file.GetData()))
+	r.data = file.GetData()
+	return nil
+}
+
+func (r *fileReader) Close() error {
+	r.cancel()
+	return nil
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestOpenFile(t *testing.T) {
+	// data spans several chunks, so ranges start and end inside them
+	data := make([]byte, 600<<10)
+	rand.NewChaCha8([32]byte{2}).Read(data)
+	size := int64(len(data))
+
+	for name, newService := range testServices() {
+		t.Run(name, func(t *testing.T) {
+			s := newService(t)
+			t.Cleanup(s.Close)
+			c := newTestClient(t, s)
+			ctx := context.Background()
+
+			src := t.TempDir()
+			writeLocalFile(t, src, "dir/file", data)
+			id, _, err := c.Upload(ctx, src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			remote := path.Join(id, filepath.ToSlash(src))
+
+			ranges := []struct {
+				name           string
+				offset, length int64
+				want           []byte
+			}{
+				{"whole file", 0, 0, data},
+				{"head", 0, 10, data[:10]},
+				{"across chunks", 250 << 10, 20 << 10, data[250<<10 : 270<<10]},
+				{"tail", size - 5, 0, data[size-5:]},
+				{"past the end", size - 5, 100, data[size-5:]},
+				{"empty tail", size, 0, nil},
+			}
+			for _, r := range ranges {
+				f, err := c.OpenFile(ctx, remote+"/dir/file", r.offset, r.length)
+				if err != nil {
+					t.Fatalf("%s: %v", r.name, err)
+				}
+				got, err := io.ReadAll(f)
+				f.Close()
+				if err != nil || !bytes.Equal(got, r.want) {
+					t.Fatalf("%s: read %d bytes and error %v, want %d bytes", r.name, len(got), err, len(r.want))
+				}
+			}
+
+			failures := []struct {
+				name           string
+				remote         string
+				offset, length int64
+				code           codes.Code
+			}{
+				{"missing file", remote + "/missing", 0, 0, codes.NotFound},
+				{"directory", remote + "/dir", 0, 0, codes.FailedPrecondition},
+				{"offset past the end", remote + "/dir/file", size + 1, 0, codes.OutOfRange},
+				{"negative length", remote + "/dir/file", 0, -1, codes.InvalidArgument},
+			}
+			for _, f := range failures {
+				if _, err := c.OpenFile(ctx, f.remote, f.offset, f.length); status.Code(err) != f.code {
+					t.Fatalf("%s: got error %v, want %s", f.name, err, f.code)
+				}
+			}
+
+			// Closing a reader part way through stops the download
+			f, err := c.OpenFile(ctx, remote+"/dir/file", 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(f, make([]byte, 10)); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/RGood/fs-xfer/pkg/delta"
+	"github.com/RGood/fs-xfer/pkg/files"
+	"github.com/RGood/fs-xfer/pkg/generated/filesystem"
+)
+
+type SyncOptions struct {
+	// Delete removes remote files that don't exist locally.
+	Delete bool
+	// Checksum compares file contents instead of trusting matching sizes and modification times.
+	Checksum bool
+	// Delta sends changed files that exist remotely as differences from the remote copy.
+	Delta bool
+}
+
+type SyncResult struct {
+	// Uploaded lists the paths of new or changed files, relative to the synced directories.
+	Uploaded []string
+	// Deleted lists the paths of remote files removed by the sync.
+	Deleted []string
+	// Size is the number of bytes uploaded.
+	Size int64
+}
+
+// Sync makes the remote directory match the local one, uploading only new or changed files.
+func (s *StorageClient) Sync(ctx context.Context, localPath string, remotePath string, opts SyncOptions) (*SyncResult, error) {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("sync source is not a directory: %s", localPath)
+	}
+
+	remote, err := s.getTree(ctx, remotePath, opts.Checksum)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve remote tree: %v", err)
+	}
+
+	local, err := files.Tree(localPath, opts.Checksum)
+	if err != nil {
+		return nil, err
+	}
+
+	changed, extra, existing := diffTrees(local, remote, opts.Checksum)
+
+	result := &SyncResult{}
+	if opts.Delete {
+		result.Deleted = extra
+	}
+	for _, entry := range changed {
+		result.Uploaded = append(result.Uploaded, entry.GetPath())
+	}
+
+	if len(result.Uploaded) == 0 && len(result.Deleted) == 0 {
+		return result, nil
+	}
+
+	var signatures map[string]*filesystem.FileSignature
+	if opts.Delta && len(existing) > 0 {
+		if signatures, err = s.getSignatures(ctx, remotePath, existing); err != nil {
+			return nil, fmt.Errorf("could not retrieve remote signatures: %v", err)
+		}
+	}
+
+	req := &filesystem.BeginSyncRequest{
+		Path:   remotePath,
+		Files:  changed,
+		Delete: result.Deleted,
+	}
+	for relPath := range signatures {
+		req.Delta = append(req.Delta, relPath)
+	}
+
+	session, err := s.beginSync(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.runSession(ctx, session, func(ctx context.Context, opts files.Options, fileChan chan<- *files.FileProgress) error {
+		opts.Signatures = signatures
+		return files.StreamFiles(ctx, localPath, result.Uploaded, opts, fileChan)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result.Size = res.GetSize()
+	return result, nil
+}
+
+// getTree returns every entry of the remote tree under remotePath, sorted by path.
+func (s *StorageClient) getTree(ctx context.Context, remotePath string, checksums bool) ([]*filesystem.TreeEntry, error) {
+	stream, err := s.c.GetTree(ctx, &filesystem.TreeRequest{Path: remotePath, Checksums: checksums})
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*filesystem.TreeEntry
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, res.GetEntries()...)
+	}
+}
+
+// maxSyncEntries bounds how many files, deletions and deltas each BeginSync message carries.
+const maxSyncEntries = 1000
+
+// beginSync opens a sync session, streaming req in messages of at most maxSyncEntries entries.
+func (s *StorageClient) beginSync(ctx context.Context, req *filesystem.BeginSyncRequest) (*filesystem.UploadSession, error) {
+	stream, err := s.c.BeginSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, n := &filesystem.BeginSyncRequest{Path: req.GetPath()}, 0
+	send := func() error {
+		err := stream.Send(msg)
+		msg, n = &filesystem.BeginSyncRequest{}, 0
+		// The server's error is returned by CloseAndRecv once it stopped reading
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	add := func(fill func(*filesystem.BeginSyncRequest)) error {
+		fill(msg)
+		if n++; n < maxSyncEntries {
+			return nil
+		}
+		return send()
+	}
+
+	for _, entry := range req.GetFiles() {
+		if err := add(func(m *filesystem.BeginSyncRequest) { m.Files = append(m.Files, entry) }); err != nil {
+			return nil, err
+		}
+	}
+	for _, relPath := range req.GetDelete() {
+		if err := add(func(m *filesystem.BeginSyncRequest) { m.Delete = append(m.Delete, relPath) }); err != nil {
+			return nil, err
+		}
+	}
+	for _, relPath := range req.GetDelta() {
+		if err := add(func(m *filesystem.BeginSyncRequest) { m.Delta = append(m.Delta, relPath) }); err != nil {
+			return nil, err
+		}
+	}
+	if err := send(); err != nil {
+		return nil, err
+	}
+	return stream.CloseAndRecv()
+}
+
+// getSignatures returns the block signatures of the given files under remotePath, keyed by their relative paths.
+func (s *StorageClient) getSignatures(ctx context.Context, remotePath string, relPaths []string) (map[string]*filesystem.FileSignature, error) {
+	stream, err := s.c.GetSignatures(ctx, &filesystem.SignatureRequest{Path: remotePath, Files: relPaths})
+	if err != nil {
+		return nil, err
+	}
+
+	signatures := map[string]*filesystem.FileSignature{}
+	for {
+		sig, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if existing, ok := signatures[sig.GetPath()]; ok {
+			existing.Blocks = append(existing.Blocks, sig.GetBlocks()...)
+		} else {
+			signatures[sig.GetPath()] = sig
+		}
+	}
+
+	for relPath, sig := range signatures {
+		if err := delta.Validate(sig); err != nil {
+			return nil, fmt.Errorf("server sent an invalid signature for %s: %v", relPath, err)
+		}
+	}
+	return signatures, nil
+}
+
+// diffTrees returns the local entries that are missing or different remotely and the remote paths missing locally.
+// It also returns the paths of changed files that have a non-empty remote copy.
+// Both trees must be sorted by path.
+func diffTrees(local []*filesystem.TreeEntry, remote []*filesystem.TreeEntry, checksum bool) ([]*filesystem.TreeEntry, []string, []string) {
+	var changed []*filesystem.TreeEntry
+	var extra []string
+	var existing []string
+
+	// Remote entries where local directories are get replaced by them rather than deleted
+	dirs := map[string]bool{}
+	for _, entry := range local {
+		for dir := path.Dir(entry.GetPath()); dir != "." && !dirs[dir]; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(local) || j < len(remote) {
+		switch {
+		case j == len(remote) || (i < len(local) && local[i].GetPath() < remote[j].GetPath()):
+			changed = append(changed, local[i])
+			i++
+		case i == len(local) || remote[j].GetPath() < local[i].GetPath():
+			if !dirs[remote[j].GetPath()] {
+				extra = append(extra, remote[j].GetPath())
+			}
+			j++
+		default:
+			if !sameFile(local[i], remote[j], checksum) {
+				changed = append(changed, local[i])
+				if local[i].GetType() == filesystem.EntryType_REGULAR && remote[j].GetType() == filesystem.EntryType_REGULAR && remote[j].GetSize() > 0 {
+					existing = append(existing, remote[j].GetPath())
+				}
+			}
+			i++
+			j++
+		}
+	}
+
+	return changed, extra, existing
+}
+
+func sameFile(local *filesystem.TreeEntry, remote *filesystem.TreeEntry, checksum bool) bool {
+	switch {
+	case local.GetType() != remote.GetType():
+		return false
+	case local.GetType() == filesystem.EntryType_DIRECTORY:
+		return true
+	case local.GetType() == filesystem.EntryType_SYMLINK:
+		return local.GetLinkTarget() == remote.GetLinkTarget()
+	case local.GetSize() != remote.GetSize():
+		return false
+	case checksum:
+		return bytes.Equal(local.GetSha256(), remote.GetSha256())
+	}
+	return local.GetMtime() == remote.GetMtime()
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/RGood/fs-xfer/pkg/generated/filesystem"
+)
+
+func TestDiffTrees(t *testing.T) {
+	file := func(p string, size int64, mtime int64) *filesystem.TreeEntry {
+		return &filesystem.TreeEntry{Path: p, Size: size, Mtime: mtime}
+	}
+	link := func(p string, target string) *filesystem.TreeEntry {
+		return &filesystem.TreeEntry{Path: p, Type: filesystem.EntryType_SYMLINK, LinkTarget: target}
+	}
+	dir := func(p string, mtime int64) *filesystem.TreeEntry {
+		return &filesystem.TreeEntry{Path: p, Type: filesystem.EntryType_DIRECTORY, Mtime: mtime}
+	}
+
+	tests := []struct {
+		name           string
+		local, remote  []*filesystem.TreeEntry
+		changed, extra []string
+		existing       []string
+	}{
+		{"same file", []*filesystem.TreeEntry{file("a", 1, 1)}, []*filesystem.TreeEntry{file("a", 1, 1)}, nil, nil, nil},
+		{"newer file", []*filesystem.TreeEntry{file("a", 1, 2)}, []*filesystem.TreeEntry{file("a", 1, 1)}, []string{"a"}, nil, []string{"a"}},
+		{"empty remote copy", []*filesystem.TreeEntry{file("a", 1, 2)}, []*filesystem.TreeEntry{file("a", 0, 1)}, []string{"a"}, nil, nil},
+		{"new and missing files", []*filesystem.TreeEntry{file("a", 1, 1)}, []*filesystem.TreeEntry{file("b", 1, 1)}, []string{"a"}, []string{"b"}, nil},
+		{"same symlink", []*filesystem.TreeEntry{link("l", "a")}, []*filesystem.TreeEntry{link("l", "a")}, nil, nil, nil},
+		{"retargeted symlink", []*filesystem.TreeEntry{link("l", "b")}, []*filesystem.TreeEntry{link("l", "a")}, []string{"l"}, nil, nil},
+		{"file replaced by symlink", []*filesystem.TreeEntry{link("a", "b")}, []*filesystem.TreeEntry{file("a", 1, 1)}, []string{"a"}, nil, nil},
+		{"missing symlink", nil, []*filesystem.TreeEntry{link("l", "a")}, nil, []string{"l"}, nil},
+		{"same empty directory", []*filesystem.TreeEntry{dir("d", 2)}, []*filesystem.TreeEntry{dir("d", 1)}, nil, nil, nil},
+		{"missing empty directory", nil, []*filesystem.TreeEntry{dir("d", 1)}, nil, []string{"d"}, nil},
+		{"directory filled", []*filesystem.TreeEntry{file("d/a", 1, 1)}, []*filesystem.TreeEntry{dir("d", 1)}, []string{"d/a"}, nil, nil},
+		{"directory emptied", []*filesystem.TreeEntry{dir("d", 1)}, []*filesystem.TreeEntry{file("d/a", 1, 1)}, []string{"d"}, []string{"d/a"}, nil},
+		{"file replaced by directory", []*filesystem.TreeEntry{file("a/b/c", 1, 1)}, []*filesystem.TreeEntry{file("a", 1, 1)}, []string{"a/b/c"}, nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changed, extra, existing := diffTrees(test.local, test.remote, false)
+
+			var changedPaths []string
+			for _, entry := range changed {
+				changedPaths = append(changedPaths, entry.GetPath())
+			}
+			if !slices.Equal(changedPaths, test.changed) || !slices.Equal(extra, test.extra) || !slices.Equal(existing, test.existing) {
+				t.Fatalf("got changed %v, extra %v and existing %v, want %v, %v and %v", changedPaths, extra, existing, test.changed, test.extra, test.existing)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/RGood/fs-xfer/pkg/generated/filesystem"
+	"github.com/klauspost/compress/zstd"
+)
+
+// MaxDecompressedSize bounds the size of decompressed data, so a small malicious payload can't exhaust memory.
+const MaxDecompressedSize = 16 * 1024 * 1024 // 16 MiB
+
+// Supported lists the codecs this build can compress and decompress, in order of preference.
+var Supported = []filesystem.Compression{filesystem.Compression_ZSTD, filesystem.Compression_GZIP}
+
+var (
+	decoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(MaxDecompressedSize))
+	// encoders caches a zstd encoder per speed, as they are expensive to create and safe to share.
+	encoders sync.Map
+)
+
+// Parse maps a codec name, such as "zstd", "gzip" or "none", to its codec.
+func Parse(name string) (filesystem.Compression, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return filesystem.Compression_UNCOMPRESSED, nil
+	case "gzip":
+		return filesystem.Compression_GZIP, nil
+	case "zstd":
+		return filesystem.Compression_ZSTD, nil
+	}
+	return 0, fmt.Errorf("unknown compression: %s", name)
+}
+
+// Negotiate returns the first of the accepted codecs that is supported, or UNCOMPRESSED if there is none.
+func Negotiate(accepted []filesystem.Compression) filesystem.Compression {
+	for _, c := range accepted {
+		if c != filesystem.Compression_UNCOMPRESSED && IsSupported(c) {
+			return c
+		}
+	}
+	return filesystem.Compression_UNCOMPRESSED
+}
+
+// IsSupported reports whether the codec is one this build supports.
+func IsSupported(c filesystem.Compression) bool {
+	for _, s := range Supported {
+		if s == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Compress returns data compressed with the codec at level, where zero picks the codec's default.
+func Compress(c filesystem.Compression, level int, data []byte) ([]byte, error) {
+	switch c {
+	case filesystem.Compression_UNCOMPRESSED:
+		return data, nil
+	case filesystem.Compression_GZIP:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+
+		var buf bytes.Buffer
+		w, err := gzip.NewWriterLevel(&buf, level)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case filesystem.Compression_ZSTD:
+		encoder, err := zstdEncoder(level)
+		if err != nil {
+			return nil, err
+		}
+		return encoder.EncodeAll(data, nil), nil
+	}
+	return nil, fmt.Errorf("unsupported compression: %v", c)
+}
+
+// Decompress returns data decompressed with the codec.
+func Decompress(c filesystem.Compression, data []byte) ([]byte, error) {
+	switch c {
+	case filesystem.Compression_UNCOMPRESSED:
+		return data, nil
+	case filesystem.Compression_GZIP:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		out, err := io.ReadAll(io.LimitReader(r, MaxDecompressedSize+1))
+		if err != nil {
+			return nil, err
+		} else if len(out) > MaxDecompressedSize {
+			return nil, fmt.Errorf("decompressed data exceeds %d bytes", MaxDecompressedSize)
+		}
+		return out, nil
+	case filesystem.Compression_ZSTD:
+		return decoder.DecodeAll(data, nil)
+	}
+	return nil, fmt.Errorf("unsupported compression: %v", c)
+}
+
+// Extension returns the file name extension of data stored with the codec.
+func Extension(c filesystem.Compression) string {
+	switch c {
+	case filesystem.Compression_GZIP:
+		return ".gz"
+	case filesystem.Compression_ZSTD:
+		return ".zst"
+	}
+	return ""
+}
+
+// zstdEncoder returns the shared encoder for level. Levels map onto the handful of speeds the encoder has,
+// which key the cache, so clients can't grow it by asking for many different levels.
+func zstdEncoder(level int) (*zstd.Encoder, error) {
+	speed := zstd.SpeedDefault
+	if level != 0 {
+		speed = zstd.EncoderLevelFromZstd(level)
+	}
+	if encoder, ok := encoders.Load(speed); ok {
+		return encoder.(*zstd.Encoder), nil
+	}
+
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(speed))
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := encoders.LoadOrStore(speed, encoder)
+	return actual.(*zstd.Encoder), nil
+}
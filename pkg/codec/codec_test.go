@@ -0,0 +1,64 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/RGood/fs-xfer/pkg/generated/filesystem"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name     string
+		accepted []filesystem.Compression
+		want     filesystem.Compression
+	}{
+		{"nothing accepted", nil, filesystem.Compression_UNCOMPRESSED},
+		{"only uncompressed", []filesystem.Compression{filesystem.Compression_UNCOMPRESSED}, filesystem.Compression_UNCOMPRESSED},
+		{"first supported", []filesystem.Compression{filesystem.Compression_GZIP, filesystem.Compression_ZSTD}, filesystem.Compression_GZIP},
+		{"unknown skipped", []filesystem.Compression{99, filesystem.Compression_UNCOMPRESSED, filesystem.Compression_ZSTD}, filesystem.Compression_ZSTD},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Negotiate(test.accepted); got != test.want {
+				t.Fatalf("negotiated %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("compressible "), 10000)
+	for _, c := range append([]filesystem.Compression{filesystem.Compression_UNCOMPRESSED}, Supported...) {
+		for _, level := range []int{0, 1, 9} {
+			compressed, err := Compress(c, level, data)
+			if err != nil {
+				t.Fatalf("%v at level %d: %v", c, level, err)
+			}
+			if c != filesystem.Compression_UNCOMPRESSED && len(compressed) >= len(data) {
+				t.Fatalf("%v at level %d left %d bytes as %d", c, level, len(data), len(compressed))
+			}
+			got, err := Decompress(c, compressed)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("%v at level %d decompressed to %d bytes and error %v, want %d bytes", c, level, len(got), err, len(data))
+			}
+		}
+	}
+
+	if _, err := Parse("lz4"); err == nil {
+		t.Fatal("parsed an unknown codec")
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	bomb := make([]byte, MaxDecompressedSize+1)
+	for _, c := range Supported {
+		compressed, err := Compress(c, 0, bomb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Decompress(c, compressed); err == nil {
+			t.Fatalf("%v decompressed more than %d bytes", c, MaxDecompressedSize)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package delta
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/RGood/fs-xfer/pkg/generated/filesystem"
+)
+
+const (
+	minBlockSize = 2 * 1024   // 2 KiB
+	maxBlockSize = 256 * 1024 // 256 KiB
+	// maxBlocks keeps signatures of large files to a few MiB.
+	maxBlocks  = 1 << 16
+	strongSize = 16
+)
+
+// Op is one step in rebuilding a file from an existing copy: either literal Data or Length bytes copied from Offset in the copy.
+type Op struct {
+	Data   []byte
+	Offset int64
+	Length int64
+}
+
+// MaxSignatures is the most file signatures a peer may send in one request.
+const MaxSignatures = 64 * 1024
+
+// Validate checks that a signature received from a peer could have been made by Sign, so diffing against it
+// takes bounded memory.
+func Validate(sig *filesystem.FileSignature) error {
+	blockSize := sig.GetBlockSize()
+	if blockSize < minBlockSize || blockSize > maxBlockSize {
+		return fmt.Errorf("block size %d is outside %d to %d", blockSize, minBlockSize, maxBlockSize)
+	}
+	if sig.GetSize() < 0 || int64(len(sig.GetBlocks())) != (sig.GetSize()+blockSize-1)/blockSize {
+		return fmt.Errorf("%d blocks of %d bytes don't cover %d bytes", len(sig.GetBlocks()), blockSize, sig.GetSize())
+	}
+	return nil
+}
+
+// BlockSize picks the signature block size for a file of the given size.
+func BlockSize(size int64) int64 {
+	blockSize := int64(math.Sqrt(float64(size)))
+	if blockSize < size/maxBlocks {
+		blockSize = size / maxBlocks
+	}
+
+	// Round up to a whole KiB
+	blockSize = (blockSize + 1023) &^ 1023
+
+	return min(max(blockSize, minBlockSize), maxBlockSize)
+}
+
+// Sign computes the block signatures of the size bytes read from r.
+func Sign(r io.Reader, size int64) (*filesystem.FileSignature, error) {
+	blockSize := BlockSize(size)
+	sig := &filesystem.FileSignature{BlockSize: blockSize, Size: size}
+
+	block := make([]byte, blockSize)
+	for remaining := size; remaining > 0; remaining -= blockSize {
+		n, err := io.ReadFull(r, block[:min(blockSize, remaining)])
+		if err != nil {
+			return nil, err
+		}
+
+		sig.Blocks = append(sig.Blocks, &filesystem.BlockSignature{
+			Weak:   weakSum(block[:n]),
+			Strong: strongSum(block[:n]),
+		})
+	}
+
+	return sig, nil
+}
+
+// Diff compares the size bytes of r against the signature of an existing copy and calls emit with the ops that rebuild r from it.
+// Adjacent copies are merged, and both literal runs and copies are split into ops of at most maxOp bytes.
+// The signature must be valid, as checked by Validate.
+func Diff(r io.ReaderAt, size int64, sig *filesystem.FileSignature, maxOp int64, emit func(Op) error) error {
+	d := &differ{
+		r:     r,
+		maxOp: maxOp,
+		emit:  emit,
+	}
+
+	blockSize := sig.GetBlockSize()
+	idx := newIndex(sig)
+	w := &window{r: r, size: size, buf: make([]byte, max(4*blockSize, 1024*1024))}
+
+	var pos int64
+	var sum rolling
+	rolled := false
+
+	for blockSize > 0 && pos+blockSize <= size {
+		if err := w.load(pos, min(blockSize+1, size-pos)); err != nil {
+			return err
+		}
+
+		if !rolled {
+			sum.init(w.slice(pos, blockSize))
+			rolled = true
+		}
+
+		if block, ok := idx.match(sum.value(), w.slice(pos, blockSize), d.next()); ok {
+			if err := d.copy(pos, block*blockSize, blockSize); err != nil {
+				return err
+			}
+			pos += blockSize
+			rolled = false
+			continue
+		}
+
+		if pos+blockSize == size {
+			break
+		}
+		sum.roll(w.at(pos), w.at(pos+blockSize), blockSize)
+		pos++
+	}
+
+	// The existing copy's short final block can only match the end of the file.
+	if tail := idx.tailLength; tail > 0 && size-tail >= d.literalStart {
+		if err := w.load(size-tail, tail); err != nil {
+			return err
+		}
+
+		data := w.slice(size-tail, tail)
+		if weakSum(data) == idx.tail.GetWeak() && bytes.Equal(strongSum(data), idx.tail.GetStrong()) {
+			if err := d.copy(size-tail, idx.tailOffset, tail); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := d.literal(size); err != nil {
+		return err
+	}
+	return d.flush()
+}
+
+// differ turns matches found by Diff into ops.
+type differ struct {
+	r     io.ReaderAt
+	maxOp int64
+	emit  func(Op) error
+
+	// literalStart is the first byte of the new file not yet covered by an op.
+	literalStart int64
+	// pending is a copy that may still be extended by the next matching block.
+	pending *Op
+}
+
+// next returns the offset in the existing copy that would extend the pending copy.
+func (d *differ) next() int64 {
+	if d.pending == nil {
+		return -1
+	}
+	return d.pending.Offset + d.pending.Length
+}
+
+// copy emits the literal data before pos and then a copy of length bytes from offset in the existing copy.
+func (d *differ) copy(pos int64, offset int64, length int64) error {
+	if err := d.literal(pos); err != nil {
+		return err
+	}
+
+	if d.pending != nil && d.next() == offset {
+		d.pending.Length += length
+	} else {
+		if err := d.flush(); err != nil {
+			return err
+		}
+		d.pending = &Op{Offset: offset, Length: length}
+	}
+
+	d.literalStart = pos + length
+	return nil
+}
+
+// literal emits the new file's data from literalStart up to end.
+func (d *differ) literal(end int64) error {
+	if d.literalStart >= end {
+		return nil
+	}
+
+	if err := d.flush(); err != nil {
+		return err
+	}
+
+	for d.literalStart < end {
+		data := make([]byte, min(end-d.literalStart, d.maxOp))
+		if _, err := d.r.ReadAt(data, d.literalStart); err != nil && err != io.EOF {
+			return err
+		}
+
+		if err := d.emit(Op{Data: data, Length: int64(len(data))}); err != nil {
+			return err
+		}
+		d.literalStart += int64(len(data))
+	}
+
+	return nil
+}
+
+// flush emits the pending copy, if any, in ops of at most maxOp bytes.
+func (d *differ) flush() error {
+	if d.pending == nil {
+		return nil
+	}
+
+	op := *d.pending
+	d.pending = nil
+	for op.Length > 0 {
+		length := min(op.Length, d.maxOp)
+		if err := d.emit(Op{Offset: op.Offset, Length: length}); err != nil {
+			return err
+		}
+		op.Offset += length
+		op.Length -= length
+	}
+	return nil
+}
+
+// index looks up blocks of a signature by their checksums.
+type index struct {
+	// filter has a bit set for every weak checksum in the index so most misses skip the map lookup.
+	filter [1 << 14]uint64
+	weak   map[uint32][]int64
+	blocks []*filesystem.BlockSignature
+
+	tail       *filesystem.BlockSignature
+	tailOffset int64
+	tailLength int64
+}
+
+func newIndex(sig *filesystem.FileSignature) *index {
+	idx := &index{weak: map[uint32][]int64{}, blocks: sig.GetBlocks()}
+
+	blockSize := sig.GetBlockSize()
+	for i, block := range sig.GetBlocks() {
+		offset := int64(i) * blockSize
+		if length := min(blockSize, sig.GetSize()-offset); length < blockSize {
+			idx.tail, idx.tailOffset, idx.tailLength = block, offset, length
+			continue
+		}
+
+		h := filterBit(block.GetWeak())
+		idx.filter[h/64] |= 1 << (h % 64)
+		idx.weak[block.GetWeak()] = append(idx.weak[block.GetWeak()], int64(i))
+	}
+
+	return idx
+}
+
+func filterBit(weak uint32) uint32 {
+	return (weak * 2654435761) >> 12
+}
+
+// match returns the index of a full block with the given content, preferring the block at preferred offset.
+func (idx *index) match(weak uint32, data []byte, preferred int64) (int64, bool) {
+	h := filterBit(weak)
+	if idx.filter[h/64]&(1<<(h%64)) == 0 {
+		return 0, false
+	}
+
+	candidates, ok := idx.weak[weak]
+	if !ok {
+		return 0, false
+	}
+
+	strong := strongSum(data)
+	found := int64(-1)
+	for _, i := range candidates {
+		if !bytes.Equal(idx.blocks[i].GetStrong(), strong) {
+			continue
+		}
+		if i*int64(len(data)) == preferred {
+			return i, true
+		}
+		if found < 0 {
+			found = i
+		}
+	}
+
+	return found, found >= 0
+}
+
+// window buffers the part of a file Diff is currently looking at.
+type window struct {
+	r     io.ReaderAt
+	size  int64
+	start int64
+	buf   []byte
+	n     int64
+}
+
+// load makes sure length bytes starting at pos are buffered.
+func (w *window) load(pos int64, length int64) error {
+	if pos >= w.start && pos+length <= w.start+w.n {
+		return nil
+	}
+
+	n, err := w.r.ReadAt(w.buf[:min(int64(len(w.buf)), w.size-pos)], pos)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if int64(n) < length {
+		return io.ErrUnexpectedEOF
+	}
+
+	w.start, w.n = pos, int64(n)
+	return nil
+}
+
+func (w *window) at(pos int64) byte {
+	return w.buf[pos-w.start]
+}
+
+func (w *window) slice(pos int64, length int64) []byte {
+	return w.buf[pos-w.start : pos-w.start+length]
+}
+
+// rolling is rsync's weak checksum, which can slide along a file one byte at a time.
+type rolling struct {
+	a, b uint32
+}
+
+func (r *rolling) init(data []byte) {
+	r.a, r.b = 0, 0
+	for i, c := range data {
+		r.a += uint32(c)
+		r.b += uint32(len(data)-i) * uint32(c)
+	}
+}
+
+// roll moves the window of the given length forward by one byte.
+func (r *rolling) roll(out byte, in byte, length int64) {
+	r.a = r.a - uint32(out) + uint32(in)
+	r.b = r.b - uint32(length)*uint32(out) + r.a
+}
+
+func (r *rolling) value() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+func weakSum(data []byte) uint32 {
+	var r rolling
+	r.init(data)
+	return r.value()
+}
+
+func strongSum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:strongSize]
+}
@@ -0,0 +1,159 @@
+package delta
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"testing"
+
+	"github.com/RGood/fs-xfer/pkg/generated/filesystem"
+)
+
+// random returns n pseudo-random bytes, the same for the same seed.
+func random(seed uint64, n int) []byte {
+	r := rand.NewChaCha8([32]byte{byte(seed), byte(seed >> 8)})
+	data := make([]byte, n)
+	r.Read(data)
+	return data
+}
+
+// apply rebuilds a file from old and the ops Diff emitted, the way receivers do.
+func apply(t *testing.T, old []byte, ops []Op) []byte {
+	t.Helper()
+
+	var rebuilt []byte
+	for _, op := range ops {
+		if op.Data != nil {
+			rebuilt = append(rebuilt, op.Data...)
+			continue
+		}
+		if op.Offset < 0 || op.Offset+op.Length > int64(len(old)) {
+			t.Fatalf("copy of %d bytes at %d is outside the %d byte copy", op.Length, op.Offset, len(old))
+		}
+		rebuilt = append(rebuilt, old[op.Offset:op.Offset+op.Length]...)
+	}
+	return rebuilt
+}
+
+func TestDiffApply(t *testing.T) {
+	const blockSize = minBlockSize
+	base := random(1, 64*blockSize+100)
+	edited := slices.Clone(base)
+	edited[10*blockSize+7] ^= 0xff
+
+	tests := []struct {
+		name string
+		old  []byte
+		new  []byte
+		// maxLiteral is the most literal bytes the ops may carry, or -1 to not check.
+		maxLiteral int
+	}{
+		{"identical", base, base, 0},
+		{"empty copy", nil, base, len(base)},
+		{"empty file", base, nil, 0},
+		{"both empty", nil, nil, 0},
+		{"smaller than a block", base[:100], base[:50], -1},
+		{"byte changed", base, edited, blockSize},
+		{"appended", base, append(slices.Clone(base), random(2, 1000)...), 1000 + 100},
+		{"prepended", base, append(random(3, 13), base...), 13},
+		{"truncated", base, base[:32*blockSize+5], 5},
+		{"inserted in the middle", base, slices.Concat(base[:20*blockSize+3], random(4, 77), base[20*blockSize+3:]), 77 + 2*blockSize},
+		{"blocks reordered", base, slices.Concat(base[32*blockSize:64*blockSize], base[:32*blockSize], base[64*blockSize:]), 0},
+		{"blocks repeated", base, slices.Concat(base[:8*blockSize], base[:8*blockSize]), 0},
+		{"unrelated", base, random(5, len(base)), -1},
+	}
+	for _, test := range tests {
+		for _, maxOp := range []int64{1000, blockSize, 1 << 20} {
+			t.Run(fmt.Sprintf("%s/maxOp=%d", test.name, maxOp), func(t *testing.T) {
+				sig, err := Sign(bytes.NewReader(test.old), int64(len(test.old)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := Validate(sig); err != nil {
+					t.Fatalf("signature made by Sign is invalid: %v", err)
+				}
+
+				var ops []Op
+				literal := 0
+				err = Diff(bytes.NewReader(test.new), int64(len(test.new)), sig, maxOp, func(op Op) error {
+					if op.Length <= 0 || op.Length > maxOp {
+						t.Fatalf("op of %d bytes, want 1 to %d", op.Length, maxOp)
+					}
+					if op.Data != nil && int64(len(op.Data)) != op.Length {
+						t.Fatalf("literal op of %d bytes has length %d", len(op.Data), op.Length)
+					}
+					literal += len(op.Data)
+					ops = append(ops, op)
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if rebuilt := apply(t, test.old, ops); !bytes.Equal(rebuilt, test.new) {
+					t.Fatalf("rebuilt %d bytes that differ from the %d byte file", len(rebuilt), len(test.new))
+				}
+				if test.maxLiteral >= 0 && literal > test.maxLiteral {
+					t.Fatalf("sent %d literal bytes, want at most %d", literal, test.maxLiteral)
+				}
+			})
+		}
+	}
+}
+
+func TestDiffEmitError(t *testing.T) {
+	data := random(6, 10*minBlockSize)
+	sig, err := Sign(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := errors.New("stop")
+	err = Diff(bytes.NewReader(data), int64(len(data)), sig, 1024, func(Op) error { return stop })
+	if !errors.Is(err, stop) {
+		t.Fatalf("got error %v, want the one emit returned", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	blocks := func(n int) []*filesystem.BlockSignature {
+		return make([]*filesystem.BlockSignature, n)
+	}
+
+	tests := []struct {
+		name  string
+		sig   *filesystem.FileSignature
+		valid bool
+	}{
+		{"empty", &filesystem.FileSignature{BlockSize: minBlockSize}, true},
+		{"whole blocks", &filesystem.FileSignature{BlockSize: minBlockSize, Size: 2 * minBlockSize, Blocks: blocks(2)}, true},
+		{"short final block", &filesystem.FileSignature{BlockSize: minBlockSize, Size: 2*minBlockSize + 1, Blocks: blocks(3)}, true},
+		{"block size too small", &filesystem.FileSignature{BlockSize: minBlockSize - 1}, false},
+		{"block size too large", &filesystem.FileSignature{BlockSize: maxBlockSize + 1}, false},
+		{"no block size", &filesystem.FileSignature{Size: 10, Blocks: blocks(1)}, false},
+		{"too few blocks", &filesystem.FileSignature{BlockSize: minBlockSize, Size: 2*minBlockSize + 1, Blocks: blocks(2)}, false},
+		{"too many blocks", &filesystem.FileSignature{BlockSize: minBlockSize, Size: minBlockSize, Blocks: blocks(2)}, false},
+		{"negative size", &filesystem.FileSignature{BlockSize: minBlockSize, Size: -1}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := Validate(test.sig); (err == nil) != test.valid {
+				t.Fatalf("Validate returned %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestBlockSize(t *testing.T) {
+	for _, size := range []int64{0, 1, minBlockSize, 1 << 20, 1 << 30, 1 << 40} {
+		blockSize := BlockSize(size)
+		if blockSize < minBlockSize || blockSize > maxBlockSize || blockSize%1024 != 0 {
+			t.Errorf("BlockSize(%d) = %d, want a whole KiB from %d to %d", size, blockSize, minBlockSize, maxBlockSize)
+		}
+		if size <= maxBlockSize*maxBlocks && (size+blockSize-1)/blockSize > maxBlocks {
+			t.Errorf("BlockSize(%d) = %d makes more than %d blocks", size, blockSize, maxBlocks)
+		}
+	}
+}
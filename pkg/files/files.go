@@ -1,12 +1,21 @@
 package files
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/RGood/fs-xfer/pkg/codec"
+	"github.com/RGood/fs-xfer/pkg/delta"
 	"github.com/RGood/fs-xfer/pkg/generated/filesystem"
 )
 
@@ -18,64 +27,651 @@ type FileProgress struct {
 	File        *filesystem.File
 }
 
+// ErrChecksumMismatch is returned when received data doesn't match its SHA-256 digest.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// Key identifies a streamed file by its path and name.
+func Key(file *filesystem.File) string {
+	return path.Join(file.GetPath(), file.GetName())
+}
+
+// ErrLinkEscapes is returned for links whose target resolves outside the root of a transfer.
+var ErrLinkEscapes = errors.New("link target escapes the transfer root")
+
+// LinkTarget returns what the symlink or hardlink entry in file points at, as a slash separated path relative to the root of the transfer.
+// Hardlink targets are keys of files sent earlier and are kept inside the root like any chunk path.
+// Symlink targets are relative to the link's directory, and ones that leave the root are rejected.
+func LinkTarget(file *filesystem.File) (string, error) {
+	target := file.GetLinkTarget()
+	if target == "" {
+		return "", fmt.Errorf("%w: %s has no target", ErrLinkEscapes, Key(file))
+	}
+
+	if file.GetType() == filesystem.EntryType_HARDLINK {
+		return relative(target), nil
+	}
+
+	if path.IsAbs(target) {
+		return "", fmt.Errorf("%w: %s -> %s", ErrLinkEscapes, Key(file), target)
+	}
+
+	target = path.Join(path.Dir(relative(Key(file))), target)
+	if target == ".." || strings.HasPrefix(target, "../") {
+		return "", fmt.Errorf("%w: %s -> %s", ErrLinkEscapes, Key(file), file.GetLinkTarget())
+	}
+	return target, nil
+}
+
+// SymlinkTarget returns the target to create the symlink entry in file with. It's cleaned, so any ".." in it
+// climbs out of the link's own directory rather than out of a symlink that may be created in its way later.
+func SymlinkTarget(file *filesystem.File) string {
+	return path.Clean(file.GetLinkTarget())
+}
+
+// ErrThroughLink is returned for entries that would be created inside a symlink.
+var ErrThroughLink = errors.New("path goes through a symlink")
+
+// maxLinkHops bounds how many symlinks CheckSymlink follows, so cycles end.
+const maxLinkHops = 40
+
+// CheckParents fails if one of the directories on the way from root to the entry at key is a symlink already in fsys,
+// so nothing received is created through a link received earlier.
+func CheckParents(fsys fs.FS, root string, key string) error {
+	dir := path.Dir(relative(key))
+	if dir == "." {
+		return nil
+	}
+
+	var p string
+	for _, elem := range strings.Split(dir, "/") {
+		p = path.Join(p, elem)
+		info, err := fs.Lstat(fsys, path.Join(root, p))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%w: %s is inside %s", ErrThroughLink, key, p)
+		}
+	}
+	return nil
+}
+
+// CheckSymlink follows the target of the symlink entry in file through what's already under root in fsys,
+// and fails if it, or a symlink on its way, leads outside root.
+func CheckSymlink(fsys fs.FS, root string, file *filesystem.File) error {
+	if _, err := resolveLink(fsys, root, path.Dir(relative(Key(file))), SymlinkTarget(file), 0); err != nil {
+		return fmt.Errorf("%s -> %s: %w", Key(file), file.GetLinkTarget(), err)
+	}
+	return nil
+}
+
+// resolveLink follows target from dir, both relative to root, through the symlinks under root in fsys and returns where it leads.
+func resolveLink(fsys fs.FS, root string, dir string, target string, hops int) (string, error) {
+	if path.IsAbs(target) {
+		return "", ErrLinkEscapes
+	}
+
+	for _, elem := range strings.Split(target, "/") {
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if dir == "." {
+				return "", ErrLinkEscapes
+			}
+			dir = path.Dir(dir)
+			continue
+		}
+
+		next := path.Join(dir, elem)
+		info, err := fs.Lstat(fsys, path.Join(root, next))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+			dir = next
+			continue
+		}
+
+		if hops++; hops > maxLinkHops {
+			return "", fmt.Errorf("too many levels of symlinks at %s", next)
+		}
+		linkTarget, err := fs.ReadLink(fsys, path.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if dir, err = resolveLink(fsys, root, dir, filepath.ToSlash(linkTarget), hops); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// relative cleans a chunk path into one relative to the root of the transfer, dropping attempts to climb out of it.
+func relative(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// VerifyChunk checks a chunk's data against its digest. Chunks without a digest are accepted.
+func VerifyChunk(file *filesystem.File) error {
+	if file.GetSha256() == nil {
+		return nil
+	}
+
+	sum := sha256.Sum256(file.GetData())
+	if !bytes.Equal(sum[:], file.GetSha256()) {
+		return fmt.Errorf("%w in chunk at offset %d of %s", ErrChecksumMismatch, file.GetOffset(), Key(file))
+	}
+	return nil
+}
+
+// VerifyFile compares a file's digest against the one carried by its final chunk.
+func VerifyFile(file *filesystem.File, sum []byte) error {
+	if !bytes.Equal(sum, file.GetFileSha256()) {
+		return fmt.Errorf("%w for file %s", ErrChecksumMismatch, Key(file))
+	}
+	return nil
+}
+
+// HashFile returns the SHA-256 digest of the file at the given path.
+func HashFile(filePath string) ([]byte, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return hashReader(f)
+}
+
+// HashFS returns the SHA-256 digest of the file called name in fsys.
+func HashFS(fsys fs.FS, name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return hashReader(f)
+}
+
+func hashReader(f io.Reader) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// CheckCopy validates the copy range of a delta chunk against the size of the existing copy it reads from,
+// before anything is allocated for it. Senders split copies into ranges of at most one chunk.
+func CheckCopy(c *filesystem.CopyRange, baseSize int64) error {
+	if c.GetLength() <= 0 || c.GetLength() > maxChunkSize || c.GetOffset() < 0 || c.GetOffset() > baseSize-c.GetLength() {
+		return fmt.Errorf("copy of %d bytes at %d is outside the existing copy of %d bytes", c.GetLength(), c.GetOffset(), baseSize)
+	}
+	return nil
+}
+
+// Options tailors a stream to what the receiver already has.
+type Options struct {
+	// Offsets maps a file's Key to the number of bytes the receiver already has.
+	// Files whose offset covers their whole size are not sent.
+	Offsets map[string]int64
+	// Signatures maps a file's Key to the signature of the receiver's existing copy.
+	// Those files are sent as literal data and copies from that copy.
+	Signatures map[string]*filesystem.FileSignature
+	// NoOwner leaves the owner out of the metadata sent with each file.
+	NoOwner bool
+	// Compression is the codec chunk data is compressed with, at CompressionLevel. Chunks that don't shrink are sent as is.
+	Compression      filesystem.Compression
+	CompressionLevel int
+	// Shard and Shards split the stream into Shards parts that can be sent concurrently, and only part Shard is sent.
+	// Each file lands whole in one part, except large files, which are split into ranges sent in different parts.
+	// Zero Shards sends everything.
+	Shard, Shards int
+}
+
+// ReadFile is an open file that supports random access, such as *os.File.
+type ReadFile interface {
+	fs.File
+	io.ReaderAt
+}
+
+// Sys is the Sys value of the file info reported by file systems other than the local disk.
+type Sys struct {
+	Owner *filesystem.Ownership
+	// LinkID is shared by every hardlink to a file, and nil for files with a single link.
+	LinkID any
+}
+
 // Given a path to a file or folder, Stream sends file chunks to the provided channel.
 func Stream(fullPath string, fileChan chan<- *FileProgress) error {
-	file, err := os.OpenFile(fullPath, os.O_RDONLY, os.ModePerm)
+	return StreamFrom(context.Background(), fullPath, Options{}, fileChan)
+}
+
+// StreamFrom is like Stream but only sends what the receiver is missing according to opts.
+// Streaming stops early if ctx is done.
+func StreamFrom(ctx context.Context, fullPath string, opts Options, fileChan chan<- *FileProgress) error {
+	info, err := os.Stat(fullPath)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	info, err := file.Stat()
+	// Chunk paths are full local paths, so the walk is rooted at the folder itself or at a file's parent
+	if info.IsDir() {
+		return streamTree(ctx, os.DirFS(fullPath), ".", path.Clean(fullPath), opts, fileChan)
+	}
+	return streamTree(ctx, os.DirFS(path.Dir(fullPath)), path.Base(fullPath), path.Dir(fullPath), opts, fileChan)
+}
+
+// StreamContents is like StreamFrom but chunk paths are relative to the folder at fullPath, or empty for a single file.
+func StreamContents(ctx context.Context, fullPath string, opts Options, fileChan chan<- *FileProgress) error {
+	info, err := os.Stat(fullPath)
 	if err != nil {
 		return err
 	}
 
-	filePath := fullPath
+	if info.IsDir() {
+		return streamTree(ctx, os.DirFS(fullPath), ".", "", opts, fileChan)
+	}
+	return streamTree(ctx, os.DirFS(path.Dir(fullPath)), path.Base(fullPath), "", opts, fileChan)
+}
+
+// StreamFS is like StreamFrom but reads the file or folder called name from fsys.
+// Chunk paths are relative to the root of fsys, and its files must implement io.ReaderAt.
+func StreamFS(ctx context.Context, fsys fs.FS, name string, opts Options, fileChan chan<- *FileProgress) error {
+	return streamTree(ctx, fsys, name, "", opts, fileChan)
+}
+
+// StreamSection sends the bytes from start to end of the regular file called name in fsys, whose files must implement io.ReaderAt.
+// Chunk paths are the file's directory. Only a section covering the whole file carries its digest and metadata.
+func StreamSection(ctx context.Context, fsys fs.FS, name string, start int64, end int64, opts Options, fileChan chan<- *FileProgress) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	file, ok := f.(ReadFile)
+	if !ok || !info.Mode().IsRegular() {
+		return fmt.Errorf("`%s` is not a regular file that supports random access", name)
+	}
+
+	return streamRange(ctx, file, info, path.Dir(name), start, end, start == 0, opts, fileChan)
+}
+
+// StreamFiles streams the files, symlinks and directories at the given slash separated paths relative to root.
+// Chunks carry paths relative to root rather than the full local path.
+func StreamFiles(ctx context.Context, root string, relPaths []string, opts Options, fileChan chan<- *FileProgress) error {
+	fsys := os.DirFS(root)
+	// Every path is below the transfer's root, so empty directories among them are sent too
+	t := &tree{ctx: ctx, fsys: fsys, root: ".", opts: opts, fileChan: fileChan, links: map[any]string{}}
+	for _, relPath := range relPaths {
+		name := path.Clean(relPath)
+		info, err := fs.Lstat(fsys, name)
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&fs.ModeSymlink != 0 {
+			err = t.symlink(name)
+		} else {
+			err = t.stream(name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamTree streams the file or folder called name in fsys. Chunk paths are name's directory joined to prefix.
+func streamTree(ctx context.Context, fsys fs.FS, name string, prefix string, opts Options, fileChan chan<- *FileProgress) error {
+	t := &tree{ctx: ctx, fsys: fsys, root: name, prefix: prefix, opts: opts, fileChan: fileChan, links: map[any]string{}}
+	return t.stream(name)
+}
+
+// tree holds the state of a single streamTree call.
+type tree struct {
+	ctx      context.Context
+	fsys     fs.FS
+	root     string
+	prefix   string
+	opts     Options
+	fileChan chan<- *FileProgress
+	// links maps the LinkID of each file sent so far to its key, so later hardlinks to it are sent as references.
+	links map[any]string
+}
+
+func (t *tree) stream(name string) error {
+	f, err := t.fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	wirePath := path.Join(t.prefix, path.Dir(name))
 
 	if info.IsDir() {
-		entries, err := file.ReadDir(0)
+		entries, err := fs.ReadDir(t.fsys, name)
 		if err != nil {
 			return err
 		}
 
+		// The root itself is implied by the transfer, so only empty folders below it are sent
+		if len(entries) == 0 && name != t.root {
+			return t.entry(&filesystem.File{
+				Name:     info.Name(),
+				Path:     wirePath,
+				Type:     filesystem.EntryType_DIRECTORY,
+				Metadata: metadata(info, t.opts),
+			})
+		}
+
 		errs := make([]error, len(entries))
 
 		for i, entry := range entries {
-			entryPath := path.Join(filePath, entry.Name())
+			if t.ctx.Err() != nil {
+				return t.ctx.Err()
+			}
 
-			errs[i] = Stream(entryPath, fileChan)
+			child := path.Join(name, entry.Name())
+			switch {
+			case entry.Type()&fs.ModeSymlink != 0:
+				errs[i] = t.symlink(child)
+			case entry.IsDir() || entry.Type().IsRegular():
+				errs[i] = t.stream(child)
+			}
+			// Anything else, like devices and named pipes, can't be transferred
 		}
 
 		return errors.Join(errs...)
-	} else {
-		chunks := info.Size() / maxChunkSize
-		if info.Size()%maxChunkSize != 0 {
-			chunks++
+	}
+
+	file, ok := f.(ReadFile)
+	if !ok {
+		return fmt.Errorf("file `%s` does not support random access", name)
+	}
+
+	if id := LinkID(info); id != nil {
+		if first, ok := t.links[id]; ok {
+			return t.entry(&filesystem.File{
+				Name:       info.Name(),
+				Path:       wirePath,
+				Type:       filesystem.EntryType_HARDLINK,
+				LinkTarget: first,
+			})
 		}
+		t.links[id] = path.Join(wirePath, info.Name())
+	}
 
-		if chunks == 0 {
-			chunks = 1
+	return t.file(file, info, wirePath)
+}
+
+// symlink sends the symlink called name without following it.
+func (t *tree) symlink(name string) error {
+	target, err := fs.ReadLink(t.fsys, name)
+	if err != nil {
+		return err
+	}
+
+	return t.entry(&filesystem.File{
+		Name:       path.Base(name),
+		Path:       path.Join(t.prefix, path.Dir(name)),
+		Type:       filesystem.EntryType_SYMLINK,
+		LinkTarget: filepath.ToSlash(target),
+	})
+}
+
+// entry sends a single chunk describing something other than a regular file, unless the receiver already has it.
+func (t *tree) entry(file *filesystem.File) error {
+	if _, ok := t.opts.Offsets[Key(file)]; ok || !t.opts.owns(Key(file), 0) {
+		return nil
+	}
+
+	select {
+	case t.fileChan <- &FileProgress{TotalChunks: 1, File: file}:
+		return nil
+	case <-t.ctx.Done():
+		return t.ctx.Err()
+	}
+}
+
+// file sends the parts of a regular file, labelled with wirePath, that belong to the stream's shard, starting from its offset in opts.
+func (t *tree) file(file ReadFile, info fs.FileInfo, wirePath string) error {
+	key := path.Join(wirePath, info.Name())
+
+	start, resumed := t.opts.Offsets[key]
+	if resumed && start >= info.Size() {
+		return nil
+	}
+
+	if sig, ok := t.opts.Signatures[key]; ok {
+		if !t.opts.owns(key, 0) {
+			return nil
+		}
+		return streamDelta(t.ctx, file, info, wirePath, start, sig, t.opts, t.fileChan)
+	}
+
+	for i, r := range splitRanges(start, info.Size(), t.opts.Shards) {
+		if !t.opts.owns(key, i) {
+			continue
+		}
+		if err := streamRange(t.ctx, file, info, wirePath, r[0], r[1], true, t.opts, t.fileChan); err != nil {
+			return err
 		}
+	}
+	return nil
+}
+
+// streamRange sends the chunks of the bytes from start to end of a single file, labelled with wirePath.
+// With verify set, the range that ends the file also carries the digest and metadata of the whole file.
+func streamRange(ctx context.Context, file ReadFile, info fs.FileInfo, wirePath string, start int64, end int64, verify bool, opts Options, fileChan chan<- *FileProgress) error {
+	filePath := path.Join(wirePath, info.Name())
+	last := verify && end == info.Size()
+
+	// The file digest covers the bytes before the range too.
+	digest := sha256.New()
+	if last {
+		if _, err := io.Copy(digest, io.NewSectionReader(file, 0, start)); err != nil {
+			return fmt.Errorf("error reading file `%s`: %v", filePath, err)
+		}
+	}
 
-		for i := int64(0); i < chunks; i++ {
-			data := make([]byte, maxChunkSize)
-			n, err := file.ReadAt(data, int64(i*maxChunkSize))
-			if err != nil && err != io.EOF {
-				return fmt.Errorf("error reading file `%s`: %v", filePath, err)
+	remaining := end - start
+	chunks := remaining / maxChunkSize
+	if remaining%maxChunkSize != 0 {
+		chunks++
+	}
+
+	if chunks == 0 {
+		chunks = 1
+	}
+
+	for i := int64(0); i < chunks; i++ {
+		offset := start + i*maxChunkSize
+		data := make([]byte, min(maxChunkSize, end-offset))
+		n, err := file.ReadAt(data, offset)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("error reading file `%s`: %v", filePath, err)
+		}
+
+		chunk := &filesystem.File{
+			Name:   info.Name(),
+			Path:   wirePath,
+			Data:   data[:n],
+			Offset: offset,
+		}
+
+		sum := sha256.Sum256(chunk.Data)
+		chunk.Sha256 = sum[:]
+		digest.Write(chunk.Data)
+		if last && i == chunks-1 {
+			chunk.FileSha256 = digest.Sum(nil)
+			chunk.Metadata = metadata(info, opts)
+		}
+		if err := compress(chunk, opts); err != nil {
+			return fmt.Errorf("error compressing file `%s`: %v", filePath, err)
+		}
+
+		select {
+		case fileChan <- &FileProgress{
+			TotalChunks: chunks,
+			Chunk:       i,
+			File:        chunk,
+		}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// streamDelta sends a file as literal data and copies from the receiver's existing copy described by sig.
+// Ops that end before start are skipped.
+func streamDelta(ctx context.Context, file ReadFile, info fs.FileInfo, wirePath string, start int64, sig *filesystem.FileSignature, opts Options, fileChan chan<- *FileProgress) error {
+	filePath := path.Join(wirePath, info.Name())
+
+	digest := sha256.New()
+	if _, err := io.Copy(digest, io.NewSectionReader(file, 0, info.Size())); err != nil {
+		return fmt.Errorf("error reading file `%s`: %v", filePath, err)
+	}
+
+	// Each chunk is held back until the next one exists so the last can carry the file digest.
+	var pending *filesystem.File
+	var chunk, offset int64
+
+	send := func(next *filesystem.File) error {
+		if pending != nil {
+			select {
+			case fileChan <- &FileProgress{Chunk: chunk, File: pending}:
+				chunk++
+			case <-ctx.Done():
+				return ctx.Err()
 			}
+		}
+		pending = next
+		return nil
+	}
+
+	err := delta.Diff(file, info.Size(), sig, maxChunkSize, func(op delta.Op) error {
+		opOffset := offset
+		offset += op.Length
+		if offset <= start {
+			return nil
+		}
+
+		// Trim the part of an op the receiver already has
+		if skip := start - opOffset; skip > 0 {
+			opOffset = start
+			if op.Data != nil {
+				op.Data = op.Data[skip:]
+			} else {
+				op.Offset += skip
+			}
+			op.Length -= skip
+		}
 
-			fileChan <- &FileProgress{
-				TotalChunks: chunks,
-				Chunk:       i,
-				File: &filesystem.File{
-					Name: info.Name(),
-					Path: path.Dir(fullPath),
-					Data: data[:n],
-				},
+		next := &filesystem.File{
+			Name:   info.Name(),
+			Path:   wirePath,
+			Offset: opOffset,
+		}
+		if op.Data != nil {
+			sum := sha256.Sum256(op.Data)
+			next.Data, next.Sha256 = op.Data, sum[:]
+			if err := compress(next, opts); err != nil {
+				return err
 			}
+		} else {
+			next.Copy = &filesystem.CopyRange{Offset: op.Offset, Length: op.Length}
 		}
+
+		return send(next)
+	})
+	if err != nil {
+		return fmt.Errorf("error reading file `%s`: %v", filePath, err)
+	}
+
+	if pending == nil {
+		pending = &filesystem.File{Name: info.Name(), Path: wirePath, Offset: info.Size()}
+	}
+	pending.FileSha256 = digest.Sum(nil)
+	pending.Metadata = metadata(info, opts)
+
+	return send(nil)
+}
+
+// compress replaces the chunk's data with its compressed form, if the codec in opts makes it smaller.
+func compress(chunk *filesystem.File, opts Options) error {
+	if opts.Compression == filesystem.Compression_UNCOMPRESSED || len(chunk.Data) == 0 {
+		return nil
+	}
+
+	data, err := codec.Compress(opts.Compression, opts.CompressionLevel, chunk.Data)
+	if err != nil {
+		return err
+	}
+	if len(data) < len(chunk.Data) {
+		chunk.Data, chunk.Compression = data, opts.Compression
+	}
+	return nil
+}
+
+// Decompress restores the original data of a compressed chunk, so it can be verified and written.
+func Decompress(file *filesystem.File) error {
+	if file.GetCompression() == filesystem.Compression_UNCOMPRESSED {
+		return nil
 	}
 
+	data, err := codec.Decompress(file.GetCompression(), file.GetData())
+	if err != nil {
+		return fmt.Errorf("could not decompress chunk at offset %d of %s: %v", file.GetOffset(), Key(file), err)
+	}
+	file.Data, file.Compression = data, filesystem.Compression_UNCOMPRESSED
 	return nil
 }
+
+// metadata describes the file for the receiver to restore.
+func metadata(info fs.FileInfo, opts Options) *filesystem.FileMetadata {
+	md := &filesystem.FileMetadata{
+		Mode:  uint32(info.Mode().Perm()),
+		Mtime: info.ModTime().UnixNano(),
+	}
+	if !opts.NoOwner {
+		md.Owner = Owner(info)
+	}
+	return md
+}
+
+// ApplyMetadata restores the permissions, modification time and, if owner is set, the owner of the file called name in root.
+// Ownership is only restored where the process is allowed to change it.
+func ApplyMetadata(root *os.Root, name string, md *filesystem.FileMetadata, owner bool) error {
+	if md == nil {
+		return nil
+	}
+
+	if err := root.Chmod(name, fs.FileMode(md.GetMode()).Perm()); err != nil {
+		return err
+	}
+
+	if o := md.GetOwner(); owner && o != nil {
+		if err := root.Lchown(name, int(o.GetUid()), int(o.GetGid())); err != nil && !errors.Is(err, fs.ErrPermission) {
+			return err
+		}
+	}
+
+	return root.Chtimes(name, time.Time{}, time.Unix(0, md.GetMtime()))
+}
@@ -0,0 +1,108 @@
+package files
+
+import (
+	"hash/fnv"
+	"sort"
+)
+
+// minRangeSize is the smallest range a large file is split into when a stream is sharded.
+const minRangeSize = 64 * maxChunkSize // 16 MiB
+
+// Ranges records which bytes of a file have been received, when its chunks may arrive in any order.
+type Ranges struct {
+	// spans holds the received [start, end) ranges, sorted and with neighbours merged.
+	spans [][2]int64
+}
+
+// Add records that the n bytes at offset were received and returns how many of them are new.
+func (r *Ranges) Add(offset int64, n int64) int64 {
+	if n <= 0 {
+		return 0
+	}
+
+	start, end := offset, offset+n
+	added := n
+	spans := make([][2]int64, 0, len(r.spans)+1)
+	for _, s := range r.spans {
+		if s[1] < offset || s[0] > offset+n {
+			spans = append(spans, s)
+			continue
+		}
+		if overlap := min(s[1], offset+n) - max(s[0], offset); overlap > 0 {
+			added -= overlap
+		}
+		start, end = min(start, s[0]), max(end, s[1])
+	}
+
+	i := sort.Search(len(spans), func(i int) bool { return spans[i][0] > start })
+	r.spans = append(spans[:i], append([][2]int64{{start, end}}, spans[i:]...)...)
+	return added
+}
+
+// Missing returns how many of the n bytes at offset haven't been received yet.
+func (r *Ranges) Missing(offset int64, n int64) int64 {
+	missing := max(n, 0)
+	for _, s := range r.spans {
+		if overlap := min(s[1], offset+n) - max(s[0], offset); overlap > 0 {
+			missing -= overlap
+		}
+	}
+	return missing
+}
+
+// Size returns how many bytes were received.
+func (r *Ranges) Size() int64 {
+	var size int64
+	for _, s := range r.spans {
+		size += s[1] - s[0]
+	}
+	return size
+}
+
+// Contiguous returns how many bytes from the start of the file were received without gaps.
+func (r *Ranges) Contiguous() int64 {
+	if len(r.spans) == 0 || r.spans[0][0] != 0 {
+		return 0
+	}
+	return r.spans[0][1]
+}
+
+// Continues reports whether data at offset would directly extend everything received so far.
+func (r *Ranges) Continues(offset int64) bool {
+	if len(r.spans) == 0 {
+		return offset == 0
+	}
+	return len(r.spans) == 1 && r.spans[0] == [2]int64{0, offset}
+}
+
+// splitRanges splits [start, end) into up to n ranges of whole chunks that are no smaller than minRangeSize.
+func splitRanges(start int64, end int64, n int) [][2]int64 {
+	count := int64(n)
+	if limit := (end - start) / minRangeSize; limit < count {
+		count = limit
+	}
+	if count <= 1 {
+		return [][2]int64{{start, end}}
+	}
+
+	size := (end - start + count - 1) / count
+	size = (size + maxChunkSize - 1) / maxChunkSize * maxChunkSize
+
+	ranges := make([][2]int64, 0, count)
+	for offset := start; offset < end; offset += size {
+		ranges = append(ranges, [2]int64{offset, min(offset+size, end)})
+	}
+	return ranges
+}
+
+// owns reports whether part of the file or entry identified by key belongs to the shard of the stream described by opts.
+// Consecutive parts of a file land in different shards.
+func (o Options) owns(key string, part int) bool {
+	if o.Shards <= 1 {
+		return true
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return (int(h.Sum32()%uint32(o.Shards))+part)%o.Shards == o.Shard
+}
@@ -0,0 +1,61 @@
+package files
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRanges(t *testing.T) {
+	var r Ranges
+	steps := []struct {
+		name          string
+		offset, n     int64
+		added         int64
+		contiguous    int64
+		spans         [][2]int64
+		continuesFrom int64
+	}{
+		{"past the start", 10, 5, 5, 0, [][2]int64{{10, 15}}, -1},
+		{"start", 0, 4, 4, 4, [][2]int64{{0, 4}, {10, 15}}, -1},
+		{"overlapping", 2, 4, 2, 6, [][2]int64{{0, 6}, {10, 15}}, -1},
+		{"already received", 11, 2, 0, 6, [][2]int64{{0, 6}, {10, 15}}, -1},
+		{"filling the gap", 6, 4, 4, 15, [][2]int64{{0, 15}}, 15},
+		{"empty", 20, 0, 0, 15, [][2]int64{{0, 15}}, 15},
+	}
+	for _, step := range steps {
+		if added := r.Add(step.offset, step.n); added != step.added {
+			t.Fatalf("%s: added %d bytes, want %d", step.name, added, step.added)
+		}
+		if got := r.Contiguous(); got != step.contiguous {
+			t.Fatalf("%s: %d contiguous bytes, want %d", step.name, got, step.contiguous)
+		}
+		if !slices.Equal(r.spans, step.spans) {
+			t.Fatalf("%s: received %v, want %v", step.name, r.spans, step.spans)
+		}
+		if step.continuesFrom >= 0 && (!r.Continues(step.continuesFrom) || r.Continues(step.continuesFrom-1)) {
+			t.Fatalf("%s: data at %d doesn't continue %v", step.name, step.continuesFrom, r.spans)
+		}
+	}
+}
+
+func TestSplitRanges(t *testing.T) {
+	tests := []struct {
+		name       string
+		start, end int64
+		n          int
+		want       [][2]int64
+	}{
+		{"small file", 0, minRangeSize, 4, [][2]int64{{0, minRangeSize}}},
+		{"one stream", 0, 4 * minRangeSize, 1, [][2]int64{{0, 4 * minRangeSize}}},
+		{"bounded by size", 0, 2*minRangeSize + 1, 4, [][2]int64{{0, minRangeSize + maxChunkSize}, {minRangeSize + maxChunkSize, 2*minRangeSize + 1}}},
+		{"even split", 0, 4 * minRangeSize, 2, [][2]int64{{0, 2 * minRangeSize}, {2 * minRangeSize, 4 * minRangeSize}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := splitRanges(test.start, test.end, test.n)
+			if !slices.Equal(got, test.want) {
+				t.Fatalf("split into %v, want %v", got, test.want)
+			}
+		})
+	}
+}
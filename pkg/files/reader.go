@@ -0,0 +1,81 @@
+package files
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	filesystem "github.com/RGood/fs-xfer/pkg/generated/filesystem"
+)
+
+// StreamReader sends everything read from r as the content of a single file called name, a slash separated path.
+// The file is sent with mode 0644 and the current time, as a reader has no metadata of its own.
+func StreamReader(ctx context.Context, r io.Reader, name string, opts Options, fileChan chan<- *FileProgress) error {
+	wirePath, fileName := path.Split(path.Clean(name))
+	wirePath = path.Clean(wirePath)
+	if wirePath == "." {
+		wirePath = ""
+	}
+
+	digest := sha256.New()
+
+	// Each chunk is held back until the next one exists so the last can carry the file digest.
+	var pending *filesystem.File
+	var chunk, offset int64
+
+	send := func(next *filesystem.File) error {
+		if pending != nil {
+			if err := compress(pending, opts); err != nil {
+				return fmt.Errorf("error compressing file `%s`: %v", name, err)
+			}
+			select {
+			case fileChan <- &FileProgress{Chunk: chunk, File: pending}:
+				chunk++
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		pending = next
+		return nil
+	}
+
+	for {
+		data := make([]byte, maxChunkSize)
+		n, err := io.ReadFull(r, data)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("error reading `%s`: %v", name, err)
+		}
+
+		// An empty reader is still sent as a single empty chunk
+		if n > 0 || pending == nil {
+			if err := send(newChunk(fileName, wirePath, data[:n], offset, digest)); err != nil {
+				return err
+			}
+			offset += int64(n)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	pending.FileSha256 = digest.Sum(nil)
+	pending.Metadata = &filesystem.FileMetadata{Mode: 0644, Mtime: time.Now().UnixNano()}
+
+	return send(nil)
+}
+
+// newChunk creates the chunk of data at offset and adds data to the file's digest.
+func newChunk(name string, wirePath string, data []byte, offset int64, digest io.Writer) *filesystem.File {
+	sum := sha256.Sum256(data)
+	digest.Write(data)
+	return &filesystem.File{
+		Name:   name,
+		Path:   wirePath,
+		Data:   data,
+		Offset: offset,
+		Sha256: sum[:],
+	}
+}
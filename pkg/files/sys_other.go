@@ -0,0 +1,25 @@
+//go:build !unix
+
+package files
+
+import (
+	"io/fs"
+
+	"github.com/RGood/fs-xfer/pkg/generated/filesystem"
+)
+
+// Owner returns the owner recorded in info, or nil if it has none.
+func Owner(info fs.FileInfo) *filesystem.Ownership {
+	if sys, ok := info.Sys().(*Sys); ok && sys != nil {
+		return sys.Owner
+	}
+	return nil
+}
+
+// LinkID returns a value shared by every hardlink to the file described by info, or nil if it has a single link.
+func LinkID(info fs.FileInfo) any {
+	if sys, ok := info.Sys().(*Sys); ok && sys != nil {
+		return sys.LinkID
+	}
+	return nil
+}
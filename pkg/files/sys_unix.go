@@ -0,0 +1,38 @@
+//go:build unix
+
+package files
+
+import (
+	"io/fs"
+	"syscall"
+
+	"github.com/RGood/fs-xfer/pkg/generated/filesystem"
+)
+
+// Owner returns the owner recorded in info, or nil if it has none.
+func Owner(info fs.FileInfo) *filesystem.Ownership {
+	switch sys := info.Sys().(type) {
+	case *syscall.Stat_t:
+		return &filesystem.Ownership{Uid: sys.Uid, Gid: sys.Gid}
+	case *Sys:
+		if sys != nil {
+			return sys.Owner
+		}
+	}
+	return nil
+}
+
+// LinkID returns a value shared by every hardlink to the file described by info, or nil if it has a single link.
+func LinkID(info fs.FileInfo) any {
+	switch sys := info.Sys().(type) {
+	case *syscall.Stat_t:
+		if sys.Nlink > 1 {
+			return [2]uint64{uint64(sys.Dev), uint64(sys.Ino)}
+		}
+	case *Sys:
+		if sys != nil {
+			return sys.LinkID
+		}
+	}
+	return nil
+}
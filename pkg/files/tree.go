@@ -0,0 +1,96 @@
+package files
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/RGood/fs-xfer/pkg/generated/filesystem"
+)
+
+// Tree lists every regular file, symlink and empty directory under root with paths relative to root, sorted by path.
+// If root is a file, the tree holds just that file under its own name.
+// With checksums set, each regular file also carries its SHA-256.
+func Tree(root string, checksums bool) ([]*filesystem.TreeEntry, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return TreeFS(os.DirFS(root), ".", checksums)
+	}
+	return TreeFS(os.DirFS(filepath.Dir(root)), filepath.Base(root), checksums)
+}
+
+// TreeFS is like Tree but lists the file or folder called name in fsys.
+func TreeFS(fsys fs.FS, name string, checksums bool) ([]*filesystem.TreeEntry, error) {
+	entries := []*filesystem.TreeEntry{}
+	// dirs maps the directories under name to their entries, which stay listed only while the directories turn out empty
+	dirs := map[string]*filesystem.TreeEntry{}
+
+	err := fs.WalkDir(fsys, name, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != name {
+			delete(dirs, path.Dir(p))
+		}
+
+		relPath := path.Base(p)
+		if p != name {
+			relPath = strings.TrimPrefix(p, name+"/")
+			if name == "." {
+				relPath = p
+			}
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry := &filesystem.TreeEntry{Path: relPath, Mtime: info.ModTime().UnixNano()}
+
+		switch {
+		case d.IsDir():
+			if p != name {
+				entry.Type = filesystem.EntryType_DIRECTORY
+				dirs[p] = entry
+			}
+			return nil
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := fs.ReadLink(fsys, p)
+			if err != nil {
+				return err
+			}
+			entry.Type, entry.LinkTarget = filesystem.EntryType_SYMLINK, filepath.ToSlash(target)
+		case d.Type().IsRegular():
+			entry.Size = info.Size()
+			if checksums {
+				if entry.Sha256, err = HashFS(fsys, p); err != nil {
+					return err
+				}
+			}
+		default:
+			return nil
+		}
+
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range dirs {
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+
+	return entries, nil
+}
@@ -0,0 +1,46 @@
+package files
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/RGood/fs-xfer/pkg/generated/filesystem"
+)
+
+func TestTreeFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"root/a":           {Data: []byte("abc")},
+		"root/sub/b":       {Data: []byte("b")},
+		"root/sub/link":    {Data: []byte("../a"), Mode: fs.ModeSymlink},
+		"root/empty":       {Mode: fs.ModeDir},
+		"root/nested/deep": {Mode: fs.ModeDir},
+	}
+
+	entries, err := TreeFS(fsys, "root", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		path   string
+		typ    filesystem.EntryType
+		size   int64
+		target string
+	}{
+		{"a", filesystem.EntryType_REGULAR, 3, ""},
+		{"empty", filesystem.EntryType_DIRECTORY, 0, ""},
+		{"nested/deep", filesystem.EntryType_DIRECTORY, 0, ""},
+		{"sub/b", filesystem.EntryType_REGULAR, 1, ""},
+		{"sub/link", filesystem.EntryType_SYMLINK, 0, "../a"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d: %v", len(entries), len(want), entries)
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.GetPath() != w.path || e.GetType() != w.typ || e.GetSize() != w.size || e.GetLinkTarget() != w.target {
+			t.Errorf("entry %d is %v, want %+v", i, e, w)
+		}
+	}
+}
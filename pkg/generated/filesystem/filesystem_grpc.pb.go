@@ -22,12 +22,45 @@ const _ = grpc.SupportPackageIsVersion7
 //
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type StorageServiceClient interface {
-	// Upload accepts files in chunks. Server expects file content to be streamed in order and consecutively.
+	// Upload accepts files in chunks. One-shot uploads must stream file content in order and consecutively.
+	// Chunks tagged with a session_id are written at their offset into that session instead of a new upload.
+	// Several streams may write to a session at once, each carrying whole files or ranges of them in any order.
 	Upload(ctx context.Context, opts ...grpc.CallOption) (StorageService_UploadClient, error)
-	// Download streams files in chunks. Server produces file chunks in order and consecutively.
+	// BeginUpload opens a resumable upload session.
+	BeginUpload(ctx context.Context, in *BeginUploadRequest, opts ...grpc.CallOption) (*UploadSession, error)
+	// ResumeUpload reports how many bytes of each file the server has received for a session.
+	ResumeUpload(ctx context.Context, in *ResumeUploadRequest, opts ...grpc.CallOption) (*UploadSession, error)
+	// CommitUpload closes a session and returns the id and size of the finished upload.
+	CommitUpload(ctx context.Context, in *CommitUploadRequest, opts ...grpc.CallOption) (*UploadFilesystemResponse, error)
+	// BeginSync opens an upload session that writes into an existing remote directory.
+	// The request is streamed in batches so syncs of huge trees fit in gRPC's message size limit.
+	// Chunk paths are relative to that directory.
+	BeginSync(ctx context.Context, opts ...grpc.CallOption) (StorageService_BeginSyncClient, error)
+	// GetTree streams every file under a remote path with its size and modification time, in batches sorted by path.
+	GetTree(ctx context.Context, in *TreeRequest, opts ...grpc.CallOption) (StorageService_GetTreeClient, error)
+	// GetSignatures streams block signatures of remote files so the client can upload them as deltas.
+	GetSignatures(ctx context.Context, in *SignatureRequest, opts ...grpc.CallOption) (StorageService_GetSignaturesClient, error)
+	// Download streams files in chunks. Server produces each file, or each range of a large file in a sharded or ranged download, in order and consecutively.
 	Download(ctx context.Context, in *DownloadRequest, opts ...grpc.CallOption) (StorageService_DownloadClient, error)
-	// GetManifest lists the contents of a remote folder.
+	// GetManifest lists the contents of a remote folder in a single response, which large folders may not fit in.
 	GetManifest(ctx context.Context, in *ManifestRequest, opts ...grpc.CallOption) (*ManifestResponse, error)
+	// ListEntries streams the contents of a remote folder in batches.
+	// Entries come depth-first, each directory's entries sorted by name and a directory before its contents, so a listing can be resumed.
+	ListEntries(ctx context.Context, in *ListEntriesRequest, opts ...grpc.CallOption) (StorageService_ListEntriesClient, error)
+	// Stat describes a single remote path without following symlinks.
+	Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*StatResponse, error)
+	// Delete removes a remote file, symlink or directory.
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	// Move renames a remote path, possibly into another upload.
+	Move(ctx context.Context, in *MoveRequest, opts ...grpc.CallOption) (*MoveResponse, error)
+	// Copy duplicates a remote path on the server, keeping metadata, symlinks and hardlinks.
+	Copy(ctx context.Context, in *CopyRequest, opts ...grpc.CallOption) (*CopyResponse, error)
+	// GetUsage reports how many bytes the caller and the whole server store, and the quotas that limit them.
+	// Uploads that would exceed a quota fail with RESOURCE_EXHAUSTED.
+	GetUsage(ctx context.Context, in *UsageRequest, opts ...grpc.CallOption) (*UsageResponse, error)
+	// CreateShareLink signs a token that lets anyone holding it download a path until it expires,
+	// without credentials of their own. Callers must be allowed to read the path.
+	CreateShareLink(ctx context.Context, in *ShareLinkRequest, opts ...grpc.CallOption) (*ShareLinkResponse, error)
 }
 
 type storageServiceClient struct {
@@ -72,8 +105,133 @@ func (x *storageServiceUploadClient) CloseAndRecv() (*UploadFilesystemResponse,
 	return m, nil
 }
 
+func (c *storageServiceClient) BeginUpload(ctx context.Context, in *BeginUploadRequest, opts ...grpc.CallOption) (*UploadSession, error) {
+	out := new(UploadSession)
+	err := c.cc.Invoke(ctx, "/filesystem.StorageService/BeginUpload", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageServiceClient) ResumeUpload(ctx context.Context, in *ResumeUploadRequest, opts ...grpc.CallOption) (*UploadSession, error) {
+	out := new(UploadSession)
+	err := c.cc.Invoke(ctx, "/filesystem.StorageService/ResumeUpload", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageServiceClient) CommitUpload(ctx context.Context, in *CommitUploadRequest, opts ...grpc.CallOption) (*UploadFilesystemResponse, error) {
+	out := new(UploadFilesystemResponse)
+	err := c.cc.Invoke(ctx, "/filesystem.StorageService/CommitUpload", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageServiceClient) BeginSync(ctx context.Context, opts ...grpc.CallOption) (StorageService_BeginSyncClient, error) {
+	stream, err := c.cc.NewStream(ctx, &StorageService_ServiceDesc.Streams[1], "/filesystem.StorageService/BeginSync", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &storageServiceBeginSyncClient{stream}
+	return x, nil
+}
+
+type StorageService_BeginSyncClient interface {
+	Send(*BeginSyncRequest) error
+	CloseAndRecv() (*UploadSession, error)
+	grpc.ClientStream
+}
+
+type storageServiceBeginSyncClient struct {
+	grpc.ClientStream
+}
+
+func (x *storageServiceBeginSyncClient) Send(m *BeginSyncRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *storageServiceBeginSyncClient) CloseAndRecv() (*UploadSession, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(UploadSession)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *storageServiceClient) GetTree(ctx context.Context, in *TreeRequest, opts ...grpc.CallOption) (StorageService_GetTreeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &StorageService_ServiceDesc.Streams[2], "/filesystem.StorageService/GetTree", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &storageServiceGetTreeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type StorageService_GetTreeClient interface {
+	Recv() (*TreeResponse, error)
+	grpc.ClientStream
+}
+
+type storageServiceGetTreeClient struct {
+	grpc.ClientStream
+}
+
+func (x *storageServiceGetTreeClient) Recv() (*TreeResponse, error) {
+	m := new(TreeResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *storageServiceClient) GetSignatures(ctx context.Context, in *SignatureRequest, opts ...grpc.CallOption) (StorageService_GetSignaturesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &StorageService_ServiceDesc.Streams[3], "/filesystem.StorageService/GetSignatures", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &storageServiceGetSignaturesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type StorageService_GetSignaturesClient interface {
+	Recv() (*FileSignature, error)
+	grpc.ClientStream
+}
+
+type storageServiceGetSignaturesClient struct {
+	grpc.ClientStream
+}
+
+func (x *storageServiceGetSignaturesClient) Recv() (*FileSignature, error) {
+	m := new(FileSignature)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func (c *storageServiceClient) Download(ctx context.Context, in *DownloadRequest, opts ...grpc.CallOption) (StorageService_DownloadClient, error) {
-	stream, err := c.cc.NewStream(ctx, &StorageService_ServiceDesc.Streams[1], "/filesystem.StorageService/Download", opts...)
+	stream, err := c.cc.NewStream(ctx, &StorageService_ServiceDesc.Streams[4], "/filesystem.StorageService/Download", opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -113,16 +271,135 @@ func (c *storageServiceClient) GetManifest(ctx context.Context, in *ManifestRequ
 	return out, nil
 }
 
+func (c *storageServiceClient) ListEntries(ctx context.Context, in *ListEntriesRequest, opts ...grpc.CallOption) (StorageService_ListEntriesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &StorageService_ServiceDesc.Streams[5], "/filesystem.StorageService/ListEntries", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &storageServiceListEntriesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type StorageService_ListEntriesClient interface {
+	Recv() (*ListEntriesResponse, error)
+	grpc.ClientStream
+}
+
+type storageServiceListEntriesClient struct {
+	grpc.ClientStream
+}
+
+func (x *storageServiceListEntriesClient) Recv() (*ListEntriesResponse, error) {
+	m := new(ListEntriesResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *storageServiceClient) Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*StatResponse, error) {
+	out := new(StatResponse)
+	err := c.cc.Invoke(ctx, "/filesystem.StorageService/Stat", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageServiceClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, "/filesystem.StorageService/Delete", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageServiceClient) Move(ctx context.Context, in *MoveRequest, opts ...grpc.CallOption) (*MoveResponse, error) {
+	out := new(MoveResponse)
+	err := c.cc.Invoke(ctx, "/filesystem.StorageService/Move", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageServiceClient) Copy(ctx context.Context, in *CopyRequest, opts ...grpc.CallOption) (*CopyResponse, error) {
+	out := new(CopyResponse)
+	err := c.cc.Invoke(ctx, "/filesystem.StorageService/Copy", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageServiceClient) GetUsage(ctx context.Context, in *UsageRequest, opts ...grpc.CallOption) (*UsageResponse, error) {
+	out := new(UsageResponse)
+	err := c.cc.Invoke(ctx, "/filesystem.StorageService/GetUsage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageServiceClient) CreateShareLink(ctx context.Context, in *ShareLinkRequest, opts ...grpc.CallOption) (*ShareLinkResponse, error) {
+	out := new(ShareLinkResponse)
+	err := c.cc.Invoke(ctx, "/filesystem.StorageService/CreateShareLink", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // StorageServiceServer is the server API for StorageService service.
 // All implementations must embed UnimplementedStorageServiceServer
 // for forward compatibility
 type StorageServiceServer interface {
-	// Upload accepts files in chunks. Server expects file content to be streamed in order and consecutively.
+	// Upload accepts files in chunks. One-shot uploads must stream file content in order and consecutively.
+	// Chunks tagged with a session_id are written at their offset into that session instead of a new upload.
+	// Several streams may write to a session at once, each carrying whole files or ranges of them in any order.
 	Upload(StorageService_UploadServer) error
-	// Download streams files in chunks. Server produces file chunks in order and consecutively.
+	// BeginUpload opens a resumable upload session.
+	BeginUpload(context.Context, *BeginUploadRequest) (*UploadSession, error)
+	// ResumeUpload reports how many bytes of each file the server has received for a session.
+	ResumeUpload(context.Context, *ResumeUploadRequest) (*UploadSession, error)
+	// CommitUpload closes a session and returns the id and size of the finished upload.
+	CommitUpload(context.Context, *CommitUploadRequest) (*UploadFilesystemResponse, error)
+	// BeginSync opens an upload session that writes into an existing remote directory.
+	// The request is streamed in batches so syncs of huge trees fit in gRPC's message size limit.
+	// Chunk paths are relative to that directory.
+	BeginSync(StorageService_BeginSyncServer) error
+	// GetTree streams every file under a remote path with its size and modification time, in batches sorted by path.
+	GetTree(*TreeRequest, StorageService_GetTreeServer) error
+	// GetSignatures streams block signatures of remote files so the client can upload them as deltas.
+	GetSignatures(*SignatureRequest, StorageService_GetSignaturesServer) error
+	// Download streams files in chunks. Server produces each file, or each range of a large file in a sharded or ranged download, in order and consecutively.
 	Download(*DownloadRequest, StorageService_DownloadServer) error
-	// GetManifest lists the contents of a remote folder.
+	// GetManifest lists the contents of a remote folder in a single response, which large folders may not fit in.
 	GetManifest(context.Context, *ManifestRequest) (*ManifestResponse, error)
+	// ListEntries streams the contents of a remote folder in batches.
+	// Entries come depth-first, each directory's entries sorted by name and a directory before its contents, so a listing can be resumed.
+	ListEntries(*ListEntriesRequest, StorageService_ListEntriesServer) error
+	// Stat describes a single remote path without following symlinks.
+	Stat(context.Context, *StatRequest) (*StatResponse, error)
+	// Delete removes a remote file, symlink or directory.
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	// Move renames a remote path, possibly into another upload.
+	Move(context.Context, *MoveRequest) (*MoveResponse, error)
+	// Copy duplicates a remote path on the server, keeping metadata, symlinks and hardlinks.
+	Copy(context.Context, *CopyRequest) (*CopyResponse, error)
+	// GetUsage reports how many bytes the caller and the whole server store, and the quotas that limit them.
+	// Uploads that would exceed a quota fail with RESOURCE_EXHAUSTED.
+	GetUsage(context.Context, *UsageRequest) (*UsageResponse, error)
+	// CreateShareLink signs a token that lets anyone holding it download a path until it expires,
+	// without credentials of their own. Callers must be allowed to read the path.
+	CreateShareLink(context.Context, *ShareLinkRequest) (*ShareLinkResponse, error)
 	mustEmbedUnimplementedStorageServiceServer()
 }
 
@@ -133,12 +410,51 @@ type UnimplementedStorageServiceServer struct {
 func (UnimplementedStorageServiceServer) Upload(StorageService_UploadServer) error {
 	return status.Errorf(codes.Unimplemented, "method Upload not implemented")
 }
+func (UnimplementedStorageServiceServer) BeginUpload(context.Context, *BeginUploadRequest) (*UploadSession, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BeginUpload not implemented")
+}
+func (UnimplementedStorageServiceServer) ResumeUpload(context.Context, *ResumeUploadRequest) (*UploadSession, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResumeUpload not implemented")
+}
+func (UnimplementedStorageServiceServer) CommitUpload(context.Context, *CommitUploadRequest) (*UploadFilesystemResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CommitUpload not implemented")
+}
+func (UnimplementedStorageServiceServer) BeginSync(StorageService_BeginSyncServer) error {
+	return status.Errorf(codes.Unimplemented, "method BeginSync not implemented")
+}
+func (UnimplementedStorageServiceServer) GetTree(*TreeRequest, StorageService_GetTreeServer) error {
+	return status.Errorf(codes.Unimplemented, "method GetTree not implemented")
+}
+func (UnimplementedStorageServiceServer) GetSignatures(*SignatureRequest, StorageService_GetSignaturesServer) error {
+	return status.Errorf(codes.Unimplemented, "method GetSignatures not implemented")
+}
 func (UnimplementedStorageServiceServer) Download(*DownloadRequest, StorageService_DownloadServer) error {
 	return status.Errorf(codes.Unimplemented, "method Download not implemented")
 }
 func (UnimplementedStorageServiceServer) GetManifest(context.Context, *ManifestRequest) (*ManifestResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetManifest not implemented")
 }
+func (UnimplementedStorageServiceServer) ListEntries(*ListEntriesRequest, StorageService_ListEntriesServer) error {
+	return status.Errorf(codes.Unimplemented, "method ListEntries not implemented")
+}
+func (UnimplementedStorageServiceServer) Stat(context.Context, *StatRequest) (*StatResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stat not implemented")
+}
+func (UnimplementedStorageServiceServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedStorageServiceServer) Move(context.Context, *MoveRequest) (*MoveResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Move not implemented")
+}
+func (UnimplementedStorageServiceServer) Copy(context.Context, *CopyRequest) (*CopyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Copy not implemented")
+}
+func (UnimplementedStorageServiceServer) GetUsage(context.Context, *UsageRequest) (*UsageResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUsage not implemented")
+}
+func (UnimplementedStorageServiceServer) CreateShareLink(context.Context, *ShareLinkRequest) (*ShareLinkResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateShareLink not implemented")
+}
 func (UnimplementedStorageServiceServer) mustEmbedUnimplementedStorageServiceServer() {}
 
 // UnsafeStorageServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -178,6 +494,128 @@ func (x *storageServiceUploadServer) Recv() (*File, error) {
 	return m, nil
 }
 
+func _StorageService_BeginUpload_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BeginUploadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServiceServer).BeginUpload(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/filesystem.StorageService/BeginUpload",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServiceServer).BeginUpload(ctx, req.(*BeginUploadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StorageService_ResumeUpload_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResumeUploadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServiceServer).ResumeUpload(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/filesystem.StorageService/ResumeUpload",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServiceServer).ResumeUpload(ctx, req.(*ResumeUploadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StorageService_CommitUpload_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CommitUploadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServiceServer).CommitUpload(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/filesystem.StorageService/CommitUpload",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServiceServer).CommitUpload(ctx, req.(*CommitUploadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StorageService_BeginSync_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(StorageServiceServer).BeginSync(&storageServiceBeginSyncServer{stream})
+}
+
+type StorageService_BeginSyncServer interface {
+	SendAndClose(*UploadSession) error
+	Recv() (*BeginSyncRequest, error)
+	grpc.ServerStream
+}
+
+type storageServiceBeginSyncServer struct {
+	grpc.ServerStream
+}
+
+func (x *storageServiceBeginSyncServer) SendAndClose(m *UploadSession) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *storageServiceBeginSyncServer) Recv() (*BeginSyncRequest, error) {
+	m := new(BeginSyncRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _StorageService_GetTree_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(TreeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(StorageServiceServer).GetTree(m, &storageServiceGetTreeServer{stream})
+}
+
+type StorageService_GetTreeServer interface {
+	Send(*TreeResponse) error
+	grpc.ServerStream
+}
+
+type storageServiceGetTreeServer struct {
+	grpc.ServerStream
+}
+
+func (x *storageServiceGetTreeServer) Send(m *TreeResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _StorageService_GetSignatures_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SignatureRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(StorageServiceServer).GetSignatures(m, &storageServiceGetSignaturesServer{stream})
+}
+
+type StorageService_GetSignaturesServer interface {
+	Send(*FileSignature) error
+	grpc.ServerStream
+}
+
+type storageServiceGetSignaturesServer struct {
+	grpc.ServerStream
+}
+
+func (x *storageServiceGetSignaturesServer) Send(m *FileSignature) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 func _StorageService_Download_Handler(srv interface{}, stream grpc.ServerStream) error {
 	m := new(DownloadRequest)
 	if err := stream.RecvMsg(m); err != nil {
@@ -217,6 +655,135 @@ func _StorageService_GetManifest_Handler(srv interface{}, ctx context.Context, d
 	return interceptor(ctx, in, info, handler)
 }
 
+func _StorageService_ListEntries_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListEntriesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(StorageServiceServer).ListEntries(m, &storageServiceListEntriesServer{stream})
+}
+
+type StorageService_ListEntriesServer interface {
+	Send(*ListEntriesResponse) error
+	grpc.ServerStream
+}
+
+type storageServiceListEntriesServer struct {
+	grpc.ServerStream
+}
+
+func (x *storageServiceListEntriesServer) Send(m *ListEntriesResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _StorageService_Stat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServiceServer).Stat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/filesystem.StorageService/Stat",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServiceServer).Stat(ctx, req.(*StatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StorageService_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServiceServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/filesystem.StorageService/Delete",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServiceServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StorageService_Move_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MoveRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServiceServer).Move(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/filesystem.StorageService/Move",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServiceServer).Move(ctx, req.(*MoveRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StorageService_Copy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CopyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServiceServer).Copy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/filesystem.StorageService/Copy",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServiceServer).Copy(ctx, req.(*CopyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StorageService_GetUsage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UsageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServiceServer).GetUsage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/filesystem.StorageService/GetUsage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServiceServer).GetUsage(ctx, req.(*UsageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StorageService_CreateShareLink_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ShareLinkRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServiceServer).CreateShareLink(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/filesystem.StorageService/CreateShareLink",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServiceServer).CreateShareLink(ctx, req.(*ShareLinkRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // StorageService_ServiceDesc is the grpc.ServiceDesc for StorageService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -224,10 +791,46 @@ var StorageService_ServiceDesc = grpc.ServiceDesc{
 	ServiceName: "filesystem.StorageService",
 	HandlerType: (*StorageServiceServer)(nil),
 	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "BeginUpload",
+			Handler:    _StorageService_BeginUpload_Handler,
+		},
+		{
+			MethodName: "ResumeUpload",
+			Handler:    _StorageService_ResumeUpload_Handler,
+		},
+		{
+			MethodName: "CommitUpload",
+			Handler:    _StorageService_CommitUpload_Handler,
+		},
 		{
 			MethodName: "GetManifest",
 			Handler:    _StorageService_GetManifest_Handler,
 		},
+		{
+			MethodName: "Stat",
+			Handler:    _StorageService_Stat_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _StorageService_Delete_Handler,
+		},
+		{
+			MethodName: "Move",
+			Handler:    _StorageService_Move_Handler,
+		},
+		{
+			MethodName: "Copy",
+			Handler:    _StorageService_Copy_Handler,
+		},
+		{
+			MethodName: "GetUsage",
+			Handler:    _StorageService_GetUsage_Handler,
+		},
+		{
+			MethodName: "CreateShareLink",
+			Handler:    _StorageService_CreateShareLink_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -235,11 +838,31 @@ var StorageService_ServiceDesc = grpc.ServiceDesc{
 			Handler:       _StorageService_Upload_Handler,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "BeginSync",
+			Handler:       _StorageService_BeginSync_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "GetTree",
+			Handler:       _StorageService_GetTree_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "GetSignatures",
+			Handler:       _StorageService_GetSignatures_Handler,
+			ServerStreams: true,
+		},
 		{
 			StreamName:    "Download",
 			Handler:       _StorageService_Download_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "ListEntries",
+			Handler:       _StorageService_ListEntries_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "filesystem/filesystem.proto",
 }
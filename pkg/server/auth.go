@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"strings"
+
+	"github.com/RGood/fs-xfer/pkg/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// downloadMethod is the full name of the Download RPC, which accepts share links in place of bearer tokens.
+const downloadMethod = "/filesystem.StorageService/Download"
+
+// UnaryAuthInterceptor rejects unary calls without a bearer token that a accepts, and passes the principal it authenticates to the handler.
+func UnaryAuthInterceptor(a auth.Authenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := authenticate(ctx, a)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamAuthInterceptor rejects streams without a bearer token that a accepts, and passes the principal it authenticates to the handler.
+func StreamAuthInterceptor(a auth.Authenticator) grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		// Downloads may present a share link instead, which Download checks itself
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		if info.FullMethod == downloadMethod && len(md.Get("authorization")) == 0 {
+			ctx := context.WithValue(stream.Context(), withoutCredentialsKey{}, true)
+			return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+		}
+
+		ctx, err := authenticate(stream.Context(), a)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+// authenticate checks the bearer token in the call's authorization metadata and returns ctx carrying its principal.
+func authenticate(ctx context.Context, a auth.Authenticator) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+
+	token, ok := strings.CutPrefix(values[0], "Bearer ")
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "authorization is not a bearer token")
+	}
+
+	principal, err := a.Authenticate(token)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return ContextWithPrincipal(ctx, principal), nil
+}
+
+type withoutCredentialsKey struct{}
+
+// withoutCredentials reports whether the auth interceptors let a call through without a bearer token, which it must make up for with a share link.
+func withoutCredentials(ctx context.Context) bool {
+	without, _ := ctx.Value(withoutCredentialsKey{}).(bool)
+	return without
+}
+
+// authenticatedStream is a server stream whose context carries the principal of the client.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
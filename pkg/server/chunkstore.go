@@ -0,0 +1,809 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RGood/fs-xfer/pkg/backend"
+	"github.com/RGood/fs-xfer/pkg/codec"
+	"github.com/RGood/fs-xfer/pkg/files"
+	filesystem "github.com/RGood/fs-xfer/pkg/generated/filesystem"
+	"github.com/google/uuid"
+)
+
+const (
+	minChunkSize = 16 * 1024  // 16 KiB
+	maxChunkSize = 256 * 1024 // 256 KiB
+	// chunkMask gives content-defined chunks an average size of 64 KiB.
+	chunkMask = uint64(0xffff) << 48
+	// maxLinkHops bounds the number of symlinks followed while opening a packed file.
+	maxLinkHops = 40
+)
+
+// Types of manifest entries other than regular files
+const (
+	dirEntry     = "dir"
+	symlinkEntry = "symlink"
+	linkEntry    = "link"
+)
+
+// gear holds the random values the content-defined chunker hashes bytes with.
+var gear = func() (table [256]uint64) {
+	// splitmix64, so every server cuts identical content at identical points
+	seed := uint64(0x9e3779b97f4a7c15)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// ChunkStore keeps the contents of uploads as content-defined chunks, each stored once under its SHA-256.
+// Every upload has a manifest listing the chunks of its files. Chunks are reference counted so deleting
+// an upload only frees the chunks no other upload uses.
+type ChunkStore struct {
+	b backend.Backend
+	// compression is the codec new chunks are compressed with at rest, at compressionLevel.
+	compression      filesystem.Compression
+	compressionLevel int
+
+	mu        sync.Mutex
+	manifests map[string]*manifest
+	refs      map[string]int
+	// codecs holds the codec of every chunk stored compressed.
+	codecs map[string]filesystem.Compression
+}
+
+// ChunkStoreOption configures optional ChunkStore behavior.
+type ChunkStoreOption func(*ChunkStore)
+
+// WithChunkCompression compresses new chunks at rest with the codec at level, where zero picks the codec's default.
+// Chunks that don't shrink are stored as is. Chunks are decompressed transparently when read.
+func WithChunkCompression(c filesystem.Compression, level int) ChunkStoreOption {
+	return func(s *ChunkStore) {
+		s.compression, s.compressionLevel = c, level
+	}
+}
+
+type manifest struct {
+	Created int64           `json:"created"`
+	Files   []*manifestFile `json:"files"`
+
+	// files and dirs index the manifest by path once it is loaded.
+	files map[string]*manifestFile
+	dirs  map[string][]fs.DirEntry
+}
+
+type manifestFile struct {
+	Path  string      `json:"path"`
+	Size  int64       `json:"size"`
+	Mode  fs.FileMode `json:"mode"`
+	Mtime int64       `json:"mtime"`
+	Owner *fileOwner  `json:"owner,omitempty"`
+	// Type is empty for regular files. Empty directories, symlinks and hardlinks have no chunks.
+	Type string `json:"type,omitempty"`
+	// Target is what a symlink points at, or the path of the file a hardlink shares its content with.
+	Target string     `json:"target,omitempty"`
+	Chunks []chunkRef `json:"chunks"`
+
+	// starts holds the offset of each chunk within the file once the manifest is loaded.
+	starts []int64
+	// content is the file holding the chunks of a hardlink, and linkID is shared by a file and its hardlinks.
+	content *manifestFile
+	linkID  string
+}
+
+type fileOwner struct {
+	Uid uint32 `json:"uid"`
+	Gid uint32 `json:"gid"`
+}
+
+// ownership converts the owner to the form packed files report it in.
+func (o *fileOwner) ownership() *filesystem.Ownership {
+	if o == nil {
+		return nil
+	}
+	return &filesystem.Ownership{Uid: o.Uid, Gid: o.Gid}
+}
+
+type chunkRef struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// NewChunkStore opens the chunk store kept in b, creating it if needed.
+// Chunks that no manifest refers to, left behind by an interrupted ingest, are removed.
+func NewChunkStore(b backend.Backend, opts ...ChunkStoreOption) (*ChunkStore, error) {
+	c := &ChunkStore{
+		b:         b,
+		manifests: map[string]*manifest{},
+		refs:      map[string]int{},
+		codecs:    map[string]filesystem.Compression{},
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+	if !codec.IsSupported(c.compression) && c.compression != filesystem.Compression_UNCOMPRESSED {
+		return nil, fmt.Errorf("unsupported compression: %v", c.compression)
+	}
+
+	for _, sub := range []string{"chunks", "manifests"} {
+		if err := b.MkdirAll(sub); err != nil {
+			return nil, err
+		}
+	}
+
+	entries, err := b.ReadDir("manifests")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			b.Remove(path.Join("manifests", entry.Name()))
+			continue
+		}
+
+		data, err := fs.ReadFile(b, path.Join("manifests", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m := &manifest{}
+		if err := json.Unmarshal(data, m); err != nil {
+			return nil, fmt.Errorf("could not read manifest of %s: %v", id, err)
+		}
+		m.index()
+
+		c.manifests[id] = m
+		for _, f := range m.Files {
+			for _, chunk := range f.Chunks {
+				c.refs[chunk.Hash]++
+			}
+		}
+	}
+
+	err = fs.WalkDir(b, "chunks", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		hash, compression := chunkName(d.Name())
+		if c.refs[hash] == 0 {
+			return b.Remove(name)
+		}
+		if compression != filesystem.Compression_UNCOMPRESSED {
+			c.codecs[hash] = compression
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Has reports whether the upload is stored in the chunk store.
+func (c *ChunkStore) Has(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.manifests[id]
+	return ok
+}
+
+// Uploads returns the ids of the uploads stored in the chunk store.
+func (c *ChunkStore) Uploads() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ids := make([]string, 0, len(c.manifests))
+	for id := range c.manifests {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Ingest stores the regular files, empty directories, symlinks and hardlinks under the directory dir of fsys as upload id,
+// replacing any previous version of it. fsys must implement fs.ReadLinkFS. It returns the number of bytes that weren't already in the store.
+func (c *ChunkStore) Ingest(id string, fsys fs.FS, dir string) (int64, error) {
+	m := &manifest{Created: time.Now().UnixNano()}
+	var added int64
+	// links maps the LinkID of each file stored so far to its path
+	links := map[any]string{}
+
+	err := fs.WalkDir(fsys, dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == dir {
+			return err
+		}
+
+		var empty bool
+		switch {
+		case d.IsDir():
+			entries, err := fs.ReadDir(fsys, name)
+			if err != nil || len(entries) > 0 {
+				return err
+			}
+			empty = true
+		case d.Type()&fs.ModeSymlink == 0 && !d.Type().IsRegular():
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		f := &manifestFile{
+			Path:  strings.TrimPrefix(name, dir+"/"),
+			Size:  info.Size(),
+			Mode:  info.Mode().Perm(),
+			Mtime: info.ModTime().UnixNano(),
+		}
+		if owner := files.Owner(info); owner != nil {
+			f.Owner = &fileOwner{Uid: owner.GetUid(), Gid: owner.GetGid()}
+		}
+		m.Files = append(m.Files, f)
+
+		switch {
+		case empty:
+			f.Type, f.Size = dirEntry, 0
+			return nil
+		case d.Type()&fs.ModeSymlink != 0:
+			f.Type = symlinkEntry
+			f.Target, err = fs.ReadLink(fsys, name)
+			return err
+		}
+
+		if linkID := files.LinkID(info); linkID != nil {
+			if first, ok := links[linkID]; ok {
+				f.Type, f.Target = linkEntry, first
+				return nil
+			}
+			links[linkID] = f.Path
+		}
+
+		n, err := c.ingestFile(fsys, name, f)
+		added += n
+		return err
+	})
+	if err == nil {
+		err = c.writeManifest(id, m)
+	}
+	if err != nil {
+		// Drop the references taken by the chunks that were stored
+		c.mu.Lock()
+		c.release(m)
+		c.mu.Unlock()
+		return 0, err
+	}
+
+	m.index()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old, ok := c.manifests[id]; ok {
+		c.release(old)
+	}
+	c.manifests[id] = m
+
+	return added, nil
+}
+
+// ingestFile splits the file called name into chunks, storing the ones the store doesn't have yet.
+func (c *ChunkStore) ingestFile(fsys fs.FS, name string, f *manifestFile) (int64, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var added int64
+	buf := make([]byte, maxChunkSize)
+	n := 0
+	eof := false
+
+	for {
+		if !eof {
+			read, err := io.ReadFull(file, buf[n:])
+			n += read
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return added, err
+			}
+		}
+
+		if n == 0 {
+			return added, nil
+		}
+
+		cut := cutPoint(buf[:n])
+		sum := sha256.Sum256(buf[:cut])
+		ref := chunkRef{Hash: hex.EncodeToString(sum[:]), Size: int64(cut)}
+
+		stored, err := c.putChunk(ref.Hash, buf[:cut])
+		if err != nil {
+			return added, err
+		}
+		if stored {
+			added += ref.Size
+		}
+		f.Chunks = append(f.Chunks, ref)
+
+		n = copy(buf, buf[cut:n])
+	}
+}
+
+// cutPoint returns the length of the content-defined chunk at the start of data.
+// data must hold maxChunkSize bytes unless it is the end of the file.
+func cutPoint(data []byte) int {
+	if len(data) <= minChunkSize {
+		return len(data)
+	}
+
+	n := min(len(data), maxChunkSize)
+	var h uint64
+	for i := minChunkSize; i < n; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// putChunk takes a reference to the chunk, writing it if the store doesn't have it yet.
+func (c *ChunkStore) putChunk(hash string, data []byte) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.refs[hash] > 0 {
+		c.refs[hash]++
+		return false, nil
+	}
+
+	compression := filesystem.Compression_UNCOMPRESSED
+	if c.compression != filesystem.Compression_UNCOMPRESSED {
+		compressed, err := codec.Compress(c.compression, c.compressionLevel, data)
+		if err != nil {
+			return false, err
+		}
+		if len(compressed) < len(data) {
+			data, compression = compressed, c.compression
+		}
+	}
+
+	if err := writeAtomic(c.b, c.chunkPath(hash, compression), data); err != nil {
+		return false, err
+	}
+
+	c.refs[hash]++
+	if compression != filesystem.Compression_UNCOMPRESSED {
+		c.codecs[hash] = compression
+	}
+	return true, nil
+}
+
+// readChunk returns the content of the chunk, decompressing it if it is stored compressed.
+func (c *ChunkStore) readChunk(hash string) ([]byte, error) {
+	c.mu.Lock()
+	compression := c.codecs[hash]
+	c.mu.Unlock()
+
+	data, err := fs.ReadFile(c.b, c.chunkPath(hash, compression))
+	if err != nil {
+		return nil, err
+	}
+	return codec.Decompress(compression, data)
+}
+
+// release drops the manifest's references to its chunks, deleting chunks that are no longer used.
+// c.mu must be held.
+func (c *ChunkStore) release(m *manifest) {
+	for _, f := range m.Files {
+		for _, chunk := range f.Chunks {
+			if c.refs[chunk.Hash]--; c.refs[chunk.Hash] <= 0 {
+				c.b.Remove(c.chunkPath(chunk.Hash, c.codecs[chunk.Hash]))
+				delete(c.refs, chunk.Hash)
+				delete(c.codecs, chunk.Hash)
+			}
+		}
+	}
+}
+
+// Delete removes the upload from the store along with the chunks only it used.
+func (c *ChunkStore) Delete(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m, ok := c.manifests[id]
+	if !ok {
+		return fs.ErrNotExist
+	}
+
+	if err := c.b.Remove(c.manifestPath(id)); err != nil {
+		return err
+	}
+
+	delete(c.manifests, id)
+	c.release(m)
+	return nil
+}
+
+// Extract writes the files of the upload to the directory dir of b.
+func (c *ChunkStore) Extract(id string, b backend.Backend, dir string) error {
+	m, ok := c.open(id)
+	if !ok {
+		return fs.ErrNotExist
+	}
+
+	if err := b.MkdirAll(dir); err != nil {
+		return err
+	}
+
+	for _, f := range m.Files {
+		if err := c.extractFile(f, b, dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// extractFile writes the manifest entry to its place under the directory dir of b.
+// Hardlinks are extracted after the file they link to, as they follow it in the manifest.
+func (c *ChunkStore) extractFile(f *manifestFile, b backend.Backend, dir string) error {
+	target := path.Join(dir, f.Path)
+	md := &filesystem.FileMetadata{Mode: uint32(f.Mode), Mtime: f.Mtime, Owner: f.Owner.ownership()}
+
+	switch f.Type {
+	case dirEntry:
+		if err := b.MkdirAll(target); err != nil {
+			return err
+		}
+		return applyMetadata(b, target, md)
+	case symlinkEntry:
+		return b.Symlink(f.Target, target)
+	case linkEntry:
+		return b.Link(path.Join(dir, f.Target), target)
+	}
+
+	out, err := b.Create(target, true)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(io.NewOffsetWriter(out, 0), &packedFile{store: c, file: f}); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return applyMetadata(b, target, md)
+}
+
+// open returns the manifest of the upload, which doubles as a read-only view of its files.
+func (c *ChunkStore) open(id string) (*manifest, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m, ok := c.manifests[id]
+	return m, ok
+}
+
+func (c *ChunkStore) writeManifest(id string, m *manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(c.b, c.manifestPath(id), data)
+}
+
+// chunkPath returns where a chunk is stored. Compressed chunks carry their codec's extension.
+func (c *ChunkStore) chunkPath(hash string, compression filesystem.Compression) string {
+	return path.Join("chunks", hash[:2], hash+codec.Extension(compression))
+}
+
+// chunkName splits the file name of a stored chunk into its hash and codec.
+func chunkName(name string) (string, filesystem.Compression) {
+	for _, compression := range codec.Supported {
+		if hash, ok := strings.CutSuffix(name, codec.Extension(compression)); ok {
+			return hash, compression
+		}
+	}
+	return name, filesystem.Compression_UNCOMPRESSED
+}
+
+func (c *ChunkStore) manifestPath(id string) string {
+	return path.Join("manifests", id+".json")
+}
+
+// writeAtomic writes data to a temporary file and renames it into place so readers never see a partial file.
+func writeAtomic(b backend.Backend, target string, data []byte) error {
+	tmp := path.Join(path.Dir(target), ".tmp-"+uuid.NewString())
+	w, err := b.Create(tmp, true)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.WriteAt(data, 0); err != nil {
+		w.Close()
+		b.Remove(tmp)
+		return err
+	}
+	if err := w.Close(); err != nil {
+		b.Remove(tmp)
+		return err
+	}
+
+	return b.Rename(tmp, target)
+}
+
+// index builds the lookup tables used to serve the manifest as a file system.
+func (m *manifest) index() {
+	m.files = map[string]*manifestFile{}
+	m.dirs = map[string][]fs.DirEntry{".": nil}
+
+	for _, f := range m.Files {
+		f.starts = make([]int64, len(f.Chunks))
+		for i := 1; i < len(f.Chunks); i++ {
+			f.starts[i] = f.starts[i-1] + f.Chunks[i-1].Size
+		}
+
+		m.files[f.Path] = f
+		if f.Type == linkEntry {
+			if first, ok := m.files[f.Target]; ok {
+				f.content, f.linkID, first.linkID = first, first.Path, first.Path
+			}
+		}
+	}
+
+	for _, f := range m.Files {
+		if _, ok := m.dirs[f.Path]; !ok && f.Type == dirEntry {
+			m.dirs[f.Path] = nil
+		}
+		m.addEntry(path.Dir(f.Path), f.info())
+	}
+
+	for _, entries := range m.dirs {
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Name() < entries[j].Name()
+		})
+	}
+}
+
+// addEntry adds an entry to dir, creating dir and its parents as needed.
+func (m *manifest) addEntry(dir string, info *packedInfo) {
+	_, exists := m.dirs[dir]
+	m.dirs[dir] = append(m.dirs[dir], fs.FileInfoToDirEntry(info))
+
+	if !exists && dir != "." {
+		m.addEntry(path.Dir(dir), &packedInfo{name: path.Base(dir), mode: fs.ModeDir | 0755, mtime: m.Created})
+	}
+}
+
+// fsFor returns the upload as a read-only file system. Its files support random access.
+func (c *ChunkStore) fsFor(m *manifest) fs.FS {
+	return &packedFS{store: c, manifest: m}
+}
+
+type packedFS struct {
+	store    *ChunkStore
+	manifest *manifest
+}
+
+// Open follows a symlink at the end of name. Symlinks to directories aren't followed when they appear earlier in a name.
+func (p *packedFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	resolved := name
+	for hops := 0; ; hops++ {
+		f, ok := p.manifest.files[resolved]
+		if !ok || f.Type != symlinkEntry {
+			break
+		}
+
+		target := path.Join(path.Dir(resolved), f.Target)
+		if hops == maxLinkHops || path.IsAbs(f.Target) || !fs.ValidPath(target) {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		resolved = target
+	}
+
+	info, err := p.lstat("open", resolved)
+	if err != nil {
+		return nil, err
+	}
+	info.name = path.Base(name)
+
+	if info.IsDir() {
+		return &packedDir{info: info, entries: p.manifest.dirs[resolved]}, nil
+	}
+	file := p.manifest.files[resolved]
+	if file.content != nil {
+		file = file.content
+	}
+	return &packedFile{store: p.store, file: file, info: info}, nil
+}
+
+func (p *packedFS) Lstat(name string) (fs.FileInfo, error) {
+	return p.lstat("lstat", name)
+}
+
+func (p *packedFS) ReadLink(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	f, ok := p.manifest.files[name]
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrNotExist}
+	} else if f.Type != symlinkEntry {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return f.Target, nil
+}
+
+func (p *packedFS) lstat(op string, name string) (*packedInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	if f, ok := p.manifest.files[name]; ok {
+		return f.info(), nil
+	}
+	if _, ok := p.manifest.dirs[name]; ok {
+		return &packedInfo{name: path.Base(name), mode: fs.ModeDir | 0755, mtime: p.manifest.Created}, nil
+	}
+	return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// packedFile reads a file's content back out of its chunks.
+type packedFile struct {
+	store *ChunkStore
+	file  *manifestFile
+	info  *packedInfo
+	pos   int64
+
+	// The most recently read chunk
+	cached     int
+	cachedData []byte
+}
+
+func (f *packedFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *packedFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *packedFile) ReadAt(p []byte, off int64) (int, error) {
+	starts := f.file.starts
+
+	// Find the chunk holding off, then copy from it and the chunks after it
+	i := sort.Search(len(starts), func(i int) bool { return starts[i] > off }) - 1
+
+	var n int
+	for ; i >= 0 && i < len(starts) && n < len(p); i++ {
+		data, err := f.chunk(i)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data[off+int64(n)-starts[i]:])
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *packedFile) chunk(i int) ([]byte, error) {
+	if f.cachedData != nil && f.cached == i {
+		return f.cachedData, nil
+	}
+
+	data, err := f.store.readChunk(f.file.Chunks[i].Hash)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("chunk %s of %s is missing from the store", f.file.Chunks[i].Hash, f.file.Path)
+	} else if err != nil {
+		return nil, err
+	}
+
+	f.cached, f.cachedData = i, data
+	return data, nil
+}
+
+func (f *packedFile) Close() error {
+	f.cachedData = nil
+	return nil
+}
+
+type packedDir struct {
+	info    *packedInfo
+	entries []fs.DirEntry
+	read    int
+}
+
+func (d *packedDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *packedDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+func (d *packedDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.read:]
+	if n > 0 {
+		if len(remaining) == 0 {
+			return nil, io.EOF
+		}
+		remaining = remaining[:min(n, len(remaining))]
+	}
+
+	d.read += len(remaining)
+	return remaining, nil
+}
+
+func (d *packedDir) Close() error {
+	return nil
+}
+
+func (f *manifestFile) info() *packedInfo {
+	info := &packedInfo{name: path.Base(f.Path), size: f.Size, mode: f.Mode, mtime: f.Mtime, sys: &files.Sys{Owner: f.Owner.ownership()}}
+	switch f.Type {
+	case dirEntry:
+		info.mode |= fs.ModeDir
+	case symlinkEntry:
+		info.mode |= fs.ModeSymlink
+	}
+	if f.linkID != "" {
+		info.sys.LinkID = f.linkID
+	}
+	return info
+}
+
+type packedInfo struct {
+	name  string
+	size  int64
+	mode  fs.FileMode
+	mtime int64
+	sys   *files.Sys
+}
+
+func (i *packedInfo) Name() string       { return i.name }
+func (i *packedInfo) Size() int64        { return i.size }
+func (i *packedInfo) Mode() fs.FileMode  { return i.mode }
+func (i *packedInfo) ModTime() time.Time { return time.Unix(0, i.mtime) }
+func (i *packedInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *packedInfo) Sys() any           { return i.sys }
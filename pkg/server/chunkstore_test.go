@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"maps"
+	"math/rand/v2"
+	"path"
+	"slices"
+	"testing"
+
+	"github.com/RGood/fs-xfer/pkg/backend"
+	filesystem "github.com/RGood/fs-xfer/pkg/generated/filesystem"
+)
+
+// randomBytes returns n pseudo-random bytes, the same for the same seed.
+func randomBytes(seed byte, n int) []byte {
+	data := make([]byte, n)
+	rand.NewChaCha8([32]byte{seed}).Read(data)
+	return data
+}
+
+// checkRefs fails unless every chunk is counted once for each reference the store's manifests hold to it,
+// and exactly the referenced chunks are stored in b.
+func checkRefs(t *testing.T, c *ChunkStore, b backend.Backend) {
+	t.Helper()
+
+	want := map[string]int{}
+	for _, m := range c.manifests {
+		for _, f := range m.Files {
+			for _, chunk := range f.Chunks {
+				want[chunk.Hash]++
+			}
+		}
+	}
+	if !maps.Equal(c.refs, want) {
+		t.Fatalf("store counts %d references to %d chunks, manifests hold %d references to %d", sum(c.refs), len(c.refs), sum(want), len(want))
+	}
+
+	stored := map[string]bool{}
+	err := fs.WalkDir(b, "chunks", func(name string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			hash, _ := chunkName(d.Name())
+			stored[hash] = true
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(slices.Sorted(maps.Keys(stored)), slices.Sorted(maps.Keys(want))) {
+		t.Fatalf("%d chunks are stored, %d are referenced", len(stored), len(want))
+	}
+
+	// Counts must come out the same when the store is opened again
+	reopened, err := NewChunkStore(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(reopened.refs, want) {
+		t.Fatalf("reopened store counts %d references to %d chunks, want %d to %d", sum(reopened.refs), len(reopened.refs), sum(want), len(want))
+	}
+}
+
+func sum(refs map[string]int) int {
+	n := 0
+	for _, count := range refs {
+		n += count
+	}
+	return n
+}
+
+func TestChunkStoreRefs(t *testing.T) {
+	for _, compression := range []filesystem.Compression{filesystem.Compression_UNCOMPRESSED, filesystem.Compression_ZSTD} {
+		t.Run(compression.String(), func(t *testing.T) {
+			testChunkStoreRefs(t, compression)
+		})
+	}
+}
+
+func testChunkStoreRefs(t *testing.T, compression filesystem.Compression) {
+	shared := randomBytes(1, 3*maxChunkSize)
+	extra := randomBytes(2, maxChunkSize)
+	contents := map[string]map[string][]byte{
+		"a": {"x": shared},
+		"b": {"x": shared, "sub/y": shared, "small": []byte("small")},
+		"c": {"x": append(slices.Clone(shared), extra...)},
+		"d": {"x": []byte("small")},
+	}
+	src := backend.NewMemory()
+	for dir, files := range contents {
+		for name, data := range files {
+			writeTestFile(t, src, path.Join(dir, name), data)
+		}
+	}
+
+	b := backend.NewMemory()
+	c, err := NewChunkStore(b, WithChunkCompression(compression, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// uploads maps the ids of the uploads stored so far to the directory of src they were ingested from
+	uploads := map[string]string{}
+	steps := []struct {
+		name string
+		// Ingest dir as id, or delete id if dir is empty
+		id, dir string
+		// minAdded and maxAdded bound the bytes the step adds to the store, and err is the error it fails with.
+		minAdded, maxAdded int64
+		err                error
+	}{
+		{"new content", "one", "a", int64(len(shared)), int64(len(shared)), nil},
+		{"content stored twice", "two", "b", 5, 5, nil},
+		{"content shared in part", "three", "c", int64(len(extra)), int64(len(extra) + maxChunkSize), nil},
+		{"upload ingested again", "one", "a", 0, 0, nil},
+		{"upload replaced", "two", "d", 0, 0, nil},
+		{"delete one sharer", "one", "", 0, 0, nil},
+		{"delete another sharer", "three", "", 0, 0, nil},
+		{"ingest after chunks were freed", "one", "a", int64(len(shared)), int64(len(shared)), nil},
+		{"delete", "one", "", 0, 0, nil},
+		{"delete again", "one", "", 0, 0, fs.ErrNotExist},
+		{"delete last", "two", "", 0, 0, nil},
+	}
+	for _, step := range steps {
+		var added int64
+		if step.dir != "" {
+			added, err = c.Ingest(step.id, src, step.dir)
+			uploads[step.id] = step.dir
+		} else {
+			err = c.Delete(step.id)
+			delete(uploads, step.id)
+		}
+		if !errors.Is(err, step.err) {
+			t.Fatalf("%s: got error %v, want %v", step.name, err, step.err)
+		}
+		if added < step.minAdded || added > step.maxAdded {
+			t.Fatalf("%s: added %d bytes, want %d to %d", step.name, added, step.minAdded, step.maxAdded)
+		}
+
+		checkRefs(t, c, b)
+		for _, id := range []string{"one", "two", "three"} {
+			if _, ok := uploads[id]; c.Has(id) != ok {
+				t.Fatalf("%s: store has %s is %t, want %t", step.name, id, c.Has(id), ok)
+			}
+		}
+
+		// Whatever a step freed, the uploads left must still be whole
+		for id, dir := range uploads {
+			out := backend.NewMemory()
+			if err := c.Extract(id, out, "out"); err != nil {
+				t.Fatalf("%s: could not extract %s: %v", step.name, id, err)
+			}
+			for name, data := range contents[dir] {
+				if got, err := fs.ReadFile(out, path.Join("out", name)); err != nil || !bytes.Equal(got, data) {
+					t.Fatalf("%s: %s of %s reads %d bytes and error %v, want %d bytes", step.name, name, id, len(got), err, len(data))
+				}
+			}
+		}
+	}
+
+	if len(c.refs) != 0 {
+		t.Fatalf("%d chunks left after every upload was deleted", len(c.refs))
+	}
+}
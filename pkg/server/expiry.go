@@ -0,0 +1,256 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// expiryDir holds a record for every upload with a time to live, named after the digest of the upload's path.
+const expiryDir = ".expiry"
+
+// defaultJanitorInterval is how often the janitor looks for expired uploads unless WithJanitorInterval says otherwise.
+const defaultJanitorInterval = time.Minute
+
+// defaultSessionTimeout is how long upload sessions may sit idle unless WithSessionTimeout says otherwise.
+const defaultSessionTimeout = 24 * time.Hour
+
+// expiry records when the upload at path is deleted.
+type expiry struct {
+	Path string `json:"path"`
+	// Expires is in nanoseconds since the Unix epoch.
+	Expires int64 `json:"expires"`
+}
+
+// expiryName returns where the expiry record of the upload at name is stored.
+func expiryName(name string) string {
+	digest := sha256.Sum256([]byte(name))
+	return path.Join(expiryDir, hex.EncodeToString(digest[:])+".json")
+}
+
+// ttl picks the time to live of an upload that asked for requested, applying the server's default and maximum.
+func (s *StorageService) ttl(requested time.Duration) time.Duration {
+	if requested <= 0 {
+		requested = s.defaultTTL
+	}
+	if s.maxTTL > 0 && (requested <= 0 || requested > s.maxTTL) {
+		requested = s.maxTTL
+	}
+	return requested
+}
+
+// setExpiry records when the upload committed by the session expires. s.expiryMu must be held.
+// Uploads that weren't merged into what was already there drop any earlier record of their destination and what was under it.
+func (s *StorageService) setExpiry(u *uploadSession, merged bool) error {
+	if !merged {
+		if err := s.dropExpiry(u.dest); err != nil {
+			return err
+		}
+	}
+	if u.ttl <= 0 {
+		return nil
+	}
+
+	expires := time.Now().Add(u.ttl)
+	if err := s.writeExpiry(expiry{Path: u.dest, Expires: expires.UnixNano()}); err != nil {
+		return err
+	}
+
+	fmt.Printf("Upload %s expires at %s\n", u.dest, expires.Format(time.RFC3339))
+	return nil
+}
+
+// writeExpiry stores the record e, replacing any earlier record of its path. s.expiryMu must be held.
+func (s *StorageService) writeExpiry(e expiry) error {
+	data, err := json.Marshal(&e)
+	if err != nil {
+		return err
+	}
+	if err := s.backend.MkdirAll(expiryDir); err != nil {
+		return err
+	}
+	return writeAtomic(s.backend, expiryName(e.Path), data)
+}
+
+// readExpiry returns every expiry record, keyed by where it's stored. s.expiryMu must be held.
+func (s *StorageService) readExpiry() (map[string]expiry, error) {
+	entries, err := s.backend.ReadDir(expiryDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	records := map[string]expiry{}
+	for _, entry := range entries {
+		name := path.Join(expiryDir, entry.Name())
+		data, err := fs.ReadFile(s.backend, name)
+		if err != nil {
+			return nil, err
+		}
+
+		var e expiry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return nil, fmt.Errorf("invalid record %s: %v", name, err)
+		}
+		records[name] = e
+	}
+	return records, nil
+}
+
+// within reports whether name is dir or something under it.
+func within(name string, dir string) bool {
+	return name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+// dropExpiry removes the records of name and of everything under it, once they're gone. s.expiryMu must be held.
+func (s *StorageService) dropExpiry(name string) error {
+	records, err := s.readExpiry()
+	if err != nil {
+		return err
+	}
+
+	for recordName, e := range records {
+		if within(e.Path, name) {
+			if err := s.backend.Remove(recordName); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// moveExpiry carries the records of src and of everything under it over to dst, keeping them at src as well if keep is set.
+// dst also expires no later than any upload src was in, so moving or copying something out of an upload doesn't outlive it.
+// s.expiryMu must be held.
+func (s *StorageService) moveExpiry(src string, dst string, keep bool) error {
+	// Nothing was at dst, so whatever records it has are left over
+	if err := s.dropExpiry(dst); err != nil {
+		return err
+	}
+	records, err := s.readExpiry()
+	if err != nil {
+		return err
+	}
+
+	var inherited int64
+	for recordName, e := range records {
+		// The record of src itself, or of an upload it's in
+		if within(src, e.Path) {
+			if inherited == 0 || e.Expires < inherited {
+				inherited = e.Expires
+			}
+			continue
+		}
+		if !within(e.Path, src) {
+			continue
+		}
+
+		if err := s.writeExpiry(expiry{Path: dst + strings.TrimPrefix(e.Path, src), Expires: e.Expires}); err != nil {
+			return err
+		}
+		if !keep {
+			if err := s.backend.Remove(recordName); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+	}
+
+	if inherited == 0 {
+		return nil
+	}
+	if err := s.writeExpiry(expiry{Path: dst, Expires: inherited}); err != nil {
+		return err
+	}
+	if !keep {
+		if err := s.backend.Remove(expiryName(src)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// janitor deletes expired uploads and discards abandoned sessions every interval until the service is closed.
+func (s *StorageService) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.expire()
+		s.reapSessions()
+
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expire deletes every upload whose time to live has run out, along with its record.
+func (s *StorageService) expire() {
+	entries, err := s.backend.ReadDir(expiryDir)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			fmt.Printf("Could not read upload expiry records: %v\n", err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		if err := s.expireRecord(path.Join(expiryDir, entry.Name())); err != nil {
+			fmt.Printf("Could not expire upload: %v\n", err)
+		}
+	}
+}
+
+// expireRecord deletes the upload the record at name is about, if it has expired.
+// Uploads with an open session are left for a later pass.
+func (s *StorageService) expireRecord(name string) error {
+	s.expiryMu.Lock()
+	defer s.expiryMu.Unlock()
+
+	// The record is read under the lock, as a commit may have replaced it since it was listed
+	data, err := fs.ReadFile(s.backend, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var e expiry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return fmt.Errorf("invalid record %s: %v", name, err)
+	}
+	if time.Now().UnixNano() < e.Expires {
+		return nil
+	}
+
+	upload, err := s.getName(e.Path)
+	if err != nil {
+		return fmt.Errorf("invalid record %s: %v", name, err)
+	}
+	// Expired uploads are deleted whatever the policy allows
+	err = s.remove(upload, true)
+	switch status.Code(err) {
+	case codes.OK:
+		fmt.Printf("Deleted expired upload: %s\n", e.Path)
+	case codes.NotFound:
+		// Deleted by a client before it expired
+	default:
+		return fmt.Errorf("could not delete %s: %v", e.Path, err)
+	}
+	if err := s.backend.Remove(name); err != nil {
+		return err
+	}
+	return s.dropExpiry(upload)
+}
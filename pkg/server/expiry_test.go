@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	filesystem "github.com/RGood/fs-xfer/pkg/generated/filesystem"
+)
+
+// expiresAt returns when the record of the upload at name says it expires, and whether it has one.
+func expiresAt(t *testing.T, s *StorageService, name string) (time.Time, bool) {
+	t.Helper()
+
+	s.expiryMu.Lock()
+	defer s.expiryMu.Unlock()
+
+	records, err := s.readExpiry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, ok := records[expiryName(name)]
+	return time.Unix(0, e.Expires), ok
+}
+
+// commitWithTTL uploads a file called a holding data in a session that asks for ttl, and returns the upload's path.
+func commitWithTTL(t *testing.T, c filesystem.StorageServiceClient, ttl time.Duration, data string) string {
+	t.Helper()
+
+	ctx := context.Background()
+	session, err := c.BeginUpload(ctx, &filesystem.BeginUploadRequest{TtlSeconds: int64(ttl / time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := uploadChunks(c, session.GetId(), &filesystem.File{Name: "a", Data: []byte(data)}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.CommitUpload(ctx, &filesystem.CommitUploadRequest{Id: session.GetId()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.GetId()
+}
+
+func TestUploadTTLLimits(t *testing.T) {
+	tests := []struct {
+		name               string
+		defaultTTL, maxTTL time.Duration
+		requested, want    time.Duration
+	}{
+		{"no limits", 0, 0, 0, 0},
+		{"requested", 0, 0, time.Hour, time.Hour},
+		{"default", 2 * time.Hour, 0, 0, 2 * time.Hour},
+		{"requested over the default", 2 * time.Hour, 0, 3 * time.Hour, 3 * time.Hour},
+		{"capped", 0, time.Hour, 3 * time.Hour, time.Hour},
+		{"default capped", 2 * time.Hour, time.Hour, 0, time.Hour},
+		{"cap without a request", 0, time.Hour, 0, time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &StorageService{defaultTTL: tt.defaultTTL, maxTTL: tt.maxTTL}
+			if got := s.ttl(tt.requested); got != tt.want {
+				t.Fatalf("ttl(%s) = %s, want %s", tt.requested, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJanitor(t *testing.T) {
+	s, _ := newTestService(t, WithJanitorInterval(10*time.Millisecond))
+	c := dial(t, s)
+	ctx := context.Background()
+
+	expiring := commitWithTTL(t, c, time.Hour, "expiring")
+	kept := commitWithTTL(t, c, 0, "kept")
+	deleted := commitWithTTL(t, c, time.Hour, "deleted")
+
+	expires, ok := expiresAt(t, s, expiring)
+	if !ok || expires.Before(time.Now().Add(59*time.Minute)) || expires.After(time.Now().Add(time.Hour)) {
+		t.Fatalf("upload asking for an hour expires at %s (recorded: %v)", expires, ok)
+	}
+	if _, ok := expiresAt(t, s, kept); ok {
+		t.Fatal("upload without a time to live has an expiry record")
+	}
+
+	// Copies expire along with what they were copied from, and moves take their record along
+	if _, err := c.Copy(ctx, &filesystem.CopyRequest{Source: expiring, Destination: "copied"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Move(ctx, &filesystem.MoveRequest{Source: "copied", Destination: "moved"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := expiresAt(t, s, "moved"); !ok || !got.Equal(expires) {
+		t.Fatalf("moved copy expires at %s (recorded: %v), want %s", got, ok, expires)
+	}
+	if _, ok := expiresAt(t, s, "copied"); ok {
+		t.Fatal("moved copy left its record behind")
+	}
+
+	if _, err := c.Delete(ctx, &filesystem.DeleteRequest{Path: deleted, Recursive: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := expiresAt(t, s, deleted); ok {
+		t.Fatal("deleted upload kept its expiry record")
+	}
+
+	// Run out the clock on the expiring upload and its copy
+	s.expiryMu.Lock()
+	for _, name := range []string{expiring, "moved"} {
+		if err := s.writeExpiry(expiry{Path: name, Expires: time.Now().Add(-time.Second).UnixNano()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.expiryMu.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, expiringLeft := expiresAt(t, s, expiring)
+		_, movedLeft := expiresAt(t, s, "moved")
+		if !expiringLeft && !movedLeft {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("janitor didn't delete the expired uploads")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	checkContent(t, s, map[string][]byte{
+		expiring + "/a": nil,
+		"moved/a":       nil,
+		kept + "/a":     []byte("kept"),
+	})
+}
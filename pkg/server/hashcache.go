@@ -0,0 +1,57 @@
+package server
+
+import (
+	"io/fs"
+	"sync"
+	"time"
+
+	"github.com/RGood/fs-xfer/pkg/files"
+)
+
+// maxCachedHashes bounds the number of digests a hashCache keeps.
+const maxCachedHashes = 100_000
+
+// hashCache remembers the SHA-256 of files by name, size and modification time, so listings don't read unchanged files again.
+type hashCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedHash
+}
+
+type cachedHash struct {
+	size  int64
+	mtime time.Time
+	sum   []byte
+}
+
+func newHashCache() *hashCache {
+	return &hashCache{entries: map[string]cachedHash{}}
+}
+
+// sum returns the digest of the file called name in fsys, whose current info is given, reading it only if it changed since it was last hashed.
+func (c *hashCache) sum(fsys fs.FS, name string, info fs.FileInfo) ([]byte, error) {
+	c.mu.Lock()
+	cached, ok := c.entries[name]
+	c.mu.Unlock()
+
+	if ok && cached.size == info.Size() && cached.mtime.Equal(info.ModTime()) {
+		return cached.sum, nil
+	}
+
+	sum, err := files.HashFS(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Make room by dropping an arbitrary entry
+	if _, ok := c.entries[name]; !ok && len(c.entries) >= maxCachedHashes {
+		for key := range c.entries {
+			delete(c.entries, key)
+			break
+		}
+	}
+	c.entries[name] = cachedHash{size: info.Size(), mtime: info.ModTime(), sum: sum}
+	return sum, nil
+}
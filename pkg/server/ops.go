@@ -0,0 +1,368 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/RGood/fs-xfer/pkg/files"
+	filesystem "github.com/RGood/fs-xfer/pkg/generated/filesystem"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *StorageService) Delete(ctx context.Context, req *filesystem.DeleteRequest) (*filesystem.DeleteResponse, error) {
+	name, err := s.getName(req.GetPath())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, OpDelete, name); err != nil {
+		return nil, err
+	}
+
+	s.expiryMu.Lock()
+	defer s.expiryMu.Unlock()
+
+	if err := s.remove(name, req.GetRecursive()); err != nil {
+		return nil, err
+	}
+	if err := s.dropExpiry(name); err != nil {
+		return nil, err
+	}
+	return &filesystem.DeleteResponse{}, nil
+}
+
+// remove deletes name, and everything in it if recursive. Unlike Delete, it doesn't check the policy,
+// so the server can delete paths no client could.
+func (s *StorageService) remove(name string, recursive bool) error {
+	upload := uploadOf(name)
+
+	// A whole packed upload is dropped from the chunk store without unpacking it first
+	if name == upload && recursive && s.store != nil && s.store.Has(upload) {
+		s.packMu.Lock()
+		defer s.packMu.Unlock()
+
+		if err := s.checkIdle(upload); err != nil {
+			return err
+		}
+		if err := s.store.Delete(upload); err != nil {
+			return err
+		}
+		s.remeasure(upload)
+		return nil
+	}
+
+	err := s.modify([]string{upload}, func() error {
+		info, err := s.backend.Lstat(name)
+		if err != nil {
+			return err
+		}
+
+		if recursive {
+			return s.backend.RemoveAll(name)
+		}
+
+		if info.IsDir() {
+			entries, err := s.backend.ReadDir(name)
+			if err != nil {
+				return err
+			}
+			if len(entries) > 0 {
+				return status.Errorf(codes.FailedPrecondition, "%s is a directory that isn't empty", name)
+			}
+		}
+		return s.backend.Remove(name)
+	})
+	return statusOf(err)
+}
+
+func (s *StorageService) Move(ctx context.Context, req *filesystem.MoveRequest) (*filesystem.MoveResponse, error) {
+	src, dst, err := s.getNames(req.GetSource(), req.GetDestination())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, OpDelete, src); err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, OpWrite, dst); err != nil {
+		return nil, err
+	}
+
+	s.expiryMu.Lock()
+	defer s.expiryMu.Unlock()
+
+	err = s.modify([]string{uploadOf(src), uploadOf(dst)}, func() error {
+		if err := s.checkDestination(src, dst); err != nil {
+			return err
+		}
+		return s.backend.Rename(src, dst)
+	})
+	if err != nil {
+		return nil, statusOf(err)
+	}
+	if err := s.moveExpiry(src, dst, false); err != nil {
+		return nil, err
+	}
+	s.claimMoved(ctx, dst)
+
+	return &filesystem.MoveResponse{}, nil
+}
+
+func (s *StorageService) Copy(ctx context.Context, req *filesystem.CopyRequest) (*filesystem.CopyResponse, error) {
+	src, dst, err := s.getNames(req.GetSource(), req.GetDestination())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, OpRead, src); err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, OpWrite, dst); err != nil {
+		return nil, err
+	}
+
+	s.expiryMu.Lock()
+	defer s.expiryMu.Unlock()
+
+	var size int64
+	err = s.modify([]string{uploadOf(dst)}, func() error {
+		if err := s.checkDestination(src, dst); err != nil {
+			return err
+		}
+
+		var err error
+		size, err = s.copyEntry(ctx, src, dst, map[any]string{})
+		if err != nil {
+			s.backend.RemoveAll(dst)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, statusOf(err)
+	}
+	// Copies expire along with what they were copied from
+	if err := s.moveExpiry(src, dst, true); err != nil {
+		return nil, err
+	}
+	s.claimMoved(ctx, dst)
+
+	return &filesystem.CopyResponse{Size: size}, nil
+}
+
+// claimMoved makes the caller the owner of dst if a move or copy made it a new upload.
+func (s *StorageService) claimMoved(ctx context.Context, dst string) {
+	if uploadOf(dst) != dst {
+		return
+	}
+	if err := s.claim(dst, PrincipalFrom(ctx)); err != nil {
+		fmt.Printf("Could not record the owner of upload %s: %v\n", dst, err)
+	}
+}
+
+// getNames validates the source and destination of a move or copy, neither of which may be inside the other.
+func (s *StorageService) getNames(source string, destination string) (string, string, error) {
+	src, err := s.getName(source)
+	if err != nil {
+		return "", "", err
+	}
+	dst, err := s.getName(destination)
+	if err != nil {
+		return "", "", err
+	}
+
+	if src == dst || strings.HasPrefix(dst, src+"/") || strings.HasPrefix(src, dst+"/") {
+		return "", "", status.Errorf(codes.InvalidArgument, "%s and %s overlap", source, destination)
+	}
+	return src, dst, nil
+}
+
+// checkDestination makes sure src exists, dst doesn't, neither is reached through a symlink, and that no symlink under src
+// would point outside its upload once at dst.
+func (s *StorageService) checkDestination(src string, dst string) error {
+	for _, name := range []string{src, dst} {
+		if err := files.CheckParents(s.fsys, ".", name); err != nil {
+			return status.Error(codes.FailedPrecondition, err.Error())
+		}
+	}
+	if _, err := fs.Lstat(s.fsys, src); err != nil {
+		return err
+	}
+	if _, err := fs.Lstat(s.fsys, dst); err == nil {
+		return status.Errorf(codes.AlreadyExists, "%s already exists", dst)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	upload := uploadOf(dst)
+	return fs.WalkDir(s.fsys, src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.Type()&fs.ModeSymlink == 0 {
+			return err
+		}
+
+		target, err := fs.ReadLink(s.fsys, p)
+		if err != nil {
+			return err
+		}
+
+		resolved := path.Join(path.Dir(path.Join(dst, strings.TrimPrefix(p, src))), target)
+		if path.IsAbs(target) || (resolved != upload && !strings.HasPrefix(resolved, upload+"/")) {
+			return status.Errorf(codes.FailedPrecondition, "symlink %s -> %s would point outside %s", p, target, upload)
+		}
+		return nil
+	})
+}
+
+// copyEntry copies the file, directory or symlink called src to dst along with its metadata and returns the size of the files copied.
+// links maps the LinkID of each file copied so far to its copy, so files hardlinked together stay linked.
+func (s *StorageService) copyEntry(ctx context.Context, src string, dst string, links map[any]string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	info, err := fs.Lstat(s.fsys, src)
+	if err != nil {
+		return 0, err
+	}
+	md := &filesystem.FileMetadata{Mode: uint32(info.Mode().Perm()), Mtime: info.ModTime().UnixNano(), Owner: files.Owner(info)}
+
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		target, err := fs.ReadLink(s.fsys, src)
+		if err != nil {
+			return 0, err
+		}
+		return 0, s.backend.Symlink(target, dst)
+	case info.IsDir():
+		if err := s.backend.MkdirAll(dst); err != nil {
+			return 0, err
+		}
+
+		entries, err := fs.ReadDir(s.fsys, src)
+		if err != nil {
+			return 0, err
+		}
+
+		var size int64
+		for _, entry := range entries {
+			n, err := s.copyEntry(ctx, path.Join(src, entry.Name()), path.Join(dst, entry.Name()), links)
+			size += n
+			if err != nil {
+				return size, err
+			}
+		}
+		return size, applyMetadata(s.backend, dst, md)
+	case info.Mode().IsRegular():
+		if id := files.LinkID(info); id != nil {
+			if first, ok := links[id]; ok {
+				return 0, s.backend.Link(first, dst)
+			}
+			links[id] = dst
+		}
+
+		size, err := s.copyFile(src, dst)
+		if err != nil {
+			return size, err
+		}
+		return size, applyMetadata(s.backend, dst, md)
+	}
+
+	// Anything else, like devices and named pipes, can't be stored
+	return 0, nil
+}
+
+// copyFile copies the content of the regular file src to dst.
+func (s *StorageService) copyFile(src string, dst string) (int64, error) {
+	r, err := s.fsys.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	w, err := s.backend.Create(dst, true)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := io.Copy(io.NewOffsetWriter(w, 0), r)
+	if err != nil {
+		w.Close()
+		return size, fmt.Errorf("could not copy %s: %v", src, err)
+	}
+
+	if err := w.Sync(); err != nil {
+		w.Close()
+		return size, err
+	}
+	return size, w.Close()
+}
+
+// modify unpacks the given uploads from the chunk store, runs fn against the backend, packs whatever is left of them again and updates their usage.
+// It fails if an upload session is writing to any of them.
+func (s *StorageService) modify(uploads []string, fn func() error) error {
+	s.packMu.Lock()
+	err := func() error {
+		for _, upload := range uploads {
+			if err := s.checkIdle(upload); err != nil {
+				return err
+			}
+			if err := s.unpack(upload); err != nil {
+				return err
+			}
+		}
+		return fn()
+	}()
+	s.packMu.Unlock()
+
+	for i, upload := range uploads {
+		if i > 0 && upload == uploads[0] {
+			continue
+		}
+		if _, statErr := s.backend.Stat(upload); statErr != nil {
+			continue
+		}
+		if packErr := s.pack(upload); err == nil {
+			err = packErr
+		}
+	}
+	s.remeasure(uploads...)
+	return err
+}
+
+// checkIdle fails if an upload session is writing to the upload.
+func (s *StorageService) checkIdle(upload string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, session := range s.sessions {
+		if session.upload == upload {
+			return status.Errorf(codes.FailedPrecondition, "upload %s has an open upload session", upload)
+		}
+	}
+	return nil
+}
+
+// uploadOf returns the upload, the top level directory, that holds name.
+func uploadOf(name string) string {
+	upload, _, _ := strings.Cut(name, "/")
+	return upload
+}
+
+// statusOf gives errors about missing or existing paths the matching status code.
+func statusOf(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, fs.ErrExist):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, fs.ErrPermission):
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return err
+}
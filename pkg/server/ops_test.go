@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"io/fs"
+	"testing"
+
+	"github.com/RGood/fs-xfer/pkg/backend"
+	filesystem "github.com/RGood/fs-xfer/pkg/generated/filesystem"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// commitChunks uploads chunks in a new session and returns the id of the committed upload.
+func commitChunks(t *testing.T, c filesystem.StorageServiceClient, chunks ...*filesystem.File) string {
+	t.Helper()
+
+	session, err := c.BeginUpload(context.Background(), &filesystem.BeginUploadRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := uploadChunks(c, session.GetId(), chunks...); err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.CommitUpload(context.Background(), &filesystem.CommitUploadRequest{Id: session.GetId()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.GetId()
+}
+
+// checkContent fails unless each of the named files reads as its content through s, and a nil content names a missing file.
+func checkContent(t *testing.T, s *StorageService, content map[string][]byte) {
+	t.Helper()
+
+	for name, want := range content {
+		got, err := fs.ReadFile(s.fsys, name)
+		if want == nil {
+			if err == nil {
+				t.Fatalf("%s still exists", name)
+			}
+			continue
+		}
+		if err != nil || string(got) != string(want) {
+			t.Fatalf("%s holds %q and error %v, want %q", name, got, err, want)
+		}
+	}
+}
+
+// opsServices returns a new service for each storage layout Delete, Move and Copy must work on.
+func opsServices() map[string]func(t *testing.T) *StorageService {
+	return map[string]func(t *testing.T) *StorageService{
+		"local": func(t *testing.T) *StorageService {
+			s, _ := newTestService(t)
+			return s
+		},
+		"dedup": func(t *testing.T) *StorageService {
+			store, err := NewChunkStore(backend.NewMemory())
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := NewStorageService(backend.NewMemory(), WithChunkStore(store))
+			t.Cleanup(s.Close)
+			return s
+		},
+	}
+}
+
+func TestDeleteMoveCopy(t *testing.T) {
+	for name, newService := range opsServices() {
+		t.Run(name, func(t *testing.T) {
+			s := newService(t)
+			c := dial(t, s)
+			ctx := context.Background()
+
+			id := commitChunks(t, c,
+				&filesystem.File{Name: "a", Data: []byte("a")},
+				&filesystem.File{Name: "b", Path: "dir", Data: []byte("b")},
+				&filesystem.File{Name: "hard", Path: "dir", Type: filesystem.EntryType_HARDLINK, LinkTarget: "dir/b"},
+				&filesystem.File{Name: "link", Path: "dir", Type: filesystem.EntryType_SYMLINK, LinkTarget: "../a"},
+			)
+			other := commitChunks(t, c, &filesystem.File{Name: "x", Data: []byte("x")})
+
+			steps := []struct {
+				name string
+				call func() error
+				code codes.Code
+				// content maps names to what they hold afterwards, or nil where they must be gone
+				content map[string][]byte
+			}{
+				{"copy", func() error {
+					_, err := c.Copy(ctx, &filesystem.CopyRequest{Source: id + "/dir", Destination: id + "/dir2"})
+					return err
+				}, codes.OK, map[string][]byte{id + "/dir2/b": []byte("b"), id + "/dir2/hard": []byte("b"), id + "/dir2/link": []byte("a")}},
+				{"copy onto an existing path", func() error {
+					_, err := c.Copy(ctx, &filesystem.CopyRequest{Source: id + "/a", Destination: id + "/dir/b"})
+					return err
+				}, codes.AlreadyExists, map[string][]byte{id + "/dir/b": []byte("b")}},
+				{"copy into itself", func() error {
+					_, err := c.Copy(ctx, &filesystem.CopyRequest{Source: id + "/dir", Destination: id + "/dir/sub"})
+					return err
+				}, codes.InvalidArgument, nil},
+				{"copy a symlink out of reach of its target", func() error {
+					_, err := c.Copy(ctx, &filesystem.CopyRequest{Source: id + "/dir", Destination: "fresh"})
+					return err
+				}, codes.FailedPrecondition, map[string][]byte{"fresh/b": nil}},
+				{"move", func() error {
+					_, err := c.Move(ctx, &filesystem.MoveRequest{Source: id + "/a", Destination: id + "/moved/a"})
+					return err
+				}, codes.OK, map[string][]byte{id + "/a": nil, id + "/moved/a": []byte("a")}},
+				{"move a missing file", func() error {
+					_, err := c.Move(ctx, &filesystem.MoveRequest{Source: id + "/a", Destination: id + "/again"})
+					return err
+				}, codes.NotFound, nil},
+				{"move between uploads", func() error {
+					_, err := c.Move(ctx, &filesystem.MoveRequest{Source: other + "/x", Destination: id + "/x"})
+					return err
+				}, codes.OK, map[string][]byte{other + "/x": nil, id + "/x": []byte("x")}},
+				{"delete a directory that isn't empty", func() error {
+					_, err := c.Delete(ctx, &filesystem.DeleteRequest{Path: id + "/dir2"})
+					return err
+				}, codes.FailedPrecondition, map[string][]byte{id + "/dir2/b": []byte("b")}},
+				{"delete a file", func() error {
+					_, err := c.Delete(ctx, &filesystem.DeleteRequest{Path: id + "/dir2/b"})
+					return err
+				}, codes.OK, map[string][]byte{id + "/dir2/b": nil, id + "/dir2/hard": []byte("b")}},
+				{"delete recursively", func() error {
+					_, err := c.Delete(ctx, &filesystem.DeleteRequest{Path: id + "/dir2", Recursive: true})
+					return err
+				}, codes.OK, map[string][]byte{id + "/dir2/hard": nil, id + "/dir/hard": []byte("b")}},
+				{"delete a missing file", func() error {
+					_, err := c.Delete(ctx, &filesystem.DeleteRequest{Path: id + "/dir2"})
+					return err
+				}, codes.NotFound, nil},
+				{"delete a whole upload", func() error {
+					_, err := c.Delete(ctx, &filesystem.DeleteRequest{Path: id, Recursive: true})
+					return err
+				}, codes.OK, map[string][]byte{id + "/dir/b": nil, id + "/x": nil}},
+			}
+			for _, step := range steps {
+				if err := step.call(); status.Code(err) != step.code {
+					t.Fatalf("%s: got error %v, want %s", step.name, err, step.code)
+				}
+				checkContent(t, s, step.content)
+			}
+		})
+	}
+}
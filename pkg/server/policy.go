@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Operation is something a principal may be allowed to do to a path.
+type Operation string
+
+const (
+	// OpRead downloads files.
+	OpRead Operation = "read"
+	// OpWrite uploads and syncs files, and is the destination of moves and copies.
+	OpWrite Operation = "write"
+	// OpList lists folders and describes paths.
+	OpList Operation = "list"
+	// OpDelete deletes paths, including the files a sync deletes and the source of a move.
+	OpDelete Operation = "delete"
+)
+
+// anyPrincipal in a rule's principals matches every principal, including anonymous clients.
+const anyPrincipal = "*"
+
+// policyCheckInterval is how often the policy file is checked for changes.
+const policyCheckInterval = 2 * time.Second
+
+// Policy decides which operations each principal may perform on which paths. Anything no rule allows is denied.
+// It's loaded from a JSON file such as:
+//
+//	{"rules": [
+//	  {"principals": ["alice", "bob"], "paths": ["team-a"], "operations": ["read", "write", "list", "delete"]},
+//	  {"principals": ["*"], "paths": ["public"], "operations": ["read", "list"]}
+//	]}
+//
+// A rule's paths are prefixes made of whole path components, so "team-a" covers "team-a/x" but not "team-ab".
+// An empty path covers everything. The file is checked for changes every few seconds until the policy is closed.
+type Policy struct {
+	file string
+
+	mu sync.Mutex
+	// sum is the SHA-256 of the file the rules were read from, so rewrites are noticed whatever their modification time.
+	sum   [sha256.Size]byte
+	rules []policyRule
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type policyRule struct {
+	Principals []string    `json:"principals"`
+	Paths      []string    `json:"paths"`
+	Operations []Operation `json:"operations"`
+}
+
+// LoadPolicy reads the policy in file and keeps checking it for changes until the policy is closed.
+func LoadPolicy(file string) (*Policy, error) {
+	p := &Policy{file: file, done: make(chan struct{})}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+	go p.watch(policyCheckInterval)
+	return p, nil
+}
+
+// Close stops checking the policy file for changes. The rules last read keep applying.
+func (p *Policy) Close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+}
+
+// watch reloads the policy every interval until it's closed.
+// If the file changed but can't be loaded, the previous rules keep applying until it can.
+func (p *Policy) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.reload(); err != nil {
+				fmt.Printf("Could not reload policy from %s, keeping the previous one: %v\n", p.file, err)
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// WithPolicy only allows the operations the policy allows. Without one, every principal may do anything.
+func WithPolicy(p *Policy) Option {
+	return func(s *StorageService) {
+		s.policy = p
+	}
+}
+
+// reload reads the policy file and applies its rules if its content changed since it was last read.
+func (p *Policy) reload() error {
+	data, err := os.ReadFile(p.file)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+
+	p.mu.Lock()
+	unchanged := p.rules != nil && sum == p.sum
+	p.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	var config struct {
+		Rules []policyRule `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("could not read policy %s: %v", p.file, err)
+	}
+
+	for i, rule := range config.Rules {
+		for _, op := range rule.Operations {
+			switch op {
+			case OpRead, OpWrite, OpList, OpDelete:
+			default:
+				return fmt.Errorf("rule %d of policy %s has unknown operation %q", i, p.file, op)
+			}
+		}
+		for j, prefix := range rule.Paths {
+			rule.Paths[j] = strings.Trim(path.Clean("/"+prefix), "/")
+		}
+	}
+
+	if config.Rules == nil {
+		config.Rules = []policyRule{}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.rules != nil {
+		fmt.Printf("Reloaded policy from %s\n", p.file)
+	}
+	p.rules, p.sum = config.Rules, sum
+	return nil
+}
+
+// Allows reports whether principal may perform op on name, a slash separated path relative to the storage root.
+func (p *Policy) Allows(principal string, op Operation, name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, rule := range p.rules {
+		if rule.matches(principal, op, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *policyRule) matches(principal string, op Operation, name string) bool {
+	if !slices.Contains(r.Principals, principal) && !slices.Contains(r.Principals, anyPrincipal) {
+		return false
+	}
+	if !slices.Contains(r.Operations, op) {
+		return false
+	}
+
+	for _, prefix := range r.Paths {
+		if prefix == "" || name == prefix || strings.HasPrefix(name, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize fails with PERMISSION_DENIED, and logs the denial, unless the calling principal may perform op on every name.
+func (s *StorageService) authorize(ctx context.Context, op Operation, names ...string) error {
+	if s.policy == nil {
+		return nil
+	}
+
+	principal := PrincipalFrom(ctx)
+	for _, name := range names {
+		if !s.policy.Allows(principal, op, name) {
+			return denied(principal, fmt.Sprintf("%s %s", op, name))
+		}
+	}
+	return nil
+}
+
+// authorizeSession fails with PERMISSION_DENIED, and logs the denial, unless the calling principal opened the session.
+func (s *StorageService) authorizeSession(ctx context.Context, session *uploadSession) error {
+	if principal := PrincipalFrom(ctx); principal != session.principal {
+		return denied(principal, fmt.Sprintf("use upload session %s", session.id))
+	}
+	return nil
+}
+
+// denied logs that principal tried to do what it may not and returns the error it gets.
+func denied(principal string, what string) error {
+	name := principalName(principal)
+	fmt.Printf("AUDIT: denied %s: %s\n", name, what)
+	return status.Errorf(codes.PermissionDenied, "%s may not %s", name, what)
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePolicy writes a policy file holding rules and returns its name.
+func writePolicy(t *testing.T, dir string, rules string) string {
+	t.Helper()
+
+	file := filepath.Join(dir, "policy.json")
+	if err := os.WriteFile(file, []byte(`{"rules": [`+rules+`]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// loadPolicy loads the policy in file, closing it when the test ends.
+func loadPolicy(t *testing.T, file string) *Policy {
+	t.Helper()
+
+	p, err := LoadPolicy(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+func TestPolicyAllows(t *testing.T) {
+	p := loadPolicy(t, writePolicy(t, t.TempDir(), `
+		{"principals": ["alice"], "paths": ["team-a", "/shared/docs/"], "operations": ["read", "write"]},
+		{"principals": ["*"], "paths": ["public"], "operations": ["read", "list"]},
+		{"principals": ["admin"], "paths": [""], "operations": ["delete"]}
+	`))
+
+	tests := []struct {
+		principal string
+		op        Operation
+		name      string
+		allowed   bool
+	}{
+		{"alice", OpRead, "team-a", true},
+		{"alice", OpWrite, "team-a/x/y", true},
+		{"alice", OpRead, "team-ab", false},
+		{"alice", OpRead, "team-ab/x", false},
+		{"alice", OpRead, "team", false},
+		{"alice", OpList, "team-a", false},
+		{"bob", OpRead, "team-a", false},
+		{"alice", OpRead, "shared/docs/x", true},
+		{"alice", OpRead, "shared/docsx", false},
+		{"alice", OpRead, "shared", false},
+		{"alice", OpRead, "public/x", true},
+		{"", OpList, "public", true},
+		{"", OpWrite, "public", false},
+		{"admin", OpDelete, "anything/at/all", true},
+		{"admin", OpRead, "public-not", false},
+	}
+	for _, test := range tests {
+		if allowed := p.Allows(test.principal, test.op, test.name); allowed != test.allowed {
+			t.Errorf("Allows(%q, %s, %q) = %v, want %v", test.principal, test.op, test.name, allowed, test.allowed)
+		}
+	}
+}
+
+func TestLoadPolicyInvalid(t *testing.T) {
+	tests := map[string]string{
+		"unknown operation": `{"principals": ["*"], "paths": [""], "operations": ["execute"]}`,
+		"invalid JSON":      `{"principals": ["*"]`,
+	}
+	for name, rules := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := LoadPolicy(writePolicy(t, t.TempDir(), rules)); err == nil {
+				t.Fatal("loaded an invalid policy")
+			}
+		})
+	}
+	if _, err := LoadPolicy(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Fatal("loaded a missing policy")
+	}
+}
+
+func TestPolicyReload(t *testing.T) {
+	dir := t.TempDir()
+	file := writePolicy(t, dir, `{"principals": ["alice"], "paths": ["a"], "operations": ["read"]}`)
+	p := loadPolicy(t, file)
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrites keep the modification time, as happens within the granularity of coarse file system clocks
+	rewrite := func(rules string) {
+		t.Helper()
+		writePolicy(t, dir, rules)
+		if err := os.Chtimes(file, info.ModTime(), info.ModTime()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	steps := []struct {
+		name  string
+		rules string
+		a, b  bool
+	}{
+		{"changed rules of the same size", `{"principals": ["alice"], "paths": ["b"], "operations": ["read"]}`, false, true},
+		{"invalid rules keep the previous ones", `{"principals": ["alice"], "paths": ["a"], "operations": ["bogus"]}`, false, true},
+		{"fixed rules", `{"principals": ["alice"], "paths": ["a", "b"], "operations": ["read"]}`, true, true},
+		{"no rules", ``, false, false},
+	}
+	if !p.Allows("alice", OpRead, "a") || p.Allows("alice", OpRead, "b") {
+		t.Fatal("initial policy not applied")
+	}
+	for _, step := range steps {
+		rewrite(step.rules)
+		err := p.reload()
+		if a, b := p.Allows("alice", OpRead, "a"), p.Allows("alice", OpRead, "b"); a != step.a || b != step.b {
+			t.Fatalf("%s: reload returned %v, and reading a allowed %v and b allowed %v, want %v and %v", step.name, err, a, b, step.a, step.b)
+		}
+	}
+}
+
+func TestPolicyWatch(t *testing.T) {
+	dir := t.TempDir()
+	file := writePolicy(t, dir, `{"principals": ["alice"], "paths": ["a"], "operations": ["read"]}`)
+	p := &Policy{file: file, done: make(chan struct{})}
+	if err := p.reload(); err != nil {
+		t.Fatal(err)
+	}
+	go p.watch(10 * time.Millisecond)
+	defer p.Close()
+
+	writePolicy(t, dir, `{"principals": ["bob"], "paths": ["a"], "operations": ["read"]}`)
+	for deadline := time.Now().Add(5 * time.Second); !p.Allows("bob", OpRead, "a"); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("policy was not reloaded")
+		}
+	}
+	if p.Allows("alice", OpRead, "a") {
+		t.Fatal("previous rules still apply")
+	}
+}
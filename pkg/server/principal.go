@@ -0,0 +1,25 @@
+package server
+
+import "context"
+
+type principalKey struct{}
+
+// ContextWithPrincipal returns a copy of ctx that carries the name of the authenticated client making a call.
+// Uploads are owned by, and counted against the quota of, the principal that made them.
+func ContextWithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFrom returns the principal carried by ctx, or an empty string for anonymous clients.
+func PrincipalFrom(ctx context.Context) string {
+	principal, _ := ctx.Value(principalKey{}).(string)
+	return principal
+}
+
+// principalName is how principal appears in logs and errors.
+func principalName(principal string) string {
+	if principal == "" {
+		return "anonymous"
+	}
+	return principal
+}
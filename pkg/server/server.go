@@ -4,174 +4,379 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"os"
+	"io/fs"
 	"path"
-	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/RGood/fs-xfer/pkg/backend"
+	"github.com/RGood/fs-xfer/pkg/codec"
+	"github.com/RGood/fs-xfer/pkg/delta"
 	"github.com/RGood/fs-xfer/pkg/files"
 	filesystem "github.com/RGood/fs-xfer/pkg/generated/filesystem"
 	"github.com/RGood/fs-xfer/pkg/units"
 	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type StorageService struct {
 	filesystem.UnimplementedStorageServiceServer
-	root string
+	backend backend.Backend
+	// fsys is the read view of the backend used by listings and downloads.
+	fsys fs.FS
+	// store holds finished uploads deduplicated into chunks, if enabled.
+	store *ChunkStore
+	// hashes caches the digests listed by GetManifest.
+	hashes *hashCache
+	// policy decides what each principal may do, if set.
+	policy *Policy
+	// shareKey signs share links, which are disabled without one. shareMu serializes counting their downloads.
+	shareKey []byte
+	shareMu  sync.Mutex
+	// quotas limit what's stored, as tracked by usage.
+	quotas Quotas
+	usage  *usage
+
+	mu       sync.Mutex
+	sessions map[string]*uploadSession
+	// packMu keeps uploads from being packed into or out of the chunk store while a sync session is opened.
+	packMu sync.Mutex
+
+	// defaultTTL and maxTTL bound how long uploads are kept. Zero keeps them until they're deleted.
+	defaultTTL time.Duration
+	maxTTL     time.Duration
+	// expiryMu guards the expiry records, and keeps the janitor from deleting an upload while a commit, move or copy changes it.
+	expiryMu        sync.Mutex
+	janitorInterval time.Duration
+	// sessionTimeout is how long an upload session may go without receiving data before the janitor discards it. Zero keeps them.
+	sessionTimeout time.Duration
+	done           chan struct{}
+	closeOnce      sync.Once
+}
+
+// Option configures optional StorageService behavior.
+type Option func(*StorageService)
+
+// WithChunkStore packs finished uploads into the given chunk store, so content shared between uploads is stored once.
+func WithChunkStore(store *ChunkStore) Option {
+	return func(s *StorageService) {
+		s.store = store
+	}
+}
+
+// WithUploadTTL deletes uploads that don't ask for a time to live after defaultTTL, and caps the time to live
+// of every upload at maxTTL. Zero leaves uploads without a default or a cap.
+func WithUploadTTL(defaultTTL time.Duration, maxTTL time.Duration) Option {
+	return func(s *StorageService) {
+		s.defaultTTL, s.maxTTL = defaultTTL, maxTTL
+	}
+}
+
+// WithJanitorInterval sets how often expired uploads are looked for and deleted.
+func WithJanitorInterval(interval time.Duration) Option {
+	return func(s *StorageService) {
+		s.janitorInterval = interval
+	}
+}
+
+// WithSessionTimeout discards upload sessions, along with what they staged, once they've received nothing for timeout.
+// Zero keeps them until they're committed.
+func WithSessionTimeout(timeout time.Duration) Option {
+	return func(s *StorageService) {
+		s.sessionTimeout = timeout
+	}
 }
 
 // NewLocalStorageService creates a new instance of StorageService with the given root directory.
-func NewLocalStorageService(root string) *StorageService {
-	return &StorageService{
-		root: filepath.Clean(root),
+func NewLocalStorageService(root string, opts ...Option) *StorageService {
+	return NewStorageService(backend.NewLocal(root), opts...)
+}
+
+// NewStorageService creates a new instance of StorageService that keeps its files in b.
+func NewStorageService(b backend.Backend, opts ...Option) *StorageService {
+	s := &StorageService{
+		backend:         b,
+		hashes:          newHashCache(),
+		usage:           newUsage(),
+		sessions:        map[string]*uploadSession{},
+		janitorInterval: defaultJanitorInterval,
+		sessionTimeout:  defaultSessionTimeout,
+		done:            make(chan struct{}),
 	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.fsys = newStorageFS(s.backend, s.store)
+	s.recoverStaging()
+	go s.janitor(s.janitorInterval)
+	return s
 }
 
-func (s *StorageService) Upload(stream filesystem.StorageService_UploadServer) (err error) {
+// Close stops the janitor that deletes expired uploads and abandoned sessions.
+func (s *StorageService) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+func (s *StorageService) Upload(stream filesystem.StorageService_UploadServer) error {
+	first, err := stream.Recv()
+	if err == nil && first.GetSessionId() != "" {
+		return s.uploadToSession(stream, first)
+	}
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return s.uploadOneShot(stream, first)
+}
+
+// uploadOneShot stores a stream of chunks in a new directory, appending each chunk to its file.
+// The directory is deleted if the stream fails.
+func (s *StorageService) uploadOneShot(stream filesystem.StorageService_UploadServer, first *filesystem.File) (err error) {
 	id := uuid.NewString()
 	ctx, cancel := context.WithTimeout(stream.Context(), 60*time.Second)
 	defer cancel()
 
-	totalSize := 0
+	session := newUploadSession(s.backend, id)
+	session.ttl = s.ttl(0)
+	session.principal = PrincipalFrom(stream.Context())
+	if err := s.authorize(stream.Context(), OpWrite, session.dest); err != nil {
+		return err
+	}
+	s.track(session)
+	defer s.untrack(session)
+	w := &chunkWriter{session: session}
 
 	// Cleanup + Logging
 	defer func() {
 		if err != nil {
-			println("Upload failed. Deleting directory:", path.Join(s.root, id), err.Error())
-			os.RemoveAll(path.Join(s.root, id))
+			println("Upload failed. Deleting directory:", session.dir, err.Error())
+			s.backend.RemoveAll(session.dir)
 		} else {
-			fmt.Printf("Upload complete. %s bytes stored in: %s\n", units.FormatBytesIEC(int64(totalSize)), path.Join(s.root, id))
-
+			fmt.Printf("Upload complete. %s bytes stored in: %s\n", units.FormatBytesIEC(session.size), session.dest)
 		}
 	}()
 
-	curFileName := ""
-	var curFile *os.File
+	if first != nil {
+		err = receive(ctx, stream, first, func(file *filesystem.File) error {
+			_, err := w.write(file, session.received(files.Key(file)))
+			return err
+		})
+	}
+	if closeErr := w.close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
 
-	for file, err := stream.Recv(); err != io.EOF; file, err = stream.Recv() {
+	// The client only sees the response once the handler returns, by which time the upload is in place
+	if err := stream.SendAndClose(&filesystem.UploadFilesystemResponse{Id: id, Size: session.size}); err != nil {
+		return err
+	}
+	if err := s.commit(session); err != nil {
+		return err
+	}
+	s.settle(session)
+	return s.pack(id)
+}
+
+// receive passes first and then every following chunk of the stream to write until the client closes the stream.
+func receive(ctx context.Context, stream filesystem.StorageService_UploadServer, first *filesystem.File, write func(*filesystem.File) error) error {
+	for file, err := first, error(nil); err != io.EOF; file, err = stream.Recv() {
 		if err != nil {
 			return err
 		} else if ctx.Err() != nil {
 			return ctx.Err()
 		}
 
-		cleanedPath := filepath.Clean(file.Path)
-		fullFileName := path.Join(s.root, id, cleanedPath, file.Name)
-
-		if curFileName != fullFileName {
-			// Close current file if it exists
-			curFile.Close()
-
-			// Ensure parent dir exists
-			if err := os.MkdirAll(path.Dir(fullFileName), os.ModeDir); err != nil {
-				return err
-			}
+		if err := write(file); err != nil {
+			return err
+		}
+	}
 
-			// Open the file for writing
-			f, err := os.OpenFile(fullFileName, os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				return err
-			}
+	return nil
+}
 
-			// Update the current file + filename
-			curFileName = fullFileName
-			curFile = f
+func (s *StorageService) Download(req *filesystem.DownloadRequest, stream filesystem.StorageService_DownloadServer) error {
+	var name string
+	var err error
+	if req.GetShareToken() != "" {
+		// A share link authorizes the download in place of the caller's credentials and the policy
+		name, err = s.shareDownload(req)
+		if err != nil {
+			return err
 		}
-
-		// Write chunk to current file
-		b, err := curFile.Write(file.Data)
+	} else if withoutCredentials(stream.Context()) {
+		return status.Error(codes.Unauthenticated, "missing bearer token or share link")
+	} else {
+		name, err = s.getName(req.GetPath())
 		if err != nil {
 			return err
 		}
-
-		totalSize += b
+		if err := s.authorize(stream.Context(), OpRead, name); err != nil {
+			return err
+		}
 	}
 
-	curFile.Close()
+	// Chunk paths are sent relative to the requested folder, or to the parent of a requested file.
+	info, err := fs.Stat(s.fsys, name)
+	if err != nil {
+		return statusOf(err)
+	}
+	prefix := name
+	if !info.IsDir() {
+		prefix = path.Dir(name)
+	}
 
-	return stream.SendAndClose(&filesystem.UploadFilesystemResponse{Id: id, Size: int64(totalSize)})
-}
+	if req.GetShards() < 0 || req.GetShard() < 0 || (req.GetShards() > 0 && req.GetShard() >= req.GetShards()) {
+		return status.Errorf(codes.InvalidArgument, "invalid shard %d of %d", req.GetShard(), req.GetShards())
+	}
+	if req.GetRange() != nil {
+		return s.downloadRange(req, name, info, stream)
+	}
 
-func (s *StorageService) Download(req *filesystem.DownloadRequest, stream filesystem.StorageService_DownloadServer) error {
-	basePath, err := s.getBasePath(req.GetPath())
-	if err != nil {
-		return err
+	opts := files.Options{
+		Signatures:       map[string]*filesystem.FileSignature{},
+		Compression:      codec.Negotiate(req.GetCompressions()),
+		CompressionLevel: int(req.GetCompressionLevel()),
+		Shard:            int(req.GetShard()),
+		Shards:           int(req.GetShards()),
+	}
+	if len(req.GetSignatures()) > delta.MaxSignatures {
+		return status.Errorf(codes.InvalidArgument, "%d signatures is more than the %d a download may carry", len(req.GetSignatures()), delta.MaxSignatures)
+	}
+	for _, sig := range req.GetSignatures() {
+		key := resolveRelative(prefix, sig.GetPath())
+		if existing, ok := opts.Signatures[key]; ok {
+			existing.Blocks = append(existing.Blocks, sig.GetBlocks()...)
+		} else {
+			opts.Signatures[key] = sig
+		}
+	}
+	for key, sig := range opts.Signatures {
+		if err := delta.Validate(sig); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid signature of %s: %v", key, err)
+		}
 	}
 
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
 	fileStream := make(chan *files.FileProgress)
+	var streamErr error
 
 	go func() {
-		files.Stream(basePath, fileStream)
+		streamErr = files.StreamFS(ctx, s.fsys, name, opts, fileStream)
 		close(fileStream)
 	}()
 
+	relative := func(p string) string {
+		return strings.TrimPrefix(path.Clean(strings.TrimPrefix(p, prefix)), "/")
+	}
+
 	for progress := range fileStream {
-		progress.File.Path = path.Clean(strings.TrimPrefix(progress.File.Path, basePath))
+		progress.File.Path = relative(progress.File.Path)
+		if progress.File.GetType() == filesystem.EntryType_HARDLINK {
+			progress.File.LinkTarget = relative(progress.File.LinkTarget)
+		}
 		if err := stream.Send(progress.File); err != nil {
 			return fmt.Errorf("error sending file chunk: %v", err)
 		}
 	}
 
-	return nil
+	return streamErr
 }
 
-func (s *StorageService) pathIsValid(path string) bool {
-	res := strings.HasPrefix(path, s.root)
-	return res
+// downloadRange streams the part of the regular file called name that a ranged download asks for.
+func (s *StorageService) downloadRange(req *filesystem.DownloadRequest, name string, info fs.FileInfo, stream filesystem.StorageService_DownloadServer) error {
+	r := req.GetRange()
+	switch {
+	case !info.Mode().IsRegular():
+		return status.Errorf(codes.FailedPrecondition, "%s is not a regular file", name)
+	case req.GetShards() > 0 || len(req.GetSignatures()) > 0:
+		return status.Errorf(codes.InvalidArgument, "a range can't be combined with shards or signatures")
+	case r.GetOffset() < 0 || r.GetLength() < 0:
+		return status.Errorf(codes.InvalidArgument, "invalid range of %d bytes at %d", r.GetLength(), r.GetOffset())
+	case r.GetOffset() > info.Size():
+		return status.Errorf(codes.OutOfRange, "offset %d is past the end of %s", r.GetOffset(), name)
+	}
+
+	end := info.Size()
+	if r.GetLength() > 0 {
+		end = min(end, r.GetOffset()+r.GetLength())
+	}
+	opts := files.Options{
+		Compression:      codec.Negotiate(req.GetCompressions()),
+		CompressionLevel: int(req.GetCompressionLevel()),
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	fileStream := make(chan *files.FileProgress)
+	var streamErr error
+
+	go func() {
+		streamErr = files.StreamSection(ctx, s.fsys, name, r.GetOffset(), end, opts, fileStream)
+		close(fileStream)
+	}()
+
+	for progress := range fileStream {
+		progress.File.Path = ""
+		if err := stream.Send(progress.File); err != nil {
+			return fmt.Errorf("error sending file chunk: %v", err)
+		}
+	}
+
+	return streamErr
 }
 
-func (s *StorageService) getBasePath(targetPath string) (string, error) {
+// getName validates a remote path and returns its name in the backend.
+func (s *StorageService) getName(targetPath string) (string, error) {
 	inputPath := path.Clean(targetPath)
 
 	if strings.HasPrefix(inputPath, "..") || inputPath == "." || inputPath == "/" {
 		return "", fmt.Errorf("invalid path: %s", targetPath)
 	}
 
-	basePath := path.Clean(path.Join(s.root, inputPath))
-	if !s.pathIsValid(basePath) {
+	// Top level names starting with a dot hold server state, such as the chunk store
+	name := strings.TrimPrefix(inputPath, "/")
+	if strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid path: %s", targetPath)
+	}
+
+	if !fs.ValidPath(name) {
 		// Prevent path traversal attacks
 		return "", fmt.Errorf("invalid base path: %s", targetPath)
 	}
 
-	return basePath, nil
+	return name, nil
 }
 
-func (s *StorageService) populateManifest(filePath string, dirFile *os.File, recursive bool) ([]*filesystem.FSEntry, error) {
+func (s *StorageService) populateManifest(name string, recursive bool, checksums bool) ([]*filesystem.FSEntry, error) {
 	entries := []*filesystem.FSEntry{}
 
-	files, err := dirFile.Readdir(0)
+	files, err := fs.ReadDir(s.fsys, name)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, fileInfo := range files {
-		entry := &filesystem.FSEntry{}
-		if fileInfo.IsDir() {
-			entries := []*filesystem.FSEntry{}
-			if recursive {
-				file, err := os.OpenFile(filepath.Join(filePath, fileInfo.Name()), os.O_RDONLY, os.ModePerm)
-				if err != nil {
-					return nil, err
-				}
-				defer file.Close()
-
-				entries, err = s.populateManifest(filepath.Join(filePath, fileInfo.Name()), file, true)
-				if err != nil {
-					return nil, err
-				}
-			}
-			entry.Value = &filesystem.FSEntry_Directory{
-				Directory: &filesystem.Directory{
-					Name:    fileInfo.Name(),
-					Entries: entries,
-				},
-			}
-		} else {
-			entry.Value = &filesystem.FSEntry_File{
-				File: &filesystem.FileInfo{
-					Name: fileInfo.Name(),
-				},
+		childName := path.Join(name, fileInfo.Name())
+		entry, err := s.manifestEntry(childName, fileInfo, checksums)
+		if err != nil {
+			return nil, err
+		}
+
+		if dir := entry.GetDirectory(); dir != nil && recursive {
+			dir.Entries, err = s.populateManifest(childName, true, checksums)
+			if err != nil {
+				return nil, err
 			}
 		}
 		entries = append(entries, entry)
@@ -180,22 +385,181 @@ func (s *StorageService) populateManifest(filePath string, dirFile *os.File, rec
 	return entries, nil
 }
 
-func (s *StorageService) GetManifest(ctx context.Context, req *filesystem.ManifestRequest) (*filesystem.ManifestResponse, error) {
-	basePath, err := s.getBasePath(req.GetPath())
+// manifestEntry describes the entry called name, leaving out the contents of directories.
+func (s *StorageService) manifestEntry(name string, d fs.DirEntry, checksums bool) (*filesystem.FSEntry, error) {
+	info, err := d.Info()
 	if err != nil {
 		return nil, err
 	}
 
-	f, err := os.OpenFile(basePath, os.O_RDONLY, os.ModePerm)
+	if d.IsDir() {
+		return &filesystem.FSEntry{Value: &filesystem.FSEntry_Directory{
+			Directory: &filesystem.Directory{
+				Name:    d.Name(),
+				Entries: []*filesystem.FSEntry{},
+				Mtime:   info.ModTime().UnixNano(),
+				Mode:    uint32(info.Mode().Perm()),
+			},
+		}}, nil
+	}
+
+	file, err := s.fileInfo(name, info, checksums)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	return &filesystem.FSEntry{Value: &filesystem.FSEntry_File{File: file}}, nil
+}
+
+// fileInfo describes the file or symlink called name for a manifest, including its digest if checksums is set.
+func (s *StorageService) fileInfo(name string, info fs.FileInfo, checksums bool) (*filesystem.FileInfo, error) {
+	file := &filesystem.FileInfo{
+		Name:  info.Name(),
+		Size:  info.Size(),
+		Mtime: info.ModTime().UnixNano(),
+		Mode:  uint32(info.Mode().Perm()),
+	}
 
-	entries, err := s.populateManifest(basePath, f, req.GetRecursive())
+	var err error
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		file.Type = filesystem.EntryType_SYMLINK
+		file.LinkTarget, err = fs.ReadLink(s.fsys, name)
+	case checksums && info.Mode().IsRegular():
+		file.Sha256, err = s.hashes.sum(s.fsys, name, info)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func (s *StorageService) GetManifest(ctx context.Context, req *filesystem.ManifestRequest) (*filesystem.ManifestResponse, error) {
+	name, err := s.getName(req.GetPath())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, OpList, name); err != nil {
+		return nil, err
+	}
+
+	entries, err := s.populateManifest(name, req.GetRecursive(), req.GetChecksums())
 	if err != nil {
 		return nil, err
 	}
 
 	return &filesystem.ManifestResponse{Entries: entries}, nil
 }
+
+func (s *StorageService) Stat(ctx context.Context, req *filesystem.StatRequest) (*filesystem.StatResponse, error) {
+	name, err := s.getName(req.GetPath())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, OpList, name); err != nil {
+		return nil, err
+	}
+
+	info, err := fs.Lstat(s.fsys, name)
+	if err != nil {
+		return nil, statusOf(err)
+	}
+
+	res := &filesystem.StatResponse{
+		Type:  filesystem.EntryType_DIRECTORY,
+		Mtime: info.ModTime().UnixNano(),
+		Mode:  uint32(info.Mode().Perm()),
+	}
+	if !info.IsDir() {
+		file, err := s.fileInfo(name, info, req.GetChecksum())
+		if err != nil {
+			return nil, statusOf(err)
+		}
+		res.Type, res.Size, res.LinkTarget, res.Sha256 = file.GetType(), file.GetSize(), file.GetLinkTarget(), file.GetSha256()
+	}
+
+	return res, nil
+}
+
+// maxListEntries bounds how many entries each ListEntries message carries.
+const maxListEntries = 1000
+
+func (s *StorageService) ListEntries(req *filesystem.ListEntriesRequest, stream filesystem.StorageService_ListEntriesServer) error {
+	name, err := s.getName(req.GetPath())
+	if err != nil {
+		return err
+	}
+	if err := s.authorize(stream.Context(), OpList, name); err != nil {
+		return err
+	}
+
+	var after []string
+	if req.GetStartAfter() != "" {
+		after = strings.Split(path.Clean(req.GetStartAfter()), "/")
+	}
+
+	batch := make([]*filesystem.ListEntry, 0, maxListEntries)
+	send := func(entry *filesystem.ListEntry) error {
+		batch = append(batch, entry)
+		if len(batch) < maxListEntries {
+			return nil
+		}
+		err := stream.Send(&filesystem.ListEntriesResponse{Entries: batch})
+		batch = batch[:0]
+		return err
+	}
+
+	if err := s.listEntries(stream.Context(), name, "", req, after, send); err != nil {
+		return statusOf(err)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return stream.Send(&filesystem.ListEntriesResponse{Entries: batch})
+}
+
+// listEntries sends the entries of dir, which is at rel in the listing, and with a recursive request everything under it.
+// after holds the components of the path to resume after that are left below dir. Entries up to and including it are skipped.
+func (s *StorageService) listEntries(ctx context.Context, dir string, rel string, req *filesystem.ListEntriesRequest, after []string, send func(*filesystem.ListEntry) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	entries, err := fs.ReadDir(s.fsys, dir)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range entries {
+		var skip bool
+		var childAfter []string
+		if len(after) > 0 {
+			if d.Name() < after[0] {
+				continue
+			}
+			if d.Name() == after[0] {
+				skip, childAfter = true, after[1:]
+			}
+			after = nil
+		}
+
+		childName, childRel := path.Join(dir, d.Name()), path.Join(rel, d.Name())
+		if !skip {
+			entry, err := s.manifestEntry(childName, d, req.GetChecksums())
+			if err != nil {
+				return err
+			}
+			if err := send(&filesystem.ListEntry{Path: childRel, Entry: entry}); err != nil {
+				return err
+			}
+		}
+
+		if d.IsDir() && req.GetRecursive() {
+			if err := s.listEntries(ctx, childName, childRel, req, childAfter, send); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
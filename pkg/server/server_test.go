@@ -0,0 +1,384 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RGood/fs-xfer/pkg/backend"
+	filesystem "github.com/RGood/fs-xfer/pkg/generated/filesystem"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// dial serves s on a loopback port until the test ends and returns a client connected to it.
+func dial(t *testing.T, s filesystem.StorageServiceServer) filesystem.StorageServiceClient {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := grpc.NewServer()
+	filesystem.RegisterStorageServiceServer(g, s)
+	go g.Serve(lis)
+	t.Cleanup(g.Stop)
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return filesystem.NewStorageServiceClient(conn)
+}
+
+// newTestService returns a service storing its uploads in a temporary directory, and that directory.
+func newTestService(t *testing.T, opts ...Option) (*StorageService, string) {
+	t.Helper()
+
+	root := t.TempDir()
+	s := NewLocalStorageService(root, opts...)
+	t.Cleanup(s.Close)
+	return s, root
+}
+
+// writeTestFile stores data as the file called name in b.
+func writeTestFile(t *testing.T, b backend.Backend, name string, data []byte) {
+	t.Helper()
+
+	w, err := b.Create(name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// uploadChunks sends chunks to the session with the given id in a single Upload stream.
+func uploadChunks(c filesystem.StorageServiceClient, id string, chunks ...*filesystem.File) error {
+	stream, err := c.Upload(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		chunk.SessionId = id
+		if err := stream.Send(chunk); err != nil {
+			break
+		}
+	}
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+// offsets returns how many bytes the session with the given id received of each file.
+func offsets(t *testing.T, c filesystem.StorageServiceClient, id string) map[string]int64 {
+	t.Helper()
+
+	session, err := c.ResumeUpload(context.Background(), &filesystem.ResumeUploadRequest{Id: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]int64{}
+	for _, f := range session.GetFiles() {
+		got[path.Join(f.GetPath(), f.GetName())] = f.GetOffset()
+	}
+	return got
+}
+
+func TestResumeUpload(t *testing.T) {
+	s, root := newTestService(t)
+	c := dial(t, s)
+	ctx := context.Background()
+
+	session, err := c.BeginUpload(ctx, &filesystem.BeginUploadRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name    string
+		chunks  []*filesystem.File
+		code    codes.Code
+		offsets map[string]int64
+	}{
+		{"first chunks", []*filesystem.File{
+			{Name: "a", Data: []byte("hello ")},
+			{Name: "b", Path: "dir", Data: []byte("x")},
+		}, codes.OK, map[string]int64{"a": 6, "dir/b": 1}},
+		{"resumed", []*filesystem.File{
+			{Name: "a", Data: []byte("world"), Offset: 6},
+		}, codes.OK, map[string]int64{"a": 11, "dir/b": 1}},
+		{"overlapping data received before", []*filesystem.File{
+			{Name: "a", Data: []byte("lo world"), Offset: 3},
+		}, codes.OK, map[string]int64{"a": 11, "dir/b": 1}},
+		{"chunk past the data received", []*filesystem.File{
+			{Name: "b", Path: "dir", Data: []byte("y"), Offset: 5},
+		}, codes.OK, map[string]int64{"a": 11, "dir/b": 1}},
+		{"gap filled", []*filesystem.File{
+			{Name: "b", Path: "dir", Data: []byte("abcd"), Offset: 1},
+		}, codes.OK, map[string]int64{"a": 11, "dir/b": 6}},
+	}
+	for _, step := range steps {
+		if err := uploadChunks(c, session.GetId(), step.chunks...); status.Code(err) != step.code {
+			t.Fatalf("%s: got error %v, want %s", step.name, err, step.code)
+		}
+		if got := offsets(t, c, session.GetId()); !maps.Equal(got, step.offsets) {
+			t.Fatalf("%s: session has offsets %v, want %v", step.name, got, step.offsets)
+		}
+	}
+
+	res, err := c.CommitUpload(ctx, &filesystem.CommitUploadRequest{Id: session.GetId()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.GetSize() != 17 {
+		t.Fatalf("committed %d bytes, want 17", res.GetSize())
+	}
+	for name, want := range map[string]string{"a": "hello world", "dir/b": "xabcdy"} {
+		if got, err := os.ReadFile(filepath.Join(root, res.GetId(), name)); err != nil || string(got) != want {
+			t.Fatalf("%s holds %q and error %v, want %q", name, got, err, want)
+		}
+	}
+
+	if _, err := c.CommitUpload(ctx, &filesystem.CommitUploadRequest{Id: session.GetId()}); status.Code(err) != codes.NotFound {
+		t.Fatalf("committing twice returned %v, want NOT_FOUND", err)
+	}
+	if err := uploadChunks(c, session.GetId(), &filesystem.File{Name: "c"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("uploading to a committed session returned %v, want NOT_FOUND", err)
+	}
+}
+
+func TestParallelStreams(t *testing.T) {
+	s, root := newTestService(t)
+	c := dial(t, s)
+	ctx := context.Background()
+
+	session, err := c.BeginUpload(ctx, &filesystem.BeginUploadRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file's chunks are spread over the streams so that each one sends its share back to front,
+	// and the hardlink to the file arrives before the file is complete
+	data := randomBytes(3, 64<<10)
+	sum := sha256.Sum256(data)
+	const chunkSize, streams = 4 << 10, 4
+	shares := make([][]*filesystem.File, streams)
+	for i := len(data)/chunkSize - 1; i >= 0; i-- {
+		chunk := &filesystem.File{Name: "big", Offset: int64(i * chunkSize), Data: data[i*chunkSize : (i+1)*chunkSize]}
+		if i == len(data)/chunkSize-1 {
+			chunk.FileSha256 = sum[:]
+		}
+		shares[i%streams] = append(shares[i%streams], chunk)
+	}
+	shares[0] = append([]*filesystem.File{{Name: "link", Type: filesystem.EntryType_HARDLINK, LinkTarget: "big"}}, shares[0]...)
+
+	var wg sync.WaitGroup
+	errs := make([]error, streams)
+	for i, share := range shares {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = uploadChunks(c, session.GetId(), share...)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		t.Fatal(err)
+	}
+	if got := offsets(t, c, session.GetId()); got["big"] != int64(len(data)) {
+		t.Fatalf("session has offsets %v, want %d bytes of big", got, len(data))
+	}
+
+	res, err := c.CommitUpload(ctx, &filesystem.CommitUploadRequest{Id: session.GetId()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"big", "link"} {
+		if got, err := os.ReadFile(filepath.Join(root, res.GetId(), name)); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s holds %d bytes and error %v, want the %d bytes sent", name, len(got), err, len(data))
+		}
+	}
+}
+
+func TestReapSessions(t *testing.T) {
+	s, root := newTestService(t, WithSessionTimeout(time.Hour))
+	c := dial(t, s)
+	ctx := context.Background()
+
+	begin := func() string {
+		t.Helper()
+		session, err := c.BeginUpload(ctx, &filesystem.BeginUploadRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := uploadChunks(c, session.GetId(), &filesystem.File{Name: "a", Data: []byte("data")}); err != nil {
+			t.Fatal(err)
+		}
+		return session.GetId()
+	}
+	// age makes the session with the given id look idle since before the timeout
+	age := func(id string) {
+		t.Helper()
+		session, err := s.getSession(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		session.mu.Lock()
+		session.active = time.Now().Add(-2 * time.Hour)
+		session.mu.Unlock()
+	}
+
+	idle, active, streaming := begin(), begin(), begin()
+	age(idle)
+
+	// A session a stream is writing to isn't idle, however long ago it last received data
+	stream, err := c.Upload(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&filesystem.File{SessionId: streaming, Name: "a", Data: []byte("more"), Offset: 4}); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); offsets(t, c, streaming)["a"] != 8; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("chunk was not received")
+		}
+	}
+	age(streaming)
+
+	s.reapSessions()
+
+	if _, err := c.ResumeUpload(ctx, &filesystem.ResumeUploadRequest{Id: idle}); status.Code(err) != codes.NotFound {
+		t.Fatalf("idle session returned %v, want NOT_FOUND", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, idle)); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("what the idle session received is still there: %v", err)
+	}
+	if _, err := c.CommitUpload(ctx, &filesystem.CommitUploadRequest{Id: idle}); status.Code(err) != codes.NotFound {
+		t.Fatalf("committing the idle session returned %v, want NOT_FOUND", err)
+	}
+
+	if _, err := stream.CloseAndRecv(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{active, streaming} {
+		if _, err := c.CommitUpload(ctx, &filesystem.CommitUploadRequest{Id: id}); err != nil {
+			t.Fatalf("could not commit session that wasn't idle: %v", err)
+		}
+	}
+}
+
+func TestReapSessionsWithoutTimeout(t *testing.T) {
+	s, _ := newTestService(t, WithSessionTimeout(0))
+	c := dial(t, s)
+	ctx := context.Background()
+
+	session, err := c.BeginUpload(ctx, &filesystem.BeginUploadRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := s.getSession(context.Background(), session.GetId())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.mu.Lock()
+	u.active = time.Time{}
+	u.mu.Unlock()
+	s.reapSessions()
+
+	if _, err := c.CommitUpload(ctx, &filesystem.CommitUploadRequest{Id: session.GetId()}); err != nil {
+		t.Fatalf("could not commit session without a timeout: %v", err)
+	}
+}
+
+// listPaths returns the paths ListEntries sends for req, and how many messages they came in.
+func listPaths(t *testing.T, c filesystem.StorageServiceClient, req *filesystem.ListEntriesRequest) ([]string, int) {
+	t.Helper()
+
+	stream, err := c.ListEntries(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	var messages int
+	for {
+		res, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return paths, messages
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		messages++
+		for _, entry := range res.GetEntries() {
+			paths = append(paths, entry.GetPath())
+		}
+	}
+}
+
+func TestListEntriesResume(t *testing.T) {
+	s, root := newTestService(t)
+	c := dial(t, s)
+
+	var want []string
+	add := func(name string, dir bool) {
+		t.Helper()
+		want = append(want, name)
+		target := filepath.Join(root, "up", filepath.FromSlash(name))
+		if dir {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := os.WriteFile(target, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("a", true)
+	for i := range maxListEntries + 200 {
+		add(fmt.Sprintf("a/f%04d", i), false)
+	}
+	add("a/z", true)
+	add("a/z/deep", false)
+	add("b", false)
+
+	got, messages := listPaths(t, c, &filesystem.ListEntriesRequest{Path: "up", Recursive: true})
+	if !slices.Equal(got, want) || messages != 2 {
+		t.Fatalf("listed %d entries in %d messages, want the %d written in 2", len(got), messages, len(want))
+	}
+
+	// Resuming after any entry lists exactly the ones after it, and resuming after one that went away skips to where it was
+	for _, i := range []int{0, 1, 500, maxListEntries, len(want) - 3, len(want) - 2, len(want) - 1} {
+		got, _ := listPaths(t, c, &filesystem.ListEntriesRequest{Path: "up", Recursive: true, StartAfter: want[i]})
+		if !slices.Equal(got, want[i+1:]) {
+			t.Fatalf("resuming after %s listed %d entries, want %d", want[i], len(got), len(want)-i-1)
+		}
+	}
+	got, _ = listPaths(t, c, &filesystem.ListEntriesRequest{Path: "up", Recursive: true, StartAfter: "a/f0499x"})
+	if !slices.Equal(got, want[501:]) {
+		t.Fatalf("resuming after a missing entry listed %d entries, want %d", len(got), len(want)-501)
+	}
+
+	got, _ = listPaths(t, c, &filesystem.ListEntriesRequest{Path: "up", StartAfter: "a"})
+	if !slices.Equal(got, []string{"b"}) {
+		t.Fatalf("resuming a listing that isn't recursive gave %v, want [b]", got)
+	}
+}
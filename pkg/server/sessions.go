@@ -0,0 +1,819 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RGood/fs-xfer/pkg/backend"
+	"github.com/RGood/fs-xfer/pkg/codec"
+	"github.com/RGood/fs-xfer/pkg/files"
+	filesystem "github.com/RGood/fs-xfer/pkg/generated/filesystem"
+	"github.com/RGood/fs-xfer/pkg/units"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// uploadSession tracks how much of each file has been written for an upload.
+// Several Upload streams may write to a session at once.
+type uploadSession struct {
+	backend backend.Backend
+	id      string
+	// dir is the directory of the backend the session writes into.
+	dir string
+	// dest is where dir is moved once the session is committed, according to overwrite.
+	dest      string
+	overwrite filesystem.OverwritePolicy
+	// ttl is how long the upload is kept once committed, or zero to keep it until it's deleted.
+	ttl time.Duration
+	// principal is the client that opened the session.
+	principal string
+	// quota reserves bytes about to be written if they stay within the server's quotas. It's nil when there are none.
+	quota func(n int64) error
+	// upload is the top level directory of the backend that holds the session's files once committed.
+	upload string
+	// target is the remote address reported when the session is committed.
+	target string
+
+	// mtimes and deletes are applied to dest when a sync session is committed.
+	mtimes  map[string]time.Time
+	deletes []string
+	// dirs holds the empty directories a sync session brings, which deletions leave in place.
+	dirs map[string]bool
+	// delta holds the keys of files rebuilt from their existing copy in dest.
+	delta map[string]bool
+
+	mu    sync.Mutex
+	files map[string]*receivedFile
+	// links maps the path of each hardlink received to the path of the file it links to, both relative to dir.
+	// They are created once the session is complete, as the files they link to may still be arriving on other streams.
+	links map[string]string
+	// streams counts the Upload streams currently writing to the session.
+	streams int
+	size    int64
+	// charged is how much of size counts against quotas, leaving out what only takes the place of existing files.
+	charged int64
+	// reserved is what writes in progress were allowed to add to charged. It counts against quotas until they're done.
+	reserved int64
+	closed   bool
+	// exhausted is set once a stream went over a quota. Clients give up on such sessions, so they're discarded once their last stream ends.
+	exhausted bool
+	// active is when the session was opened, or last received data or a stream.
+	active time.Time
+}
+
+// receivedFile is the server's record of one file in an upload.
+type receivedFile struct {
+	name     string
+	path     string
+	received files.Ranges
+	// digest covers the bytes received so far while they arrive in order, or is nil once they don't.
+	digest hash.Hash
+	// final holds the digest and metadata sent with the chunk that ends the file, at end, once it has arrived.
+	final *filesystem.File
+	end   int64
+
+	// mu is held while writing to the file, which every stream writing to it shares while any of them has it open.
+	mu   sync.Mutex
+	refs int
+	// fullName is where the file is stored.
+	fullName string
+	w        backend.Writer
+	// base is the existing copy that copy chunks of a delta read from, and baseSize its size.
+	base     files.ReadFile
+	baseSize int64
+	// replaces is the size of the file at the destination this one takes the place of once committed.
+	replaces int64
+	// created is set once the file has been created, so only the first open replaces existing content.
+	created bool
+	// done is set once the file is complete and verified. Chunks of it that arrive later are ignored.
+	done bool
+	// kept is set for files that already existed at the destination of a skip-existing upload, which are never written.
+	kept bool
+}
+
+// newUploadSession creates a session that writes into the staging area and is moved to a new upload named after it once committed.
+func newUploadSession(b backend.Backend, id string) *uploadSession {
+	return &uploadSession{
+		backend: b,
+		id:      id,
+		dir:     stagingName(id),
+		dest:    id,
+		upload:  id,
+		target:  id,
+		files:   map[string]*receivedFile{},
+		links:   map[string]string{},
+		active:  time.Now(),
+	}
+}
+
+// file returns the record of the file that the chunk belongs to, creating it for the first chunk.
+func (u *uploadSession) file(file *filesystem.File) *receivedFile {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	key := files.Key(file)
+	entry, ok := u.files[key]
+	if !ok {
+		entry = &receivedFile{name: file.GetName(), path: file.GetPath(), digest: sha256.New()}
+		u.files[key] = entry
+	}
+	return entry
+}
+
+// received returns the number of bytes written without gaps so far for the file identified by key.
+func (u *uploadSession) received(key string) int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if entry, ok := u.files[key]; ok {
+		return entry.received.Contiguous()
+	}
+	return 0
+}
+
+// keepExisting records every file under the session's destination as kept, so uploading it again leaves it as it is.
+func (u *uploadSession) keepExisting(fsys fs.FS) error {
+	return fs.WalkDir(fsys, u.dest, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		key := strings.TrimPrefix(p, u.dest+"/")
+		u.files[key] = &receivedFile{name: path.Base(key), path: path.Dir(key), done: true, kept: true}
+		return nil
+	})
+}
+
+// kept reports whether the file identified by key is kept from the destination of a skip-existing upload.
+func (u *uploadSession) kept(key string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	entry, ok := u.files[key]
+	return ok && entry.kept
+}
+
+// advance records that data from the chunk was written to the file at offset, releasing the bytes reserved for the write,
+// and reports whether every byte up to the end of the file has now arrived.
+func (u *uploadSession) advance(entry *receivedFile, file *filesystem.File, offset int64, data []byte, reserved int64) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.reserved -= reserved
+	if entry.digest != nil && entry.received.Continues(offset) {
+		entry.digest.Write(data)
+	} else {
+		entry.digest = nil
+	}
+	u.charged += u.charge(entry, offset, int64(len(data)))
+	u.size += entry.received.Add(offset, int64(len(data)))
+	u.active = time.Now()
+
+	if file.GetFileSha256() != nil && entry.final == nil {
+		entry.final = &filesystem.File{Name: file.GetName(), Path: file.GetPath(), FileSha256: file.GetFileSha256(), Metadata: file.GetMetadata()}
+		entry.end = offset + int64(len(data))
+	}
+
+	return entry.final != nil && entry.received.Contiguous() >= entry.end
+}
+
+// bytesCharged returns the number of bytes written to the session so far, or reserved by writes in progress, that count against quotas.
+func (u *uploadSession) bytesCharged() int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.charged + u.reserved
+}
+
+// charge returns how much writing n bytes at offset of the file adds to what the session counts against quotas.
+// Bytes the file already received don't count again, nor do those that only take the place of the file it replaces. u.mu must be held.
+func (u *uploadSession) charge(entry *receivedFile, offset int64, n int64) int64 {
+	size := entry.received.Size()
+	return max(size+entry.received.Missing(offset, n)-entry.replaces, 0) - max(size-entry.replaces, 0)
+}
+
+// reserve returns the bytes it reserved against quotas for writing n bytes at offset of the file, which advance releases,
+// or fails if the write would take the session over a quota. entry.mu must be held until advance is called.
+func (u *uploadSession) reserve(entry *receivedFile, offset int64, n int64) (int64, error) {
+	if u.quota == nil {
+		return 0, nil
+	}
+
+	u.mu.Lock()
+	charge := u.charge(entry, offset, n)
+	u.mu.Unlock()
+	if charge == 0 {
+		return 0, nil
+	}
+	if err := u.quota(charge); err != nil {
+		return 0, err
+	}
+	return charge, nil
+}
+
+// beginStream registers an Upload stream writing to the session, unless it was already committed.
+func (u *uploadSession) beginStream() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed {
+		return status.Errorf(codes.FailedPrecondition, "upload session %s is already committed", u.id)
+	}
+	u.streams++
+	u.active = time.Now()
+	return nil
+}
+
+// endStream unregisters an Upload stream, which failed with err if it isn't nil. It reports whether the session was closed
+// because it went over a quota and no stream is left writing to it.
+func (u *uploadSession) endStream(err error) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.streams--
+	u.active = time.Now()
+	if status.Code(err) == codes.ResourceExhausted {
+		u.exhausted = true
+	}
+	if !u.exhausted || u.streams > 0 || u.closed {
+		return false
+	}
+	u.closed = true
+	return true
+}
+
+// close stops the session from accepting streams and returns its size, unless a stream is still writing to it
+// or it was already closed.
+func (u *uploadSession) close() (int64, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed {
+		return 0, status.Errorf(codes.FailedPrecondition, "upload session %s is already committed", u.id)
+	}
+	if u.streams > 0 {
+		return 0, status.Errorf(codes.Aborted, "upload session %s is still receiving data", u.id)
+	}
+	u.closed = true
+	return u.size, nil
+}
+
+// expire closes the session if no stream is writing to it and it has been idle since before deadline, and reports whether it did.
+func (u *uploadSession) expire(deadline time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed || u.streams > 0 || u.active.After(deadline) {
+		return false
+	}
+	u.closed = true
+	return true
+}
+
+// createLinks creates the hardlinks received by the session in its directory, replacing whatever file is in their place.
+// Hardlinks may only point at regular files, as a symlink linked elsewhere would point somewhere else.
+func (u *uploadSession) createLinks() error {
+	for link, target := range u.links {
+		name, root := resolveRelative(u.dir, link), u.dir
+
+		// Files kept from the destination of a skip-existing upload, or left alone by a sync, were never staged
+		if _, err := u.backend.Lstat(resolveRelative(root, target)); errors.Is(err, fs.ErrNotExist) {
+			root = u.dest
+		}
+		oldName := resolveRelative(root, target)
+
+		if err := files.CheckParents(u.backend, u.dir, link); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err := files.CheckParents(u.backend, root, target); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		if info, err := u.backend.Lstat(oldName); err != nil {
+			return err
+		} else if !info.Mode().IsRegular() {
+			return status.Errorf(codes.InvalidArgument, "hardlink %s -> %s doesn't point at a regular file", link, target)
+		}
+
+		if err := u.backend.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err := u.backend.Link(oldName, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *uploadSession) toProto() *filesystem.UploadSession {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	offsets := make([]*filesystem.FileOffset, 0, len(u.files))
+	for _, entry := range u.files {
+		offsets = append(offsets, &filesystem.FileOffset{Name: entry.name, Path: entry.path, Offset: entry.received.Contiguous(), Kept: entry.kept})
+	}
+	sort.Slice(offsets, func(i, j int) bool {
+		return path.Join(offsets[i].Path, offsets[i].Name) < path.Join(offsets[j].Path, offsets[j].Name)
+	})
+
+	return &filesystem.UploadSession{Id: u.id, Files: offsets, Compressions: codec.Supported}
+}
+
+// chunkWriter writes the chunks of one stream into an upload session, keeping the file it most recently wrote to open.
+type chunkWriter struct {
+	session *uploadSession
+	cur     *receivedFile
+}
+
+// write stores the chunk at offset. Chunks of a file may arrive in any order and overlap data already received.
+// Once every byte up to the chunk carrying the file digest has arrived, the file is checked against it and given the metadata sent with it.
+func (w *chunkWriter) write(file *filesystem.File, offset int64) (int, error) {
+	if err := files.Decompress(file); err != nil {
+		return 0, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := files.VerifyChunk(file); err != nil {
+		return 0, status.Error(codes.DataLoss, err.Error())
+	}
+
+	if file.GetType() != filesystem.EntryType_REGULAR {
+		return 0, w.entry(file)
+	}
+
+	entry := w.session.file(file)
+	if entry != w.cur {
+		if err := w.close(); err != nil {
+			return 0, err
+		}
+		entry.mu.Lock()
+		entry.refs++
+		entry.mu.Unlock()
+		w.cur = entry
+	}
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	if entry.done {
+		return 0, nil
+	}
+	if entry.w == nil {
+		if err := w.open(entry, file); err != nil {
+			return 0, err
+		}
+	}
+
+	data := file.GetData()
+	if c := file.GetCopy(); c != nil {
+		if entry.base == nil {
+			return 0, status.Errorf(codes.InvalidArgument, "%s has no existing copy to copy from", files.Key(file))
+		}
+
+		if err := files.CheckCopy(c, entry.baseSize); err != nil {
+			return 0, status.Errorf(codes.InvalidArgument, "%s: %v", files.Key(file), err)
+		}
+
+		data = make([]byte, c.GetLength())
+		if n, err := entry.base.ReadAt(data, c.GetOffset()); n < len(data) {
+			return 0, status.Errorf(codes.InvalidArgument, "copy of %d bytes at %d is outside the existing copy of %s: %v", c.GetLength(), c.GetOffset(), files.Key(file), err)
+		}
+	}
+
+	reserved, err := w.session.reserve(entry, offset, int64(len(data)))
+	if err != nil {
+		return 0, err
+	}
+
+	// Only what was written is charged, whether or not the write succeeded
+	b, err := entry.w.WriteAt(data, offset)
+	complete := w.session.advance(entry, file, offset, data[:b], reserved)
+	if err != nil || !complete {
+		return b, err
+	}
+
+	return b, w.finish(entry)
+}
+
+// entry creates the empty directory or symlink described by file, replacing whatever file or empty directory is in its place.
+// Hardlinks are only recorded, to be created once the session is complete.
+func (w *chunkWriter) entry(file *filesystem.File) error {
+	if w.session.kept(files.Key(file)) {
+		return nil
+	}
+
+	b := w.session.backend
+	name := resolveUploadPath(w.session.dir, file)
+	if err := files.CheckParents(b, w.session.dir, files.Key(file)); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var err error
+	switch file.GetType() {
+	case filesystem.EntryType_DIRECTORY:
+		if err = removeSymlink(b, name); err != nil {
+			return err
+		}
+		if err = b.MkdirAll(name); err == nil {
+			err = applyMetadata(b, name, file.GetMetadata())
+		}
+	case filesystem.EntryType_SYMLINK, filesystem.EntryType_HARDLINK:
+		target, linkErr := files.LinkTarget(file)
+		if linkErr != nil {
+			return status.Error(codes.InvalidArgument, linkErr.Error())
+		}
+
+		if file.GetType() == filesystem.EntryType_HARDLINK {
+			w.session.mu.Lock()
+			w.session.links[files.Key(file)] = target
+			w.session.mu.Unlock()
+			break
+		}
+
+		// The target is followed through what was staged so far, and the links it passes through have been checked the same way
+		if linkErr := files.CheckSymlink(b, w.session.dir, file); linkErr != nil {
+			return status.Error(codes.InvalidArgument, linkErr.Error())
+		}
+		if err = b.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		err = b.Symlink(files.SymlinkTarget(file), name)
+	default:
+		return status.Errorf(codes.InvalidArgument, "%s has unknown type %v", files.Key(file), file.GetType())
+	}
+	if err != nil {
+		return err
+	}
+
+	w.session.file(file)
+	return nil
+}
+
+// open opens the file of entry for writing. entry.mu must be held.
+func (w *chunkWriter) open(entry *receivedFile, file *filesystem.File) error {
+	b := w.session.backend
+	fullFileName := resolveUploadPath(w.session.dir, file)
+	if err := files.CheckParents(b, w.session.dir, files.Key(file)); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !entry.created {
+		if err := removeSymlink(b, fullFileName); err != nil {
+			return err
+		}
+	}
+
+	if w.session.delta[files.Key(file)] {
+		baseName := resolveUploadPath(w.session.dest, file)
+		base, err := b.Open(baseName)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if base != nil {
+			readFile, ok := base.(files.ReadFile)
+			if !ok {
+				base.Close()
+				return fmt.Errorf("file `%s` does not support random access", baseName)
+			}
+			info, err := readFile.Stat()
+			if err != nil {
+				base.Close()
+				return err
+			}
+			entry.base, entry.baseSize = readFile, info.Size()
+		}
+	}
+
+	if !entry.created {
+		if info, err := b.Lstat(resolveUploadPath(w.session.dest, file)); err == nil && info.Mode().IsRegular() {
+			entry.replaces = info.Size()
+		}
+	}
+
+	// Open the file for writing, replacing any existing content the first time it is written
+	f, err := b.Create(fullFileName, !entry.created)
+	if err != nil {
+		if entry.base != nil {
+			entry.base.Close()
+			entry.base = nil
+		}
+		return err
+	}
+
+	entry.fullName, entry.w, entry.created = fullFileName, f, true
+	return nil
+}
+
+// finish closes the completed file of entry, checks it against the digest carried by its final chunk
+// and applies its metadata. entry.mu must be held.
+func (w *chunkWriter) finish(entry *receivedFile) error {
+	if err := entry.close(); err != nil {
+		return err
+	}
+
+	b := w.session.backend
+	var sum []byte
+	if entry.digest != nil {
+		sum = entry.digest.Sum(nil)
+	} else {
+		var err error
+		if sum, err = files.HashFS(b, entry.fullName); err != nil {
+			return err
+		}
+	}
+	if err := files.VerifyFile(entry.final, sum); err != nil {
+		return status.Error(codes.DataLoss, err.Error())
+	}
+
+	entry.done = true
+	return applyMetadata(b, entry.fullName, entry.final.GetMetadata())
+}
+
+// close lets go of the file the stream last wrote to. The last stream to let go of a file that isn't complete
+// flushes it to disk, so the recorded offsets survive a dropped connection.
+func (w *chunkWriter) close() error {
+	entry := w.cur
+	if entry == nil {
+		return nil
+	}
+	w.cur = nil
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	entry.refs--
+	if entry.refs > 0 {
+		return nil
+	}
+	return entry.close()
+}
+
+// close flushes and closes the file if it is open. r.mu must be held.
+func (r *receivedFile) close() error {
+	if r.base != nil {
+		r.base.Close()
+		r.base = nil
+	}
+
+	if r.w == nil {
+		return nil
+	}
+
+	f := r.w
+	r.w = nil
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// removeSymlink removes name if it's a symlink, so what's created in its place isn't created through it.
+func removeSymlink(b backend.Backend, name string) error {
+	info, err := b.Lstat(name)
+	if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		return nil
+	}
+	return b.Remove(name)
+}
+
+// applyMetadata restores the permissions, owner and modification time sent with a file's final chunk.
+// Ownership is only restored where the server is allowed to change it.
+func applyMetadata(b backend.Backend, name string, md *filesystem.FileMetadata) error {
+	if md == nil {
+		return nil
+	}
+
+	if err := b.Chmod(name, fs.FileMode(md.GetMode()).Perm()); err != nil {
+		return err
+	}
+
+	if o := md.GetOwner(); o != nil {
+		if err := b.Chown(name, int(o.GetUid()), int(o.GetGid())); err != nil && !errors.Is(err, fs.ErrPermission) {
+			return err
+		}
+	}
+
+	return b.Chtimes(name, time.Unix(0, md.GetMtime()))
+}
+
+// resolveUploadPath maps a chunk's path and name to a location inside dir, ignoring attempts to climb out of it.
+func resolveUploadPath(dir string, file *filesystem.File) string {
+	return resolveRelative(dir, files.Key(file))
+}
+
+// resolveRelative maps a slash separated path to a location inside dir, ignoring attempts to climb out of it.
+func resolveRelative(dir string, relPath string) string {
+	return path.Join(dir, path.Clean("/"+relPath))
+}
+
+// getSession returns the session with the given id, provided the calling principal opened it.
+func (s *StorageService) getSession(ctx context.Context, id string) (*uploadSession, error) {
+	s.mu.Lock()
+	session, ok := s.sessions[id]
+	s.mu.Unlock()
+
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown upload session: %s", id)
+	}
+	if err := s.authorizeSession(ctx, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *StorageService) BeginUpload(ctx context.Context, req *filesystem.BeginUploadRequest) (*filesystem.UploadSession, error) {
+	if req.GetTtlSeconds() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "negative time to live: %ds", req.GetTtlSeconds())
+	}
+
+	id := uuid.NewString()
+	session := newUploadSession(s.backend, id)
+	session.ttl = s.ttl(time.Duration(req.GetTtlSeconds()) * time.Second)
+	session.principal = PrincipalFrom(ctx)
+
+	if req.GetDestination() != "" {
+		if err := s.prepareDestination(ctx, session, req); err != nil {
+			return nil, statusOf(err)
+		}
+	} else if err := s.authorize(ctx, OpWrite, session.dest); err != nil {
+		return nil, err
+	}
+	if err := s.backend.MkdirAll(session.dir); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.sessions[id] = session
+	s.mu.Unlock()
+	s.track(session)
+
+	return session.toProto(), nil
+}
+
+// prepareDestination points the session at the destination the request asks for. Destinations that already exist are checked
+// against the request's overwrite policy, which is applied again when the session is committed.
+func (s *StorageService) prepareDestination(ctx context.Context, session *uploadSession, req *filesystem.BeginUploadRequest) error {
+	name, err := s.getName(req.GetDestination())
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := s.authorize(ctx, OpWrite, name); err != nil {
+		return err
+	}
+	// Replacing a destination deletes whatever the upload doesn't bring along
+	if req.GetOverwrite() == filesystem.OverwritePolicy_REPLACE {
+		if err := s.authorize(ctx, OpDelete, name); err != nil {
+			return err
+		}
+	}
+	if _, ok := filesystem.OverwritePolicy_name[int32(req.GetOverwrite())]; !ok {
+		return status.Errorf(codes.InvalidArgument, "unknown overwrite policy %v", req.GetOverwrite())
+	}
+	session.dest, session.overwrite, session.upload, session.target = name, req.GetOverwrite(), uploadOf(name), name
+	if err := files.CheckParents(s.fsys, ".", name); err != nil {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	info, err := fs.Lstat(s.fsys, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	switch policy := req.GetOverwrite(); {
+	case policy == filesystem.OverwritePolicy_REPLACE:
+		return nil
+	case policy == filesystem.OverwritePolicy_FAIL:
+		return status.Errorf(codes.AlreadyExists, "%s already exists", req.GetDestination())
+	case !info.IsDir():
+		return status.Errorf(codes.FailedPrecondition, "%s is not a directory", req.GetDestination())
+	case policy == filesystem.OverwritePolicy_SKIP_EXISTING:
+		return session.keepExisting(s.fsys)
+	}
+	return nil
+}
+
+func (s *StorageService) ResumeUpload(ctx context.Context, req *filesystem.ResumeUploadRequest) (*filesystem.UploadSession, error) {
+	session, err := s.getSession(ctx, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return session.toProto(), nil
+}
+
+func (s *StorageService) CommitUpload(ctx context.Context, req *filesystem.CommitUploadRequest) (*filesystem.UploadFilesystemResponse, error) {
+	session, err := s.getSession(ctx, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := session.close()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	delete(s.sessions, session.id)
+	s.mu.Unlock()
+	defer s.untrack(session)
+
+	if err := s.commit(session); err != nil {
+		return nil, statusOf(err)
+	}
+	if err := session.applySync(); err != nil {
+		return nil, err
+	}
+	s.settle(session)
+	if err := s.pack(session.upload); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Upload complete. %s bytes stored in: %s\n", units.FormatBytesIEC(size), session.target)
+
+	return &filesystem.UploadFilesystemResponse{Id: session.target, Size: size}, nil
+}
+
+// discard drops a session that can't be completed, along with what it staged, so it no longer counts against quotas.
+// An existing upload the session kept unpacked is packed again.
+func (s *StorageService) discard(session *uploadSession) {
+	s.mu.Lock()
+	delete(s.sessions, session.id)
+	s.mu.Unlock()
+	s.untrack(session)
+
+	if err := s.backend.RemoveAll(session.dir); err != nil {
+		fmt.Printf("Could not remove staged upload %s: %v\n", session.dir, err)
+	}
+	if _, err := s.backend.Stat(session.upload); err == nil {
+		if err := s.pack(session.upload); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// reapSessions discards the sessions that received nothing for longer than the session timeout.
+func (s *StorageService) reapSessions() {
+	if s.sessionTimeout <= 0 {
+		return
+	}
+	deadline := time.Now().Add(-s.sessionTimeout)
+
+	s.mu.Lock()
+	var idle []*uploadSession
+	for _, session := range s.sessions {
+		if session.expire(deadline) {
+			idle = append(idle, session)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, session := range idle {
+		s.discard(session)
+		fmt.Printf("Discarded upload session %s after %s without data\n", session.id, s.sessionTimeout)
+	}
+}
+
+// uploadToSession writes a stream of chunks into the session named by its first chunk, alongside any other streams writing to it.
+// Data received before the stream fails is kept so the client can resume.
+func (s *StorageService) uploadToSession(stream filesystem.StorageService_UploadServer, first *filesystem.File) (err error) {
+	session, err := s.getSession(stream.Context(), first.GetSessionId())
+	if err != nil {
+		return err
+	}
+
+	if err := session.beginStream(); err != nil {
+		return err
+	}
+
+	w := &chunkWriter{session: session}
+	var size int64
+
+	err = receive(stream.Context(), stream, first, func(file *filesystem.File) error {
+		b, err := w.write(file, file.GetOffset())
+		size += int64(b)
+		return err
+	})
+	if closeErr := w.close(); err == nil {
+		err = closeErr
+	}
+	// The stream ends before the response is sent, so a client that commits once it has it finds no stream running
+	if session.endStream(err) {
+		s.discard(session)
+	}
+	if err != nil {
+		fmt.Printf("Upload to session %s interrupted after %s bytes: %v\n", session.id, units.FormatBytesIEC(size), err)
+		return err
+	}
+
+	return stream.SendAndClose(&filesystem.UploadFilesystemResponse{Id: session.id, Size: size})
+}
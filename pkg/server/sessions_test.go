@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"testing"
+
+	filesystem "github.com/RGood/fs-xfer/pkg/generated/filesystem"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func sha(data string) []byte {
+	sum := sha256.Sum256([]byte(data))
+	return sum[:]
+}
+
+func TestUploadDigests(t *testing.T) {
+	s, _ := newTestService(t)
+	c := dial(t, s)
+
+	tests := []struct {
+		name   string
+		chunks []*filesystem.File
+		code   codes.Code
+		// offset is how much of the file the session keeps.
+		offset int64
+	}{
+		{"valid", []*filesystem.File{
+			{Name: "a", Data: []byte("hello "), Sha256: sha("hello ")},
+			{Name: "a", Data: []byte("world"), Offset: 6, Sha256: sha("world"), FileSha256: sha("hello world")},
+		}, codes.OK, 11},
+		{"no digests", []*filesystem.File{
+			{Name: "a", Data: []byte("hello")},
+		}, codes.OK, 5},
+		{"corrupt chunk", []*filesystem.File{
+			{Name: "a", Data: []byte("hello"), Sha256: sha("hellO")},
+		}, codes.DataLoss, 0},
+		{"corrupt file", []*filesystem.File{
+			{Name: "a", Data: []byte("hello"), Sha256: sha("hello"), FileSha256: sha("hellO")},
+		}, codes.DataLoss, 5},
+		{"file read back after chunks out of order", []*filesystem.File{
+			{Name: "a", Data: []byte("hello world")},
+			{Name: "a", Data: []byte("hello"), FileSha256: sha("hello world")},
+		}, codes.OK, 11},
+		{"corrupt file read back after chunks out of order", []*filesystem.File{
+			{Name: "a", Data: []byte("hello world")},
+			{Name: "a", Data: []byte("hello"), FileSha256: sha("hello")},
+		}, codes.DataLoss, 11},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session, err := c.BeginUpload(context.Background(), &filesystem.BeginUploadRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := uploadChunks(c, session.GetId(), test.chunks...); status.Code(err) != test.code {
+				t.Fatalf("got error %v, want %s", err, test.code)
+			}
+			if offset := offsets(t, c, session.GetId())["a"]; offset != test.offset {
+				t.Fatalf("session kept %d bytes, want %d", offset, test.offset)
+			}
+		})
+	}
+}
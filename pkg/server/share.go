@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+
+	filesystem "github.com/RGood/fs-xfer/pkg/generated/filesystem"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// minShareKeySize is the shortest key share links may be signed with.
+const minShareKeySize = 32
+
+// sharesFile counts the downloads of every share link with a download limit.
+const sharesFile = ".shares.json"
+
+// shareLink is what a share link token grants. Tokens are the base64url encoded JSON of a shareLink,
+// a dot and the base64url encoded HMAC-SHA256 of the encoded JSON.
+type shareLink struct {
+	// ID tells links apart when counting their downloads.
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	// Expires is in seconds since the Unix epoch.
+	Expires      int64 `json:"exp"`
+	MaxDownloads int64 `json:"max,omitempty"`
+}
+
+// shareCount is how often a link with a download limit was used.
+type shareCount struct {
+	Downloads int64 `json:"downloads"`
+	// Expires lets counts be dropped once their link stopped working.
+	Expires int64 `json:"exp"`
+}
+
+// WithShareKey signs share links with key, which must be at least 32 bytes. Without one, CreateShareLink fails.
+// Changing the key invalidates every link signed with the previous one.
+func WithShareKey(key []byte) Option {
+	return func(s *StorageService) {
+		s.shareKey = key
+	}
+}
+
+func (s *StorageService) CreateShareLink(ctx context.Context, req *filesystem.ShareLinkRequest) (*filesystem.ShareLinkResponse, error) {
+	if len(s.shareKey) < minShareKeySize {
+		return nil, status.Error(codes.FailedPrecondition, "share links aren't enabled on this server")
+	}
+
+	name, err := s.getName(req.GetPath())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if req.GetTtlSeconds() <= 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid time to live %ds", req.GetTtlSeconds())
+	}
+	if req.GetMaxDownloads() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid download limit %d", req.GetMaxDownloads())
+	}
+	if err := s.authorize(ctx, OpRead, name); err != nil {
+		return nil, err
+	}
+	if _, err := fs.Stat(s.fsys, name); err != nil {
+		return nil, statusOf(err)
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	link := shareLink{
+		ID:           hex.EncodeToString(id),
+		Path:         name,
+		Expires:      time.Now().Add(time.Duration(req.GetTtlSeconds()) * time.Second).Unix(),
+		MaxDownloads: req.GetMaxDownloads(),
+	}
+	token, err := s.signShareLink(link)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("%s shared %s until %s\n", principalName(PrincipalFrom(ctx)), name, time.Unix(link.Expires, 0).UTC().Format(time.RFC3339))
+	return &filesystem.ShareLinkResponse{Token: token, Expires: link.Expires}, nil
+}
+
+func (s *StorageService) signShareLink(link shareLink) (string, error) {
+	data, err := json.Marshal(&link)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(s.shareMAC(payload)), nil
+}
+
+func (s *StorageService) shareMAC(payload string) []byte {
+	mac := hmac.New(sha256.New, s.shareKey)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// openShareLink checks the signature and expiry of a share link token and returns what it grants.
+func (s *StorageService) openShareLink(token string) (*shareLink, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok || len(s.shareKey) < minShareKeySize {
+		return nil, status.Error(codes.Unauthenticated, "invalid share link")
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, s.shareMAC(payload)) {
+		return nil, status.Error(codes.Unauthenticated, "invalid share link")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "invalid share link")
+	}
+	var link shareLink
+	if err := json.Unmarshal(data, &link); err != nil {
+		return nil, status.Error(codes.Unauthenticated, "invalid share link")
+	}
+	if time.Now().Unix() >= link.Expires {
+		return nil, status.Error(codes.Unauthenticated, "share link expired")
+	}
+	return &link, nil
+}
+
+// shareDownload authorizes a download with a share link, counting it against the link's download limit.
+// It returns the path to download, which is the shared path unless the request names something inside it.
+func (s *StorageService) shareDownload(req *filesystem.DownloadRequest) (string, error) {
+	link, err := s.openShareLink(req.GetShareToken())
+	if err != nil {
+		return "", err
+	}
+
+	name := link.Path
+	if req.GetPath() != "" {
+		if name, err = s.getName(req.GetPath()); err != nil {
+			return "", err
+		}
+		if name != link.Path && !strings.HasPrefix(name, link.Path+"/") {
+			return "", denied("share link "+link.ID, "read "+name)
+		}
+	}
+	// Every download of a limited link must count, so they can't be split into shards fetched by separate calls
+	if req.GetShards() > 1 {
+		return "", status.Error(codes.InvalidArgument, "downloads with a share link can't be sharded")
+	}
+
+	// Only downloads that can start count
+	if _, err := fs.Stat(s.fsys, name); err != nil {
+		return "", statusOf(err)
+	}
+	if link.MaxDownloads > 0 {
+		if err := s.countShareDownload(link); err != nil {
+			return "", err
+		}
+	}
+	return name, nil
+}
+
+// countShareDownload records a download of link, failing once it was downloaded as often as it allows.
+func (s *StorageService) countShareDownload(link *shareLink) error {
+	s.shareMu.Lock()
+	defer s.shareMu.Unlock()
+
+	counts := map[string]shareCount{}
+	data, err := fs.ReadFile(s.backend, sharesFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	} else if err == nil {
+		if err := json.Unmarshal(data, &counts); err != nil {
+			return fmt.Errorf("could not read %s: %v", sharesFile, err)
+		}
+	}
+
+	count := counts[link.ID]
+	if count.Downloads >= link.MaxDownloads {
+		return status.Errorf(codes.PermissionDenied, "share link was already downloaded %d times", count.Downloads)
+	}
+	counts[link.ID] = shareCount{Downloads: count.Downloads + 1, Expires: link.Expires}
+
+	now := time.Now().Unix()
+	for id, count := range counts {
+		if now >= count.Expires {
+			delete(counts, id)
+		}
+	}
+	data, err = json.Marshal(counts)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(s.backend, sharesFile, data)
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RGood/fs-xfer/pkg/backend"
+	filesystem "github.com/RGood/fs-xfer/pkg/generated/filesystem"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newShareService returns a service signing share links with key, storing shared/file.
+func newShareService(t *testing.T, key []byte) *StorageService {
+	t.Helper()
+
+	b := backend.NewMemory()
+	writeTestFile(t, b, "shared/file", []byte("content"))
+
+	s := NewStorageService(b, WithShareKey(key))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestOpenShareLink(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), minShareKeySize)
+	s := newShareService(t, key)
+	sign := func(s *StorageService, link shareLink) string {
+		t.Helper()
+		token, err := s.signShareLink(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	valid := shareLink{ID: "id", Path: "shared", Expires: time.Now().Add(time.Hour).Unix()}
+	token := sign(s, valid)
+	payload, signature, _ := strings.Cut(token, ".")
+
+	widened := valid
+	widened.Path = ""
+	forgedPayload, _, _ := strings.Cut(sign(s, widened), ".")
+
+	flipped := []byte(signature)
+	flipped[0] ^= 1
+	expired := valid
+	expired.Expires = time.Now().Add(-time.Second).Unix()
+	otherKey := newShareService(t, bytes.Repeat([]byte("o"), minShareKeySize))
+	shortKey := newShareService(t, key[:minShareKeySize-1])
+
+	tests := []struct {
+		name  string
+		s     *StorageService
+		token string
+		ok    bool
+	}{
+		{"valid", s, token, true},
+		{"swapped payload", s, forgedPayload + "." + signature, false},
+		{"tampered signature", s, payload + "." + base64.RawURLEncoding.EncodeToString(flipped), false},
+		{"invalid signature encoding", s, payload + ".!!", false},
+		{"no signature", s, payload + ".", false},
+		{"no dot", s, payload, false},
+		{"empty", s, "", false},
+		{"expired", s, sign(s, expired), false},
+		{"signed with another key", otherKey, token, false},
+		{"key too short", shortKey, sign(shortKey, valid), false},
+		{"signed payload that isn't JSON", s, func() string {
+			p := base64.RawURLEncoding.EncodeToString([]byte("not json"))
+			return p + "." + base64.RawURLEncoding.EncodeToString(s.shareMAC(p))
+		}(), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			link, err := test.s.openShareLink(test.token)
+			switch {
+			case test.ok && err != nil:
+				t.Fatalf("rejected valid link: %v", err)
+			case test.ok && *link != valid:
+				t.Fatalf("got link %+v, want %+v", *link, valid)
+			case !test.ok && status.Code(err) != codes.Unauthenticated:
+				t.Fatalf("got link %+v and error %v, want UNAUTHENTICATED", link, err)
+			}
+		})
+	}
+}
+
+func TestShareDownload(t *testing.T) {
+	s := newShareService(t, bytes.Repeat([]byte("k"), minShareKeySize))
+	expires := time.Now().Add(time.Hour).Unix()
+	unlimited, err := s.signShareLink(shareLink{ID: "unlimited", Path: "shared", Expires: expires})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited, err := s.signShareLink(shareLink{ID: "limited", Path: "shared/file", Expires: expires, MaxDownloads: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		req  *filesystem.DownloadRequest
+		want string
+		code codes.Code
+	}{
+		{"shared path", &filesystem.DownloadRequest{ShareToken: unlimited}, "shared", codes.OK},
+		{"inside shared path", &filesystem.DownloadRequest{ShareToken: unlimited, Path: "shared/file"}, "shared/file", codes.OK},
+		{"outside shared path", &filesystem.DownloadRequest{ShareToken: unlimited, Path: "other"}, "", codes.PermissionDenied},
+		{"sibling with shared prefix", &filesystem.DownloadRequest{ShareToken: unlimited, Path: "shared-not"}, "", codes.PermissionDenied},
+		{"escaping shared path", &filesystem.DownloadRequest{ShareToken: unlimited, Path: "shared/../other"}, "", codes.PermissionDenied},
+		{"sharded", &filesystem.DownloadRequest{ShareToken: unlimited, Shards: 2}, "", codes.InvalidArgument},
+		{"first limited download", &filesystem.DownloadRequest{ShareToken: limited}, "shared/file", codes.OK},
+		{"second limited download", &filesystem.DownloadRequest{ShareToken: limited}, "shared/file", codes.OK},
+		{"limit reached", &filesystem.DownloadRequest{ShareToken: limited}, "", codes.PermissionDenied},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name, err := s.shareDownload(test.req)
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("got error %v, want %s", err, test.code)
+			}
+			if name != test.want {
+				t.Fatalf("got path %q, want %q", name, test.want)
+			}
+		})
+	}
+}
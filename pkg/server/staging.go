@@ -0,0 +1,141 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+
+	"github.com/RGood/fs-xfer/pkg/files"
+	filesystem "github.com/RGood/fs-xfer/pkg/generated/filesystem"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// stagingDir holds uploads while they're received, so readers never see them half written.
+// Like every top level name starting with a dot, it can't be reached through the RPCs.
+const stagingDir = ".staging"
+
+// stagingName returns where the session with the given id writes until it's committed.
+func stagingName(id string) string {
+	return path.Join(stagingDir, id)
+}
+
+// recoverStaging removes the staged uploads left behind by a server that stopped before committing them.
+// Sessions only live in memory, so none of them can be resumed.
+func (s *StorageService) recoverStaging() {
+	entries, err := s.backend.ReadDir(stagingDir)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			fmt.Printf("Could not read staged uploads: %v\n", err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		name := path.Join(stagingDir, entry.Name())
+		if err := s.backend.RemoveAll(name); err != nil {
+			fmt.Printf("Could not remove stale staged upload %s: %v\n", name, err)
+			continue
+		}
+		fmt.Printf("Removed stale staged upload: %s\n", name)
+	}
+}
+
+// commit creates the hardlinks of a finished session and moves it from the staging area to its destination,
+// applying its overwrite policy to whatever is there by now, and records when it expires.
+func (s *StorageService) commit(u *uploadSession) error {
+	s.expiryMu.Lock()
+	defer s.expiryMu.Unlock()
+
+	merged, err := s.place(u)
+	if err != nil {
+		return err
+	}
+	return s.setExpiry(u, merged)
+}
+
+// place moves a finished session from the staging area to its destination and reports whether it was merged into an existing directory.
+func (s *StorageService) place(u *uploadSession) (bool, error) {
+	s.packMu.Lock()
+	defer s.packMu.Unlock()
+
+	// Kept files that hardlinks may point at have to be unpacked first
+	if err := s.unpack(u.upload); err != nil {
+		return false, err
+	}
+	if err := u.createLinks(); err != nil {
+		return false, err
+	}
+
+	// A symlink created since the session began must not lead it somewhere else
+	if err := files.CheckParents(s.backend, ".", u.dest); err != nil {
+		return false, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	info, err := s.backend.Lstat(u.dest)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return false, s.backend.Rename(u.dir, u.dest)
+	case err != nil:
+		return false, err
+	case u.overwrite == filesystem.OverwritePolicy_FAIL:
+		return false, status.Errorf(codes.AlreadyExists, "%s already exists", u.dest)
+	case u.overwrite == filesystem.OverwritePolicy_REPLACE:
+		return false, s.replace(u.dir, u.dest, stagingName(u.id+".old"))
+	case !info.IsDir():
+		return false, status.Errorf(codes.FailedPrecondition, "%s is not a directory", u.dest)
+	}
+
+	if err := s.merge(u.dir, u.dest, u.overwrite == filesystem.OverwritePolicy_MERGE); err != nil {
+		return true, err
+	}
+	return true, s.backend.RemoveAll(u.dir)
+}
+
+// replace swaps dst for src, parking dst at old until src is in its place.
+func (s *StorageService) replace(src string, dst string, old string) error {
+	if err := s.backend.Rename(dst, old); err != nil {
+		return err
+	}
+	if err := s.backend.Rename(src, dst); err != nil {
+		if restoreErr := s.backend.Rename(old, dst); restoreErr != nil {
+			return fmt.Errorf("could not restore %s after failing to replace it: %v", dst, restoreErr)
+		}
+		return err
+	}
+	return s.backend.RemoveAll(old)
+}
+
+// merge moves everything under src into the existing directory dst. Entries that are in the way are replaced if overwrite is set and kept otherwise.
+func (s *StorageService) merge(src string, dst string, overwrite bool) error {
+	entries, err := s.backend.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		from, to := path.Join(src, entry.Name()), path.Join(dst, entry.Name())
+
+		info, err := s.backend.Lstat(to)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			err = s.backend.Rename(from, to)
+		case err != nil:
+		case entry.IsDir() && info.IsDir():
+			err = s.merge(from, to, overwrite)
+		case !overwrite:
+		case entry.IsDir() || info.IsDir():
+			// Renaming only replaces entries of the same kind
+			if err = s.backend.RemoveAll(to); err == nil {
+				err = s.backend.Rename(from, to)
+			}
+		default:
+			err = s.backend.Rename(from, to)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+
+	filesystem "github.com/RGood/fs-xfer/pkg/generated/filesystem"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStagingRecovery(t *testing.T) {
+	s, root := newTestService(t)
+	c := dial(t, s)
+	ctx := context.Background()
+
+	committed := commitChunks(t, c, &filesystem.File{Name: "a", Data: []byte("kept")})
+
+	session, err := c.BeginUpload(ctx, &filesystem.BeginUploadRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := uploadChunks(c, session.GetId(), &filesystem.File{Name: "b", Data: []byte("half")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Uploads stay invisible until they're committed
+	if _, err := c.Stat(ctx, &filesystem.StatRequest{Path: session.GetId()}); status.Code(err) != codes.NotFound {
+		t.Fatalf("stat of an uncommitted upload returned %v, want NotFound", err)
+	}
+	if _, err := c.Stat(ctx, &filesystem.StatRequest{Path: stagingDir}); status.Code(err) == codes.OK {
+		t.Fatal("the staging area can be reached through the RPCs")
+	}
+
+	// A server starting over the same root after a crash removes what the old one staged
+	restarted := NewLocalStorageService(root)
+	t.Cleanup(restarted.Close)
+
+	if _, err := restarted.backend.Lstat(stagingName(session.GetId())); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("stale staged upload has error %v after a restart, want it removed", err)
+	}
+	checkContent(t, restarted, map[string][]byte{
+		committed + "/a":       []byte("kept"),
+		session.GetId() + "/b": nil,
+	})
+}
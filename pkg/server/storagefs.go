@@ -0,0 +1,48 @@
+package server
+
+import (
+	"io/fs"
+	"strings"
+)
+
+// storageFS is the read-only view of the backend that the listing and download RPCs use.
+// Uploads packed into the chunk store appear as ordinary directories.
+type storageFS struct {
+	root  fs.FS
+	store *ChunkStore
+}
+
+func newStorageFS(root fs.FS, store *ChunkStore) *storageFS {
+	return &storageFS{root: root, store: store}
+}
+
+func (f *storageFS) Open(name string) (fs.File, error) {
+	fsys, name := f.route(name)
+	return fsys.Open(name)
+}
+
+func (f *storageFS) Lstat(name string) (fs.FileInfo, error) {
+	fsys, name := f.route(name)
+	return fs.Lstat(fsys, name)
+}
+
+func (f *storageFS) ReadLink(name string) (string, error) {
+	fsys, name := f.route(name)
+	return fs.ReadLink(fsys, name)
+}
+
+// route returns the file system holding name, which is either the backend or a packed upload, and the name within it.
+func (f *storageFS) route(name string) (fs.FS, string) {
+	if f.store != nil && fs.ValidPath(name) {
+		id, rest, _ := strings.Cut(name, "/")
+		if rest == "" {
+			rest = "."
+		}
+
+		if m, ok := f.store.open(id); ok {
+			return f.store.fsFor(m), rest
+		}
+	}
+
+	return f.root, name
+}
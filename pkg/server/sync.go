@@ -0,0 +1,284 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/RGood/fs-xfer/pkg/backend"
+	"github.com/RGood/fs-xfer/pkg/delta"
+	"github.com/RGood/fs-xfer/pkg/files"
+	filesystem "github.com/RGood/fs-xfer/pkg/generated/filesystem"
+	"github.com/RGood/fs-xfer/pkg/units"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxTreeEntries bounds how many entries each GetTree message carries.
+const maxTreeEntries = 1000
+
+func (s *StorageService) GetTree(req *filesystem.TreeRequest, stream filesystem.StorageService_GetTreeServer) error {
+	name, err := s.getName(req.GetPath())
+	if err != nil {
+		return err
+	}
+	if err := s.authorize(stream.Context(), OpList, name); err != nil {
+		return err
+	}
+
+	entries, err := files.TreeFS(s.fsys, name, req.GetChecksums())
+	if err != nil {
+		return err
+	}
+
+	for len(entries) > 0 {
+		n := min(len(entries), maxTreeEntries)
+		if err := stream.Send(&filesystem.TreeResponse{Entries: entries[:n]}); err != nil {
+			return err
+		}
+		entries = entries[n:]
+	}
+	return nil
+}
+
+func (s *StorageService) BeginSync(stream filesystem.StorageService_BeginSyncServer) error {
+	req, err := recvSyncRequest(stream)
+	if err != nil {
+		return err
+	}
+
+	session, err := s.beginSync(stream.Context(), req)
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(session)
+}
+
+// recvSyncRequest reads every message of a BeginSync stream into a single request.
+func recvSyncRequest(stream filesystem.StorageService_BeginSyncServer) (*filesystem.BeginSyncRequest, error) {
+	req, err := stream.Recv()
+	if err == io.EOF {
+		return nil, status.Error(codes.InvalidArgument, "empty sync request")
+	} else if err != nil {
+		return nil, err
+	}
+
+	for {
+		next, err := stream.Recv()
+		if err == io.EOF {
+			return req, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		req.Files = append(req.Files, next.GetFiles()...)
+		req.Delete = append(req.Delete, next.GetDelete()...)
+		req.Delta = append(req.Delta, next.GetDelta()...)
+	}
+}
+
+func (s *StorageService) beginSync(ctx context.Context, req *filesystem.BeginSyncRequest) (*filesystem.UploadSession, error) {
+	name, err := s.getName(req.GetPath())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, OpWrite, name); err != nil {
+		return nil, err
+	}
+	for _, relPath := range req.GetDelete() {
+		if err := s.authorize(ctx, OpDelete, resolveRelative(name, relPath)); err != nil {
+			return nil, err
+		}
+	}
+	upload, _, _ := strings.Cut(name, "/")
+
+	// The upload stays unpacked until the session is committed
+	s.packMu.Lock()
+	defer s.packMu.Unlock()
+
+	if err := s.unpack(upload); err != nil {
+		return nil, err
+	}
+
+	if err := files.CheckParents(s.backend, ".", name); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	info, err := s.backend.Lstat(name)
+	if err != nil {
+		return nil, statusOf(err)
+	}
+	if !info.IsDir() {
+		return nil, status.Errorf(codes.FailedPrecondition, "sync target is not a directory: %s", req.GetPath())
+	}
+
+	// Syncs are staged like any upload and merged into the directory they sync once committed
+	session := newUploadSession(s.backend, uuid.NewString())
+	session.dest, session.overwrite, session.upload = name, filesystem.OverwritePolicy_MERGE, upload
+	session.target = req.GetPath()
+	session.principal = PrincipalFrom(ctx)
+	session.mtimes = map[string]time.Time{}
+	session.dirs = map[string]bool{}
+	for _, entry := range req.GetFiles() {
+		switch entry.GetType() {
+		case filesystem.EntryType_REGULAR:
+			session.mtimes[entry.GetPath()] = time.Unix(0, entry.GetMtime())
+		case filesystem.EntryType_DIRECTORY:
+			session.dirs[resolveRelative(name, entry.GetPath())] = true
+		}
+	}
+	session.deletes = req.GetDelete()
+	session.delta = map[string]bool{}
+	for _, relPath := range req.GetDelta() {
+		session.delta[relPath] = true
+	}
+
+	if err := s.backend.MkdirAll(session.dir); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.sessions[session.id] = session
+	s.mu.Unlock()
+	s.track(session)
+
+	return session.toProto(), nil
+}
+
+// maxSignatureBlocks limits how many block signatures are sent in one message.
+const maxSignatureBlocks = 16 * 1024
+
+func (s *StorageService) GetSignatures(req *filesystem.SignatureRequest, stream filesystem.StorageService_GetSignaturesServer) error {
+	name, err := s.getName(req.GetPath())
+	if err != nil {
+		return err
+	}
+	if err := s.authorize(stream.Context(), OpRead, name); err != nil {
+		return err
+	}
+
+	for _, relPath := range req.GetFiles() {
+		sig, err := s.signFile(resolveRelative(name, relPath))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		sig.Path = relPath
+
+		blocks := sig.GetBlocks()
+		for first := true; first || len(blocks) > 0; first = false {
+			n := min(len(blocks), maxSignatureBlocks)
+			if err := stream.Send(&filesystem.FileSignature{
+				Path:      sig.GetPath(),
+				BlockSize: sig.GetBlockSize(),
+				Size:      sig.GetSize(),
+				Blocks:    blocks[:n],
+			}); err != nil {
+				return err
+			}
+			blocks = blocks[n:]
+		}
+	}
+
+	return nil
+}
+
+func (s *StorageService) signFile(name string) (*filesystem.FileSignature, error) {
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fs.ErrNotExist
+	}
+
+	return delta.Sign(f, info.Size())
+}
+
+// applySync sets the modification times of synced files and removes the entries the client no longer has, once the session is in place.
+func (u *uploadSession) applySync() error {
+	for relPath, mtime := range u.mtimes {
+		if err := u.backend.Chtimes(resolveRelative(u.dest, relPath), mtime); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	for _, relPath := range u.deletes {
+		target := resolveRelative(u.dest, relPath)
+		if target == u.dest {
+			continue
+		}
+		// Entries in directories the sync replaced with files or symlinks went away with them
+		if info, err := u.backend.Lstat(path.Dir(target)); err != nil || !info.IsDir() || files.CheckParents(u.backend, u.dest, relPath) != nil {
+			continue
+		}
+		if err := u.backend.Remove(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		pruneEmptyDirs(u.backend, u.dest, path.Dir(target), u.dirs)
+	}
+
+	return nil
+}
+
+// pruneEmptyDirs removes dir and its parents up to, but not including, root for as long as they are empty and not in keep.
+func pruneEmptyDirs(b backend.Backend, root string, dir string, keep map[string]bool) {
+	for ; dir != root && len(dir) > len(root) && !keep[dir]; dir = path.Dir(dir) {
+		if err := b.Remove(dir); err != nil {
+			return
+		}
+	}
+}
+
+// pack moves a finished upload into the chunk store, unless another session is still writing to it.
+func (s *StorageService) pack(upload string) error {
+	if s.store == nil {
+		return nil
+	}
+
+	s.packMu.Lock()
+	defer s.packMu.Unlock()
+
+	s.mu.Lock()
+	for _, other := range s.sessions {
+		if other.upload == upload {
+			s.mu.Unlock()
+			return nil
+		}
+	}
+	s.mu.Unlock()
+
+	added, err := s.store.Ingest(upload, s.backend, upload)
+	if err != nil {
+		return fmt.Errorf("could not pack upload %s: %v", upload, err)
+	}
+
+	fmt.Printf("Packed %s into the chunk store. %s bytes were new.\n", upload, units.FormatBytesIEC(added))
+	return s.backend.RemoveAll(upload)
+}
+
+// unpack restores a packed upload to plain files so it can be modified. s.packMu must be held.
+func (s *StorageService) unpack(upload string) error {
+	if s.store == nil || !s.store.Has(upload) {
+		return nil
+	}
+
+	if err := s.store.Extract(upload, s.backend, upload); err != nil {
+		s.backend.RemoveAll(upload)
+		return fmt.Errorf("could not unpack upload %s: %v", upload, err)
+	}
+
+	return s.store.Delete(upload)
+}
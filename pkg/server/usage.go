@@ -0,0 +1,293 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"sync"
+
+	filesystem "github.com/RGood/fs-xfer/pkg/generated/filesystem"
+	"github.com/RGood/fs-xfer/pkg/units"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Quotas limit the size of the files the server stores, in bytes. Zero leaves a limit unset.
+// Uploads are checked as their chunks arrive and fail with RESOURCE_EXHAUSTED once they'd exceed a limit.
+type Quotas struct {
+	// Upload caps the size of a single upload or sync.
+	Upload int64
+	// Principal caps the size of the uploads each principal owns, along with what it's still uploading.
+	Principal int64
+	// Total caps the size of everything stored, along with everything still being uploaded.
+	Total int64
+}
+
+// WithQuotas enforces the given quotas on uploads.
+func WithQuotas(q Quotas) Option {
+	return func(s *StorageService) {
+		s.quotas = q
+	}
+}
+
+// ownersFile records the principal that created each upload.
+const ownersFile = ".owners.json"
+
+// usage tracks the size of every upload and who owns it, so quotas are checked without walking the storage for every chunk.
+type usage struct {
+	mu sync.Mutex
+	// sizes holds the size of the regular files in each upload, and total and principals their sums.
+	// They're measured when first needed and kept up to date as uploads change.
+	sizes      map[string]int64
+	total      int64
+	principals map[string]int64
+	// owners maps each upload to the principal that created it. It's loaded when first needed.
+	// Uploads created before owners were recorded count as the anonymous principal's.
+	owners map[string]string
+	// active holds the sessions receiving data. What they've received counts against quotas before it's committed.
+	active map[*uploadSession]bool
+}
+
+func newUsage() *usage {
+	return &usage{active: map[*uploadSession]bool{}}
+}
+
+// loadOwners reads the owner of every upload. s.usage.mu must be held.
+func (s *StorageService) loadOwners() error {
+	if s.usage.owners != nil {
+		return nil
+	}
+
+	owners := map[string]string{}
+	data, err := fs.ReadFile(s.backend, ownersFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	} else if err == nil {
+		if err := json.Unmarshal(data, &owners); err != nil {
+			return fmt.Errorf("could not read %s: %v", ownersFile, err)
+		}
+	}
+
+	s.usage.owners = owners
+	return nil
+}
+
+// saveOwners writes the owner of every upload. s.usage.mu must be held.
+func (s *StorageService) saveOwners() error {
+	data, err := json.Marshal(s.usage.owners)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(s.backend, ownersFile, data)
+}
+
+// loadUsage measures every upload. s.usage.mu must be held.
+func (s *StorageService) loadUsage() error {
+	if s.usage.sizes != nil {
+		return nil
+	}
+	if err := s.loadOwners(); err != nil {
+		return err
+	}
+
+	entries, err := s.backend.ReadDir(".")
+	if err != nil {
+		return err
+	}
+	var uploads []string
+	for _, entry := range entries {
+		// Top level names starting with a dot hold server state
+		if !strings.HasPrefix(entry.Name(), ".") {
+			uploads = append(uploads, entry.Name())
+		}
+	}
+	if s.store != nil {
+		uploads = append(uploads, s.store.Uploads()...)
+	}
+
+	s.usage.sizes, s.usage.total, s.usage.principals = map[string]int64{}, 0, map[string]int64{}
+	for _, upload := range uploads {
+		if err := s.measure(upload); err != nil {
+			s.usage.sizes = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// measure updates the recorded size of upload, dropping it along with its owner once it's gone. s.usage.mu must be held.
+func (s *StorageService) measure(upload string) error {
+	var size int64
+	err := fs.WalkDir(s.fsys, upload, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	gone := errors.Is(err, fs.ErrNotExist)
+	if err != nil && !gone {
+		return err
+	}
+
+	owner := s.usage.owners[upload]
+	s.usage.total += size - s.usage.sizes[upload]
+	s.usage.principals[owner] += size - s.usage.sizes[upload]
+	s.usage.sizes[upload] = size
+	if !gone {
+		return nil
+	}
+
+	delete(s.usage.sizes, upload)
+	if _, ok := s.usage.owners[upload]; ok {
+		delete(s.usage.owners, upload)
+		return s.saveOwners()
+	}
+	return nil
+}
+
+// claim makes principal the owner of upload, unless it already has one.
+func (s *StorageService) claim(upload string, principal string) error {
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+
+	if err := s.loadOwners(); err != nil {
+		return err
+	}
+	if _, ok := s.usage.owners[upload]; ok {
+		return nil
+	}
+
+	s.usage.owners[upload] = principal
+	if s.usage.sizes != nil {
+		size := s.usage.sizes[upload]
+		s.usage.principals[""] -= size
+		s.usage.principals[principal] += size
+	}
+	return s.saveOwners()
+}
+
+// remeasure updates the recorded size of uploads that changed. Nothing is measured until the usage is first needed.
+func (s *StorageService) remeasure(uploads ...string) {
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+
+	if s.usage.sizes == nil {
+		return
+	}
+	for _, upload := range uploads {
+		if err := s.measure(upload); err != nil {
+			fmt.Printf("Could not measure upload %s: %v\n", upload, err)
+		}
+	}
+}
+
+// track counts what the session receives against quotas until it's untracked.
+func (s *StorageService) track(u *uploadSession) {
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+
+	s.usage.active[u] = true
+	if s.quotas != (Quotas{}) {
+		u.quota = func(n int64) error {
+			return s.reserve(u, n)
+		}
+	}
+}
+
+// untrack stops counting what the session received against quotas, once it's committed or has failed.
+func (s *StorageService) untrack(u *uploadSession) {
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+
+	delete(s.usage.active, u)
+}
+
+// settle records the owner and new size of the upload a session committed to, and stops counting the session itself.
+func (s *StorageService) settle(u *uploadSession) {
+	// Syncs only change uploads that already exist
+	if u.delta == nil {
+		if err := s.claim(u.upload, u.principal); err != nil {
+			fmt.Printf("Could not record the owner of upload %s: %v\n", u.upload, err)
+		}
+	}
+	s.remeasure(u.upload)
+	s.untrack(u)
+}
+
+// reserve counts n more bytes against quotas for the session, or fails if they would exceed a quota.
+// Checking and reserving under s.usage.mu keeps concurrent streams from all passing the check against the same usage.
+func (s *StorageService) reserve(u *uploadSession, n int64) error {
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+
+	if err := s.loadUsage(); err != nil {
+		return err
+	}
+
+	total, principal := s.usage.total, s.usage.principals[u.principal]
+	for other := range s.usage.active {
+		size := other.bytesCharged()
+		total += size
+		if other.principal == u.principal {
+			principal += size
+		}
+	}
+
+	switch {
+	case s.quotas.Upload > 0 && u.bytesCharged()+n > s.quotas.Upload:
+		return quotaExceeded("upload", s.quotas.Upload, u.bytesCharged(), n)
+	case s.quotas.Principal > 0 && principal+n > s.quotas.Principal:
+		return quotaExceeded(fmt.Sprintf("principal %q", u.principal), s.quotas.Principal, principal, n)
+	case s.quotas.Total > 0 && total+n > s.quotas.Total:
+		return quotaExceeded("server", s.quotas.Total, total, n)
+	}
+
+	u.mu.Lock()
+	u.reserved += n
+	u.mu.Unlock()
+	return nil
+}
+
+// quotaExceeded reports that n more bytes don't fit in what's left of a quota.
+func quotaExceeded(what string, limit int64, used int64, n int64) error {
+	return status.Errorf(codes.ResourceExhausted, "%s quota of %s (%d bytes) exceeded: %s (%d bytes) used, %d more bytes received",
+		what, units.FormatBytesIEC(limit), limit, units.FormatBytesIEC(used), used, n)
+}
+
+// GetUsage reports how much the calling principal and the whole server store, along with the quotas that apply.
+func (s *StorageService) GetUsage(ctx context.Context, req *filesystem.UsageRequest) (*filesystem.UsageResponse, error) {
+	principal := PrincipalFrom(ctx)
+
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+
+	if err := s.loadUsage(); err != nil {
+		return nil, statusOf(err)
+	}
+
+	res := &filesystem.UsageResponse{
+		Principal:   principal,
+		Used:        s.usage.principals[principal],
+		Quota:       s.quotas.Principal,
+		TotalUsed:   s.usage.total,
+		TotalQuota:  s.quotas.Total,
+		UploadQuota: s.quotas.Upload,
+	}
+	for other := range s.usage.active {
+		size := other.bytesCharged()
+		res.TotalUsed += size
+		if other.principal == principal {
+			res.Used += size
+		}
+	}
+	return res, nil
+}
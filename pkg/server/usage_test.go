@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/RGood/fs-xfer/pkg/backend"
+	filesystem "github.com/RGood/fs-xfer/pkg/generated/filesystem"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// failingBackend fails every write to a file whose name contains "fail".
+type failingBackend struct {
+	backend.Backend
+}
+
+func (b failingBackend) Create(name string, truncate bool) (backend.Writer, error) {
+	w, err := b.Backend.Create(name, truncate)
+	if err != nil || !strings.Contains(name, "fail") {
+		return w, err
+	}
+	return failingWriter{w}, nil
+}
+
+type failingWriter struct {
+	backend.Writer
+}
+
+func (failingWriter) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("disk on fire")
+}
+
+// totalUsed returns how many bytes the server reports it stores, counting uploads in progress.
+func totalUsed(t *testing.T, c filesystem.StorageServiceClient) int64 {
+	t.Helper()
+
+	res, err := c.GetUsage(context.Background(), &filesystem.UsageRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.GetTotalUsed()
+}
+
+func TestUploadQuota(t *testing.T) {
+	s, _ := newTestService(t, WithQuotas(Quotas{Upload: 10}))
+	c := dial(t, s)
+	ctx := context.Background()
+
+	session, err := c.BeginUpload(ctx, &filesystem.BeginUploadRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := session.GetId()
+
+	// Chunks sent again only count once
+	for range 2 {
+		if err := uploadChunks(c, id, &filesystem.File{Name: "a", Data: []byte("12345678")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := totalUsed(t, c); got != 8 {
+		t.Fatalf("usage is %d bytes with 8 received, want 8", got)
+	}
+
+	err = uploadChunks(c, id, &filesystem.File{Name: "b", Data: []byte("12345")})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("upload going over its quota returned %v, want ResourceExhausted", err)
+	}
+
+	// The session is dropped along with what it staged once its last stream ends
+	if _, err := c.ResumeUpload(ctx, &filesystem.ResumeUploadRequest{Id: id}); status.Code(err) != codes.NotFound {
+		t.Fatalf("resuming a session over its quota returned %v, want NotFound", err)
+	}
+	if _, err := s.backend.Lstat(stagingName(id)); err == nil {
+		t.Fatal("session over its quota left its staged files behind")
+	}
+	if got := totalUsed(t, c); got != 0 {
+		t.Fatalf("usage is %d bytes after the session was dropped, want 0", got)
+	}
+}
+
+func TestTotalQuota(t *testing.T) {
+	s, _ := newTestService(t, WithQuotas(Quotas{Total: 10}))
+	c := dial(t, s)
+	ctx := context.Background()
+
+	first := commitChunks(t, c, &filesystem.File{Name: "a", Data: []byte("123456")})
+
+	session, err := c.BeginUpload(ctx, &filesystem.BeginUploadRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = uploadChunks(c, session.GetId(), &filesystem.File{Name: "a", Data: []byte("12345")})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("upload going over the server's quota returned %v, want ResourceExhausted", err)
+	}
+	if got := totalUsed(t, c); got != 6 {
+		t.Fatalf("usage is %d bytes with a 6 byte upload stored, want 6", got)
+	}
+
+	// Deleting an upload frees its bytes
+	if _, err := c.Delete(ctx, &filesystem.DeleteRequest{Path: first, Recursive: true}); err != nil {
+		t.Fatal(err)
+	}
+	commitChunks(t, c, &filesystem.File{Name: "a", Data: []byte("12345")})
+	if got := totalUsed(t, c); got != 5 {
+		t.Fatalf("usage is %d bytes with a 5 byte upload stored, want 5", got)
+	}
+}
+
+func TestQuotaReleasedOnFailedWrite(t *testing.T) {
+	s := NewStorageService(failingBackend{backend.NewMemory()}, WithQuotas(Quotas{Total: 10}))
+	t.Cleanup(s.Close)
+	c := dial(t, s)
+	ctx := context.Background()
+
+	session, err := c.BeginUpload(ctx, &filesystem.BeginUploadRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := uploadChunks(c, session.GetId(), &filesystem.File{Name: "fail", Data: []byte("12345678")}); err == nil {
+		t.Fatal("write to a failing file succeeded")
+	}
+	if got := totalUsed(t, c); got != 0 {
+		t.Fatalf("usage is %d bytes after a failed write, want 0", got)
+	}
+
+	// The bytes reserved for the failed write are available again
+	if err := uploadChunks(c, session.GetId(), &filesystem.File{Name: "a", Data: []byte("12345678")}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReserveConcurrently(t *testing.T) {
+	s, _ := newTestService(t, WithQuotas(Quotas{Principal: 10, Total: 15}))
+
+	alice, bob := newUploadSession(s.backend, "alice"), newUploadSession(s.backend, "bob")
+	alice.principal, bob.principal = "alice", "bob"
+	s.track(alice)
+	s.track(bob)
+
+	// Streams checking at once must not all pass against the same usage
+	var wg sync.WaitGroup
+	var reserved atomic.Int64
+	for i := range 40 {
+		u := alice
+		if i%2 == 1 {
+			u = bob
+		}
+		wg.Go(func() {
+			if err := u.quota(1); err == nil {
+				reserved.Add(1)
+			} else if status.Code(err) != codes.ResourceExhausted {
+				t.Error(err)
+			}
+		})
+	}
+	wg.Wait()
+
+	if got := reserved.Load(); got != 15 {
+		t.Fatalf("reserved %d bytes under a quota of 15", got)
+	}
+	if got := alice.bytesCharged(); got > 10 {
+		t.Fatalf("alice reserved %d bytes under a quota of 10", got)
+	}
+	if got := bob.bytesCharged(); got > 10 {
+		t.Fatalf("bob reserved %d bytes under a quota of 10", got)
+	}
+}